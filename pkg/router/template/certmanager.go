@@ -114,6 +114,14 @@ func (cm *simpleCertificateManager) WriteCertificatesForConfig(config *ServiceAl
 			}
 		}
 	}
+
+	for id, contents := range clientCertFiles(config) {
+		clientCertFile := certificateFile{certDir: cm.cfg.caCertDir, id: id}
+		delete(cm.deletedCertificates, clientCertFile.Tag())
+		if err := cm.w.WriteCertificate(cm.cfg.caCertDir, id, []byte(contents)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -143,9 +151,43 @@ func (cm *simpleCertificateManager) DeleteCertificatesForConfig(config *ServiceA
 			}
 		}
 	}
+
+	if hasClientCertAnnotations(config) {
+		key := string(routeKeyFromParts(config.Namespace, config.Name))
+		for _, postfix := range []string{clientCAPostfix, clientCRLPostfix} {
+			clientCertFile := certificateFile{certDir: cm.cfg.caCertDir, id: key + postfix}
+			cm.deletedCertificates[clientCertFile.Tag()] = clientCertFile
+		}
+	}
 	return nil
 }
 
+// hasClientCertAnnotations returns true if the route has a client CA or
+// CRL annotation, which are written to files in the CA certificate
+// directory.
+func hasClientCertAnnotations(config *ServiceAliasConfig) bool {
+	return len(config.Annotations[clientCAAnnotation]) > 0 || len(config.Annotations[clientCRLAnnotation]) > 0
+}
+
+// clientCertFiles returns the contents of the client CA and CRL files of a
+// route keyed by their id, which is the route key followed by the file
+// postfix. Annotations that do not hold a valid CA or CRL are skipped.
+func clientCertFiles(config *ServiceAliasConfig) map[string]string {
+	files := make(map[string]string)
+	if !hasClientCertAnnotations(config) {
+		return files
+	}
+
+	key := string(routeKeyFromParts(config.Namespace, config.Name))
+	if ca := clientCAData(*config); len(ca) > 0 {
+		files[key+clientCAPostfix] = ca
+	}
+	if crl := clientCRLData(*config); len(crl) > 0 {
+		files[key+clientCRLPostfix] = crl
+	}
+	return files
+}
+
 // Commit applies any pending changes made to the certificateManager.
 func (cm *simpleCertificateManager) Commit() error {
 	// Deletion of certificates that are being referenced in backends or
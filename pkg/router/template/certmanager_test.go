@@ -86,6 +86,34 @@ func TestCertManager(t *testing.T) {
 			expectedAdds:    []string{},
 			expectedDeletes: []string{},
 		},
+		"add client ca and crl": {
+			cfg: &ServiceAliasConfig{
+				Namespace:      "ns",
+				Name:           "route",
+				Host:           "www.example.com",
+				TLSTermination: routev1.TLSTerminationEdge,
+				Annotations: map[string]string{
+					clientCAAnnotation:  testCACertificate,
+					clientCRLAnnotation: testClientCRL,
+				},
+			},
+			expectedAdds:    []string{cfg.caCertDir + "ns:route" + clientCAPostfix, cfg.caCertDir + "ns:route" + clientCRLPostfix},
+			expectedDeletes: []string{cfg.caCertDir + "ns:route" + clientCAPostfix, cfg.caCertDir + "ns:route" + clientCRLPostfix},
+		},
+		"add invalid client ca": {
+			//nothing is written for an invalid ca, but a previously written file is still deleted
+			cfg: &ServiceAliasConfig{
+				Namespace:      "ns",
+				Name:           "route",
+				Host:           "www.example.com",
+				TLSTermination: routev1.TLSTerminationEdge,
+				Annotations: map[string]string{
+					clientCAAnnotation: "not a certificate",
+				},
+			},
+			expectedAdds:    []string{},
+			expectedDeletes: []string{cfg.caCertDir + "ns:route" + clientCAPostfix, cfg.caCertDir + "ns:route" + clientCRLPostfix},
+		},
 		"add cert no tls termination type": {
 			cfg: &ServiceAliasConfig{
 				Host: "www.example.com",
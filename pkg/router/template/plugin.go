@@ -23,6 +23,10 @@ import (
 const (
 	// endpointsKeySeparator is used to uniquely generate key/ID for endpoints
 	endpointsKeySeparator = "/"
+
+	// endpointWeightsAnnotation sets per-pod endpoint weights as a
+	// whitespace separated list of <pod name>=<weight> pairs.
+	endpointWeightsAnnotation = "haproxy.router.openshift.io/endpoint-weights"
 )
 
 // TemplatePlugin implements the router.Plugin interface to provide
@@ -319,6 +323,7 @@ func createRouterEndpoints(endpoints *kapi.Endpoints, excludeUDP bool, lookupSvc
 	}
 
 	out := make([]Endpoint, 0, len(endpoints.Subsets)*4)
+	weights := endpointWeights(endpoints)
 	// For checking if the endpoints ID is duplicated.
 	duplicated := map[string]bool{}
 
@@ -365,6 +370,8 @@ func createRouterEndpoints(endpoints *kapi.Endpoints, excludeUDP bool, lookupSvc
 					ep.AppProtocol = *p.AppProtocol
 				}
 
+				ep.Weight = weights[ep.TargetName]
+
 				// IdHash contains an obfuscated internal IP address
 				// that is the value passed in the cookie. The IP address
 				// is made more difficult to extract by including other
@@ -386,6 +393,27 @@ func createRouterEndpoints(endpoints *kapi.Endpoints, excludeUDP bool, lookupSvc
 	return out
 }
 
+// endpointWeights returns the per-pod weights set by the endpoint weights
+// annotation, keyed by pod name. The values are validated and clamped when
+// the configuration is rendered.
+func endpointWeights(endpoints *kapi.Endpoints) map[string]string {
+	value, ok := endpoints.Annotations[endpointWeightsAnnotation]
+	if !ok {
+		return nil
+	}
+
+	weights := map[string]string{}
+	for _, pair := range strings.Fields(value) {
+		name, weight, found := strings.Cut(pair, "=")
+		if !found || len(name) == 0 {
+			log.V(0).Info("endpointWeights found invalid weight", "namespace", endpoints.Namespace, "name", endpoints.Name, "value", pair)
+			continue
+		}
+		weights[name] = weight
+	}
+	return weights
+}
+
 func isServiceIPSet(service *kapi.Service) bool {
 	return service.Spec.ClusterIP != kapi.ClusterIPNone && service.Spec.ClusterIP != ""
 }
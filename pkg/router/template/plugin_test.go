@@ -553,6 +553,39 @@ func (r *fakeStatusRecorder) isUnservableInFutureVersions(route *routev1.Route)
 	return false
 }
 
+// TestCreateRouterEndpointsWeights tests that endpoint weights are set from
+// the endpoint weights annotation.
+func TestCreateRouterEndpointsWeights(t *testing.T) {
+	endpoints := &kapi.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+			Name:      "test",
+			Annotations: map[string]string{
+				endpointWeightsAnnotation: "pod-1=10 pod-2=300 invalid",
+			},
+		},
+		Subsets: []kapi.EndpointSubset{{
+			Addresses: []kapi.EndpointAddress{
+				{IP: "1.1.1.1", TargetRef: &kapi.ObjectReference{Kind: "Pod", Name: "pod-1"}},
+				{IP: "2.2.2.2", TargetRef: &kapi.ObjectReference{Kind: "Pod", Name: "pod-2"}},
+				{IP: "3.3.3.3", TargetRef: &kapi.ObjectReference{Kind: "Pod", Name: "pod-3"}},
+			},
+			Ports: []kapi.EndpointPort{{Port: 8080, Name: "port"}},
+		}},
+	}
+
+	expected := map[string]int{"pod-1": 10, "pod-2": 256, "pod-3": 1}
+	eps := createRouterEndpoints(endpoints, false, nil)
+	if len(eps) != len(expected) {
+		t.Fatalf("Expected %d endpoints, got %d", len(expected), len(eps))
+	}
+	for _, ep := range eps {
+		if got := endpointWeight(ep, 1); got != expected[ep.TargetName] {
+			t.Errorf("Expected weight %d for %s, got %d", expected[ep.TargetName], ep.TargetName, got)
+		}
+	}
+}
+
 // TestHandleRoute test route watch events
 func TestHandleRoute(t *testing.T) {
 	rejections := &fakeStatusRecorder{}
@@ -206,6 +206,9 @@ type templateData struct {
 	// that a certificate has been observed over various routes, used to
 	// detect duplicate certificates.
 	CertificateIndex map[string]int
+	// BackendIndexes maps the routes to their backend index, see
+	// backendIndexes.
+	BackendIndexes map[ServiceAliasConfigKey]int
 }
 
 func newTemplateRouter(cfg templateRouterCfg) (*templateRouter, error) {
@@ -597,6 +600,7 @@ func (r *templateRouter) writeConfig() error {
 	log.V(4).Info("router certificate manager config committed")
 
 	disableHTTP2, _ := strconv.ParseBool(os.Getenv("ROUTER_DISABLE_HTTP2"))
+	indexes := backendIndexes(r.state)
 
 	for name, template := range r.templates {
 		filename := filepath.Join(r.dir, name)
@@ -629,6 +633,7 @@ func (r *templateRouter) writeConfig() error {
 			HTTPResponseHeaders:           r.httpResponseHeaders,
 			HTTPRequestHeaders:            r.httpRequestHeaders,
 			CertificateIndex:              certificateIndex,
+			BackendIndexes:                indexes,
 		}
 		if err := template.Execute(file, data); err != nil {
 			file.Close()
@@ -1050,6 +1055,12 @@ func (r *templateRouter) createServiceAliasConfig(route *routev1.Route, backendK
 
 				config.Certificates[destCertKey] = destCert
 			}
+
+			if len(tls.Certificate) > 0 {
+				if complete, err := routeChainIsComplete(config); err == nil && !complete {
+					log.V(0).Info("certificate chain is missing intermediate certificates", "namespace", route.Namespace, "name", route.Name)
+				}
+			}
 		}
 	}
 
@@ -1059,6 +1070,10 @@ func (r *templateRouter) createServiceAliasConfig(route *routev1.Route, backendK
 func getHeadersList(httpHeaderList []routev1.RouteHTTPHeader) []HTTPHeader {
 	var httpHeadersList []HTTPHeader
 	for _, value := range httpHeaderList {
+		if value.Action.Type == routev1.Set && isHopByHopHeader(value.Name) {
+			log.V(0).Info("skipping set of hop-by-hop header", "header", value.Name)
+			continue
+		}
 		if value.Action.Type == routev1.Set && value.Action.Set != nil && len(value.Name) != 0 && len(value.Action.Set.Value) != 0 {
 			setHeaderValue := SanitizeHeaderValue(value.Action.Set.Value)
 
@@ -1246,6 +1261,11 @@ func (r *templateRouter) shouldWriteCerts(cfg *ServiceAliasConfig) bool {
 		return false
 	}
 
+	// Client CA and CRL files are written whatever the certificates
+	if hasClientCertAnnotations(cfg) {
+		return true
+	}
+
 	if cfg.Certificates == nil {
 		return false
 	}
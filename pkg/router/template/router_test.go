@@ -497,6 +497,68 @@ func TestCreateServiceAliasConfig(t *testing.T) {
 
 }
 
+// TestCreateServiceAliasConfigHopByHopHeaders validates that setting a
+// hop-by-hop header is dropped while deleting one is kept.
+func TestCreateServiceAliasConfigHopByHopHeaders(t *testing.T) {
+	router := NewFakeTemplateRouter()
+
+	setHeader := func(name, value string) routev1.RouteHTTPHeader {
+		return routev1.RouteHTTPHeader{
+			Name: name,
+			Action: routev1.RouteHTTPHeaderActionUnion{
+				Type: routev1.Set,
+				Set:  &routev1.RouteSetHTTPHeader{Value: value},
+			},
+		}
+	}
+	deleteHeader := func(name string) routev1.RouteHTTPHeader {
+		return routev1.RouteHTTPHeader{
+			Name:   name,
+			Action: routev1.RouteHTTPHeaderActionUnion{Type: routev1.Delete},
+		}
+	}
+
+	route := &routev1.Route{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+			Name:      "bar",
+		},
+		Spec: routev1.RouteSpec{
+			Host: "host",
+			To: routev1.RouteTargetReference{
+				Name: "TestService",
+			},
+			HTTPHeaders: &routev1.RouteHTTPHeaders{
+				Actions: routev1.RouteHTTPHeaderActions{
+					Response: []routev1.RouteHTTPHeader{
+						setHeader("Connection", "close"),
+						setHeader("X-Frame-Options", "DENY"),
+						deleteHeader("Keep-Alive"),
+					},
+					Request: []routev1.RouteHTTPHeader{
+						setHeader("Upgrade", "websocket"),
+						setHeader("transfer-encoding", "chunked"),
+						setHeader("X-Custom", "abc"),
+						deleteHeader("Upgrade"),
+						deleteHeader("Connection"),
+					},
+				},
+			},
+		},
+	}
+
+	config := *router.createServiceAliasConfig(route, "foo")
+
+	expectedResponseHeaders := []HTTPHeader{{Name: "'X-Frame-Options'", Value: "'DENY'", Action: "Set"}, {Name: "'Keep-Alive'", Action: "Delete"}}
+	expectedRequestHeaders := []HTTPHeader{{Name: "'X-Custom'", Value: "'abc'", Action: "Set"}, {Name: "'Upgrade'", Action: "Delete"}, {Name: "'Connection'", Action: "Delete"}}
+	if !cmp.Equal(config.HTTPResponseHeaders, expectedResponseHeaders) {
+		t.Errorf("Expected response headers %v, got %v", expectedResponseHeaders, config.HTTPResponseHeaders)
+	}
+	if !cmp.Equal(config.HTTPRequestHeaders, expectedRequestHeaders) {
+		t.Errorf("Expected request headers %v, got %v", expectedRequestHeaders, config.HTTPRequestHeaders)
+	}
+}
+
 // TestAddRoute validates that adding a route creates a service alias config and associated service units
 func TestAddRoute(t *testing.T) {
 	router := NewFakeTemplateRouter()
@@ -1,18 +1,28 @@
 package templaterouter
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/url"
 	"os"
 	"path"
+	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
+	"unicode"
 
 	routev1 "github.com/openshift/api/route/v1"
 	"github.com/openshift/router/pkg/router/routeapihelpers"
@@ -57,6 +67,45 @@ func cachedRegexpCompile(pattern string) (*regexp.Regexp, error) {
 	return v.(*regexp.Regexp), nil
 }
 
+// WarmRegexpCache compiles patterns into the compiledRegexp store so that
+// the first render does not pay for their compilation. Invalid patterns
+// are logged and skipped.
+func WarmRegexpCache(patterns []string) {
+	for _, pattern := range patterns {
+		if _, err := cachedRegexpCompile(pattern); err != nil {
+			log.Error(err, "unable to compile regexp", "pattern", pattern)
+		}
+	}
+}
+
+// EvictRegexpCache removes the compiled regular expressions of all
+// patterns not in keep from the compiledRegexp store, so that the store
+// does not grow with the patterns of routes that no longer exist.
+func EvictRegexpCache(keep []string) {
+	retain := make(map[string]bool, len(keep))
+	for _, pattern := range keep {
+		retain[pattern] = true
+	}
+
+	compiledRegexp.Range(func(key, _ interface{}) bool {
+		if pattern := key.(string); !retain[pattern] {
+			log.V(7).Info("evicting regexp", "pattern", pattern)
+			compiledRegexp.Delete(key)
+		}
+		return true
+	})
+}
+
+// RegexpCacheStats returns the number of compiled regular expressions in
+// the compiledRegexp store.
+func RegexpCacheStats() (entries int) {
+	compiledRegexp.Range(func(_, _ interface{}) bool {
+		entries++
+		return true
+	})
+	return entries
+}
+
 // matchString reports whether the string s contains any match in
 // pattern. Repeated re-compilations of the regular expression
 // (pattern) are avoided by utilising the cachedRegexpCompile store.
@@ -166,7 +215,7 @@ func genCertificateHostName(hostname string, wildcard bool) string {
 // the endpoints (does not change the return order if the data structure did not mutate)
 func processEndpointsForAlias(alias ServiceAliasConfig, svc ServiceUnit, action string) []Endpoint {
 	endpoints := endpointsForAlias(alias, svc)
-	if strings.ToLower(action) == "shuffle" {
+	if shouldShuffle(alias, action) {
 		for i := len(endpoints) - 1; i >= 0; i-- {
 			rIndex := rand.Intn(i + 1)
 			endpoints[i], endpoints[rIndex] = endpoints[rIndex], endpoints[i]
@@ -219,18 +268,121 @@ func generateHAProxyCertConfigMap(td templateData) []string {
 		backendConfig := backendConfig(string(k), cfg, hascert)
 		if entry := haproxyutil.GenerateMapEntry(certConfigMap, backendConfig); entry != nil {
 			fqCertPath := path.Join(td.WorkingDir, certDir, entry.Key)
-			if td.DisableHTTP2 || td.CertificateIndex[cert.Contents] > 1 {
-				lines = append(lines, strings.Join([]string{fqCertPath, entry.Value}, " "))
+			alpn := !td.DisableHTTP2 && td.CertificateIndex[cert.Contents] <= 1
+			if options := crtListOptions(cfg, alpn); len(options) > 0 {
+				lines = append(lines, strings.Join([]string{fqCertPath, options, entry.Value}, " "))
 			} else {
-				lines = append(lines, strings.Join([]string{fqCertPath, "[alpn h2,http/1.1]", entry.Value}, " "))
+				lines = append(lines, strings.Join([]string{fqCertPath, entry.Value}, " "))
 			}
 		}
 	}
 
-	sort.Sort(sort.Reverse(sort.StringSlice(lines)))
+	lines = dedupeCertLines(lines)
+	sortCertConfigMapLines(lines)
 	return lines
 }
 
+// dedupeCertLines returns the cert config map lines with exact duplicates
+// removed, preserving the order of first occurrence.
+func dedupeCertLines(lines []string) []string {
+	seen := make(map[string]bool, len(lines))
+	deduped := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if seen[line] {
+			continue
+		}
+		seen[line] = true
+		deduped = append(deduped, line)
+	}
+	return deduped
+}
+
+const (
+	// sslCiphersAnnotation sets the ciphers allowed for a route's
+	// certificate in the crt-list.
+	sslCiphersAnnotation = "haproxy.router.openshift.io/ssl-ciphers"
+
+	// sslMinVersionAnnotation sets the minimum TLS version allowed for a
+	// route's certificate in the crt-list.
+	sslMinVersionAnnotation = "haproxy.router.openshift.io/ssl-min-ver"
+)
+
+// sslCiphersRegexp matches an OpenSSL cipher list.
+var sslCiphersRegexp = regexp.MustCompile(`^[A-Za-z0-9_+!@=.:-]+$`)
+
+// crtListOptions returns the bracketed crt-list options for a route's
+// certificate line in the cert config map, or the empty string if there are
+// none. ALPN (h2 and http/1.1) is advertised if alpn is true, and the
+// ciphers and minimum TLS version are taken from the route annotations when
+// they are valid.
+func crtListOptions(cfg ServiceAliasConfig, alpn bool) string {
+	options := make([]string, 0)
+	if alpn {
+		options = append(options, "alpn h2,http/1.1")
+	}
+
+	if ciphers := cfg.Annotations[sslCiphersAnnotation]; len(ciphers) > 0 {
+		if sslCiphersRegexp.MatchString(ciphers) {
+			options = append(options, "ciphers "+ciphers)
+		} else {
+			log.V(0).Info("ignoring invalid ssl ciphers annotation", "namespace", cfg.Namespace, "name", cfg.Name, "value", ciphers)
+		}
+	}
+
+	if version := cfg.Annotations[sslMinVersionAnnotation]; len(version) > 0 {
+		if matchValues(version, "SSLv3", "TLSv1.0", "TLSv1.1", "TLSv1.2", "TLSv1.3") {
+			options = append(options, "ssl-min-ver "+version)
+		} else {
+			log.V(0).Info("ignoring invalid ssl minimum version annotation", "namespace", cfg.Namespace, "name", cfg.Name, "value", version)
+		}
+	}
+
+	if len(options) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(options, " ") + "]"
+}
+
+// certHostSpecificity returns the hostSpecificity of a certificate host name
+// as used in the cert config map, where a wildcard is written as
+// *.<subdomain>, so that certificates are ordered like the route acls.
+func certHostSpecificity(host string) int {
+	return hostSpecificity(ServiceAliasConfig{Host: host, IsWildcard: strings.HasPrefix(host, "*.")})
+}
+
+// certLinePrecedes returns true if the cert config map line a should come
+// before line b: more specific hosts come first and lines with equally
+// specific hosts are ordered in reverse string order. A wildcard only
+// covers hosts with the same number of labels, which hostSpecificity
+// scores higher than the wildcard, so a specific host always precedes a
+// wildcard covering it.
+func certLinePrecedes(a, b string) bool {
+	hostA, hostB := certConfigMapLineHost(a), certConfigMapLineHost(b)
+	if sa, sb := certHostSpecificity(hostA), certHostSpecificity(hostB); sa != sb {
+		return sa > sb
+	}
+	return a > b
+}
+
+// sortCertConfigMapLines sorts cert config map lines so that the most
+// specific certificate hosts come first, ensuring a wildcard certificate
+// does not shadow a more specific one.
+func sortCertConfigMapLines(lines []string) {
+	sort.SliceStable(lines, func(i, j int) bool {
+		return certLinePrecedes(lines[i], lines[j])
+	})
+}
+
+// certConfigMapLineHost returns the host (SNI filter) of a cert config map
+// line, which is always the last field of the line.
+func certConfigMapLineHost(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
+
 // validateHAProxyAllowlist validates an allowlist for use with an haproxy acl.
 func validateHAProxyAllowlist(value string) bool {
 	_, valid := haproxyutil.ValidateAllowlist(value)
@@ -428,33 +580,3744 @@ func indent(input string, spaces int) string {
 	return strings.Join(lines, "\n")
 }
 
-var helperFunctions = template.FuncMap{
-	"endpointsForAlias":        endpointsForAlias,        //returns the list of valid endpoints
-	"processEndpointsForAlias": processEndpointsForAlias, //returns the list of valid endpoints after processing them
-	"env":                      env,                      //tries to get an environment variable, returns the first non-empty default value or "" on failure
-	"matchPattern":             matchPattern,             //anchors provided regular expression and evaluates against given string
-	"isInteger":                isInteger,                //determines if a given variable is an integer
-	"matchValues":              matchValues,              //compares a given string to a list of allowed strings
+// decodePath percent-decodes a route path so that it can be compared
+// against other paths consistently. It returns the decoded path and
+// whether decoding changed the value. If the path contains an invalid
+// encoding, the original path is returned along with false.
+func decodePath(path string) (string, bool) {
+	decoded, err := url.PathUnescape(path)
+	if err != nil {
+		log.V(7).Info("decodePath found invalid encoding", "path", path, "error", err)
+		return path, false
+	}
 
-	"genSubdomainWildcardRegexp": genSubdomainWildcardRegexp,             //generates a regular expression matching the subdomain for hosts (and paths) with a wildcard policy
-	"generateRouteRegexp":        generateRouteRegexp,                    //generates a regular expression matching the route hosts (and paths)
-	"genCertificateHostName":     genCertificateHostName,                 //generates host name to use for serving/matching certificates
-	"genBackendNamePrefix":       templateutil.GenerateBackendNamePrefix, //generates the prefix for the backend name
+	return decoded, decoded != path
+}
 
-	"isTrue":     isTrue,     //determines if a given variable is a true value
-	"firstMatch": firstMatch, //anchors provided regular expression and evaluates against given strings, returns the first matched string or ""
+// hostnameRegexp matches a host name that is safe to emit verbatim into
+// the haproxy configuration.
+var hostnameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
 
-	"getHTTPAliasesGroupedByHost": getHTTPAliasesGroupedByHost, //returns HTTP(S) aliases grouped by their host
-	"getPrimaryAliasKey":          getPrimaryAliasKey,          //returns the key of the primary alias for a group of aliases
+// sanitizeHost returns the lower-cased host if it is a valid host name
+// or the empty string otherwise.
+func sanitizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if !hostnameRegexp.MatchString(host) {
+		log.V(0).Info("sanitizeHost found invalid host name", "host", host)
+		return ""
+	}
+	return host
+}
 
-	"generateHAProxyMap":           generateHAProxyMap,           //generates a haproxy map content
-	"validateHAProxyAllowlist":     validateHAProxyAllowlist,     //validates a haproxy allowlist (acl) content
-	"generateHAProxyAllowlistFile": generateHAProxyAllowlistFile, //generates a haproxy allowlist file for use in an acl
+const (
+	// preserveHostAnnotation enables setting the Host header sent to a
+	// reencrypt backend to the route host.
+	preserveHostAnnotation = "haproxy.router.openshift.io/preserve-host"
+)
 
-	"clipHAProxyTimeoutValue": clipHAProxyTimeoutValue, //clips extrodinarily high timeout values to be below the maximum allowed timeout value
-	"parseIPList":             parseIPList,             //parses the list of IPs/CIDRs (IPv4/IPv6)
+// preserveHostHeader returns the directive that rewrites the Host header
+// to the (sanitized) route host when the preserve-host annotation is set.
+// The empty string is returned when the annotation is disabled or the host
+// is not valid.
+func preserveHostHeader(cfg ServiceAliasConfig) string {
+	if !isTrue(cfg.Annotations[preserveHostAnnotation]) {
+		return ""
+	}
+
+	host := sanitizeHost(cfg.Host)
+	if len(host) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("http-request set-header Host %s", host)
+}
+
+// effectiveTLSMode returns the TLS termination type in effect for a route.
+// Unknown termination types are treated as plain (insecure) HTTP, for
+// which the empty termination type is returned.
+func effectiveTLSMode(cfg ServiceAliasConfig) routev1.TLSTerminationType {
+	switch cfg.TLSTermination {
+	case routev1.TLSTerminationEdge, routev1.TLSTerminationReencrypt, routev1.TLSTerminationPassthrough:
+		return cfg.TLSTermination
+	case "":
+		return ""
+	default:
+		log.V(0).Info("unknown tls termination type, treating route as insecure", "termination", cfg.TLSTermination)
+		return ""
+	}
+}
+
+// forwardedProto returns the value of the X-Forwarded-Proto header for a
+// route, which is "https" for routes terminating TLS at the router and
+// "http" otherwise.
+func forwardedProto(cfg ServiceAliasConfig) string {
+	switch effectiveTLSMode(cfg) {
+	case routev1.TLSTerminationEdge, routev1.TLSTerminationReencrypt:
+		return "https"
+	default:
+		return "http"
+	}
+}
+
+// forwardedPort returns the frontend port to advertise to backends of a
+// route via the X-Forwarded-Port header: ROUTER_SERVICE_HTTPS_PORT for
+// routes terminating TLS at the router and ROUTER_SERVICE_HTTP_PORT
+// otherwise, the same values the template binds the frontends to.
+func forwardedPort(cfg ServiceAliasConfig) string {
+	if forwardedProto(cfg) == "https" {
+		return servicePort("ROUTER_SERVICE_HTTPS_PORT", "443")
+	}
+	return servicePort("ROUTER_SERVICE_HTTP_PORT", "80")
+}
+
+// servicePort returns the frontend port set by the environment variable
+// name, falling back to def when it is unset or not a valid port.
+func servicePort(name, def string) string {
+	port := env(name, def)
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		log.V(0).Info("servicePort found invalid port, using default", "variable", name, "port", port, "default", def)
+		return def
+	}
+	return port
+}
+
+// isUnmatchableRoute returns true if a route has neither a host nor a
+// (non-root) path, in which case no meaningful acl can be generated for it.
+func isUnmatchableRoute(cfg ServiceAliasConfig) bool {
+	if len(cfg.Host) > 0 || (len(cfg.Path) > 0 && cfg.Path != "/") {
+		return false
+	}
+
+	log.V(0).Info("route has neither host nor path and cannot be matched", "namespace", cfg.Namespace, "name", cfg.Name)
+	return true
+}
+
+// hostSpecificity returns a score for how specific a route's host is, where
+// higher scores are more specific. Hosts with more labels are more specific
+// and an exact host is more specific than a wildcard with the same number
+// of labels.
+func hostSpecificity(cfg ServiceAliasConfig) int {
+	if len(cfg.Host) == 0 {
+		return 0
+	}
+
+	score := 2 * (strings.Count(cfg.Host, ".") + 1)
+	if !cfg.IsWildcard {
+		score++
+	}
+	return score
+}
+
+// pathSpecificity returns a score for how specific a route path is, where
+// higher scores are more specific. A longer path prefix is more specific
+// than any path it is a prefix of.
+func pathSpecificity(path string) int {
+	return len(strings.TrimRight(path, "/"))
+}
+
+// orderAllAliases returns the keys of the given aliases in the order in
+// which their acls should be evaluated: most specific host first, then most
+// specific path, with the alias key as a tie breaker so that the order is
+// deterministic.
+func orderAllAliases(aliases map[ServiceAliasConfigKey]ServiceAliasConfig) []ServiceAliasConfigKey {
+	keys := make([]ServiceAliasConfigKey, 0, len(aliases))
+	for k := range aliases {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := aliases[keys[i]], aliases[keys[j]]
+		if hi, hj := hostSpecificity(a), hostSpecificity(b); hi != hj {
+			return hi > hj
+		}
+		if pi, pj := pathSpecificity(a.Path), pathSpecificity(b.Path); pi != pj {
+			return pi > pj
+		}
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
+const (
+	// sniInspectDelayAnnotation sets how long to wait for the TLS client
+	// hello when routing a passthrough route by SNI.
+	sniInspectDelayAnnotation = "haproxy.router.openshift.io/sni-inspect-delay"
+
+	// defaultSNIInspectDelay is the inspect delay used when neither the
+	// annotation nor ROUTER_INSPECT_DELAY provide a valid value.
+	defaultSNIInspectDelay = "5s"
+)
+
+// sniInspectDelay returns the `tcp-request inspect-delay` value to use for
+// a passthrough route. The value is read from the sni-inspect-delay
+// annotation (clipped to the maximum allowed by haproxy) and defaults to
+// ROUTER_INSPECT_DELAY or 5s. The empty string is returned for routes that
+// are not passthrough routes.
+func sniInspectDelay(cfg ServiceAliasConfig) string {
+	if effectiveTLSMode(cfg) != routev1.TLSTerminationPassthrough {
+		return ""
+	}
+
+	if delay := clipHAProxyTimeoutValue(cfg.Annotations[sniInspectDelayAnnotation]); len(delay) > 0 {
+		return delay
+	}
 
-	"indent":                 indent,                 //indents a multiline string with specified number of spaces
-	"processRewriteTarget":   rewritetarget.SanitizeInput, //sanitizes `haproxy.router.openshift.io/rewrite-target` annotation
+	if delay := clipHAProxyTimeoutValue(os.Getenv("ROUTER_INSPECT_DELAY")); len(delay) > 0 {
+		return delay
+	}
+
+	return defaultSNIInspectDelay
+}
+
+// passthroughSNIMapEntry returns the map entry mapping the SNI of a
+// passthrough route to its backend, and whether the route is a passthrough
+// route for which such an entry applies. Like the os_sni_passthrough.map
+// entries, routes with a path are not routable by SNI.
+func passthroughSNIMapEntry(cfg ServiceAliasConfig) (string, string, bool) {
+	if len(cfg.Host) == 0 || len(cfg.Path) > 0 || effectiveTLSMode(cfg) != routev1.TLSTerminationPassthrough {
+		return "", "", false
+	}
+
+	key := templateutil.GenerateSNIRegexp(cfg.Host, cfg.IsWildcard)
+	value := fmt.Sprintf("%s:%s", templateutil.GenerateBackendNamePrefix(cfg.TLSTermination), routeKeyFromParts(cfg.Namespace, cfg.Name))
+	return key, value, true
+}
+
+// detectTerminationCollision reports whether any host in the given aliases
+// is used by both passthrough and non-passthrough routes, which cannot be
+// served from the same frontend. It returns the (alphabetically first)
+// colliding host and true if a collision is found.
+func detectTerminationCollision(aliases map[string]ServiceAliasConfig) (string, bool) {
+	passthrough := make(map[string]bool)
+	other := make(map[string]bool)
+	for _, cfg := range aliases {
+		if effectiveTLSMode(cfg) == routev1.TLSTerminationPassthrough {
+			passthrough[cfg.Host] = true
+		} else {
+			other[cfg.Host] = true
+		}
+	}
+
+	collisions := make([]string, 0)
+	for host := range passthrough {
+		if other[host] {
+			collisions = append(collisions, host)
+		}
+	}
+	if len(collisions) == 0 {
+		return "", false
+	}
+
+	sort.Strings(collisions)
+	log.V(0).Info("host is used by both passthrough and non-passthrough routes", "hosts", collisions)
+	return collisions[0], true
+}
+
+// detectDuplicateSNI returns the (sorted) SNI hosts that appear in more than
+// one of the given cert config map lines with different certificates, in
+// which case it is ambiguous which certificate haproxy will serve.
+func detectDuplicateSNI(lines []string) []string {
+	certsByHost := make(map[string]map[string]bool)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		host := fields[len(fields)-1]
+		if _, ok := certsByHost[host]; !ok {
+			certsByHost[host] = make(map[string]bool)
+		}
+		certsByHost[host][fields[0]] = true
+	}
+
+	duplicates := make([]string, 0)
+	for host, certs := range certsByHost {
+		if len(certs) > 1 {
+			duplicates = append(duplicates, host)
+		}
+	}
+	sort.Strings(duplicates)
+
+	if len(duplicates) > 0 {
+		log.V(0).Info("found SNI hosts served by multiple certificates", "hosts", duplicates)
+	}
+	return duplicates
+}
+
+const (
+	// defaultCertificateAnnotation designates a route's certificate as
+	// the default certificate served to clients that do not send SNI.
+	defaultCertificateAnnotation = "haproxy.router.openshift.io/default-certificate"
+)
+
+// defaultCertEntry returns the crt-list entry for the certificate served to
+// clients that do not send SNI, and whether such a certificate exists. The
+// certificate of a route with the default-certificate annotation is used if
+// there is one, otherwise the first route with a certificate is used. In
+// both cases routes are considered in key order so the choice is
+// deterministic.
+func defaultCertEntry(td templateData) (string, bool) {
+	keys := make([]string, 0, len(td.State))
+	for k := range td.State {
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+
+	candidate := ""
+	for _, k := range keys {
+		cfg := td.State[ServiceAliasConfigKey(k)]
+		if effectiveTLSMode(cfg) != routev1.TLSTerminationEdge && effectiveTLSMode(cfg) != routev1.TLSTerminationReencrypt {
+			continue
+		}
+		if cert, ok := cfg.Certificates[generateCertKey(&cfg)]; !ok || len(cert.Contents) == 0 {
+			continue
+		}
+
+		if isTrue(cfg.Annotations[defaultCertificateAnnotation]) {
+			candidate = k
+			break
+		}
+		if len(candidate) == 0 {
+			candidate = k
+		}
+	}
+
+	if len(candidate) == 0 {
+		return "", false
+	}
+
+	return path.Join(td.WorkingDir, certDir, fmt.Sprintf("%s.pem", candidate)), true
+}
+
+// featureEnabled returns the boolean value of the environment variable
+// name, or def if it is unset. Values that are not strictly parsable as a
+// boolean are logged and also yield def.
+func featureEnabled(name string, def bool) bool {
+	value, ok := os.LookupEnv(name)
+	if !ok || len(value) == 0 {
+		return def
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.V(0).Info("ignoring ambiguous feature flag value, using default", "name", name, "value", value, "default", def)
+		return def
+	}
+	return enabled
+}
+
+var (
+	// reloadJitterSource is the source of randomness used by reloadJitter.
+	// It can be replaced with a fixed seed source for testing.
+	reloadJitterSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// reloadJitterLock guards reloadJitterSource, which is not safe for
+	// concurrent use.
+	reloadJitterLock sync.Mutex
+)
+
+// reloadJitter returns baseSeconds plus a random jitter of up to
+// maxJitterSeconds, so that router replicas do not all reload at the same
+// time. A non-positive maxJitterSeconds yields baseSeconds.
+func reloadJitter(baseSeconds int, maxJitterSeconds int) int {
+	if maxJitterSeconds <= 0 {
+		return baseSeconds
+	}
+
+	reloadJitterLock.Lock()
+	defer reloadJitterLock.Unlock()
+	return baseSeconds + reloadJitterSource.Intn(maxJitterSeconds+1)
+}
+
+const (
+	// changeKindNone indicates that a route did not change.
+	changeKindNone = "none"
+
+	// changeKindEndpoints indicates that only the endpoints of a route
+	// changed, which can be applied without a reload.
+	changeKindEndpoints = "endpoints"
+
+	// changeKindStructural indicates that the route configuration itself
+	// changed, which requires a reload.
+	changeKindStructural = "structural"
+)
+
+// withoutDerivedState returns a copy of a route with the fields cleared
+// that commitAndReload recomputes from the endpoints (the server weights
+// and the active endpoint and service unit counts) or that track
+// persistence state, leaving only the route configuration itself.
+func withoutDerivedState(cfg ServiceAliasConfig) ServiceAliasConfig {
+	cfg.ServiceUnitNames = nil
+	cfg.ActiveServiceUnits = 0
+	cfg.ActiveEndpoints = 0
+	cfg.Status = ""
+	return cfg
+}
+
+// changeKind classifies the change between two versions of a route and its
+// endpoints as "none", "endpoints" (only the endpoints changed) or
+// "structural" (the route configuration changed). Fields that are derived
+// from the endpoints or that track persistence state are not considered
+// structural (see withoutDerivedState), and the order of the endpoints is
+// not significant.
+func changeKind(prev, curr ServiceAliasConfig, prevEps, currEps []Endpoint) string {
+	if !reflect.DeepEqual(withoutDerivedState(prev), withoutDerivedState(curr)) {
+		return changeKindStructural
+	}
+
+	if !sameEndpoints(prevEps, currEps) {
+		return changeKindEndpoints
+	}
+
+	return changeKindNone
+}
+
+// sameEndpoints returns true if a and b contain the same endpoints,
+// irrespective of their order.
+func sameEndpoints(a, b []Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[Endpoint]int, len(a))
+	for _, ep := range a {
+		counts[ep]++
+	}
+	for _, ep := range b {
+		if counts[ep] == 0 {
+			return false
+		}
+		counts[ep]--
+	}
+	return true
+}
+
+// endpointRuntimeCommands returns the haproxy runtime api (stats socket)
+// commands that apply endpoint additions and removals to a backend without
+// a reload. A server line must already exist for every server named: added
+// maps the server slot each new endpoint is placed in, such as one of the
+// dynamic server template slots ("_dynamic-pod-1"), to the endpoint, and
+// removed lists the names of the servers to take out of rotation. Added
+// endpoints are brought up, in slot name order, before removed servers are
+// disabled so that the backend does not lose capacity in between. Commands
+// that fail validateRuntimeCommand are dropped, together with the other
+// command for the same server, so that a server is never enabled with a
+// stale address.
+func endpointRuntimeCommands(backend string, added map[string]Endpoint, removed []string) []string {
+	slots := make([]string, 0, len(added))
+	for slot := range added {
+		slots = append(slots, slot)
+	}
+	sort.Strings(slots)
+
+	commands := make([]string, 0, 2*len(added)+len(removed))
+	for _, slot := range slots {
+		ep := added[slot]
+		server := fmt.Sprintf("%s/%s", backend, slot)
+		serverCommands := []string{
+			fmt.Sprintf("set server %s addr %s port %s", server, ep.IP, ep.Port),
+			fmt.Sprintf("enable server %s", server),
+		}
+		if !validateRuntimeCommand(serverCommands[0]) || !validateRuntimeCommand(serverCommands[1]) {
+			log.V(0).Info("skipping endpoint with unsafe runtime api command", "backend", backend, "server", slot, "id", ep.ID)
+			continue
+		}
+		commands = append(commands, serverCommands...)
+	}
+
+	for _, name := range removed {
+		if cmd := fmt.Sprintf("disable server %s/%s", backend, name); validateRuntimeCommand(cmd) {
+			commands = append(commands, cmd)
+		}
+	}
+
+	return commands
+}
+
+// validateRuntimeCommand returns true if cmd is safe to send to the haproxy
+// runtime api. Commands must be non-empty and consist of printable ASCII
+// characters only. Newlines, control characters and the `;` command
+// separator are rejected as they would allow injecting additional commands.
+func validateRuntimeCommand(cmd string) bool {
+	if len(strings.TrimSpace(cmd)) == 0 {
+		return false
+	}
+
+	for _, c := range cmd {
+		if c < ' ' || c > '~' || c == ';' {
+			log.V(0).Info("rejecting unsafe runtime api command", "command", strconv.Quote(cmd))
+			return false
+		}
+	}
+
+	return true
+}
+
+// warmupOrder returns the endpoints ordered so that established servers
+// precede newly added ones, for use together with slowstart. Endpoints do
+// not carry timestamps, so lastSeen provides the time each endpoint (keyed
+// by id) was first observed; endpoints seen earlier are considered more
+// established and endpoints missing from lastSeen are considered new. The
+// original order is kept for equally established endpoints.
+func warmupOrder(endpoints []Endpoint, lastSeen map[string]time.Time) []Endpoint {
+	ordered := make([]Endpoint, len(endpoints))
+	copy(ordered, endpoints)
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ti, oki := lastSeen[ordered[i].ID]
+		tj, okj := lastSeen[ordered[j].ID]
+		if oki != okj {
+			return oki
+		}
+		return oki && ti.Before(tj)
+	})
+
+	return ordered
+}
+
+const (
+	// tcpCheckPortAnnotation sets the port that tcp health checks of a
+	// passthrough route connect to.
+	tcpCheckPortAnnotation = "haproxy.router.openshift.io/tcp-check-port"
+)
+
+// isValidPort returns true if s is a valid TCP/UDP port number.
+func isValidPort(s string) bool {
+	port, err := strconv.Atoi(s)
+	return err == nil && port > 0 && port <= 65535
+}
+
+// tcpCheckExpr returns the tcp health check directives for a passthrough
+// route, which cannot use http checks, or the empty string for any other
+// route. If the tcp-check-port annotation holds a valid port, the check
+// connects to that port instead of the server port.
+func tcpCheckExpr(cfg ServiceAliasConfig) string {
+	if effectiveTLSMode(cfg) != routev1.TLSTerminationPassthrough {
+		return ""
+	}
+
+	directives := []string{"option tcp-check"}
+	if port := cfg.Annotations[tcpCheckPortAnnotation]; len(port) > 0 {
+		if isValidPort(port) {
+			directives = append(directives, "tcp-check connect port "+port)
+		} else {
+			log.V(0).Info("ignoring invalid tcp check port annotation", "namespace", cfg.Namespace, "name", cfg.Name, "value", port)
+		}
+	}
+
+	return strings.Join(directives, "\n")
 }
 
+const (
+	// connRateLimitAnnotation limits the rate of connections per source
+	// ip, in the form <count>/<period>, e.g. 100/10s.
+	connRateLimitAnnotation = "haproxy.router.openshift.io/rate-limit-connections.rate-per-period"
+)
+
+// connRateLimit parses the connection rate limit annotation of a route into
+// the number of connections allowed per source ip and the period over which
+// they are counted. It returns false if the annotation is absent or invalid.
+func connRateLimit(cfg ServiceAliasConfig) (int, string, bool) {
+	value := cfg.Annotations[connRateLimitAnnotation]
+	if len(value) == 0 {
+		return 0, "", false
+	}
+
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		log.V(0).Info("ignoring invalid connection rate limit annotation", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+		return 0, "", false
+	}
+
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		log.V(0).Info("ignoring invalid connection rate limit count", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+		return 0, "", false
+	}
+
+	if _, err := haproxytime.ParseDuration(parts[1]); err != nil {
+		log.V(0).Info("ignoring invalid connection rate limit period", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+		return 0, "", false
+	}
+
+	return count, parts[1], true
+}
+
+// retryAfterHeader returns the directive setting the Retry-After header on
+// responses to rate limited requests, or the empty string if seconds is not
+// positive.
+func retryAfterHeader(seconds int) string {
+	if seconds <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("http-response set-header Retry-After %d", seconds)
+}
+
+const (
+	// h2MaxConcurrentStreamsAnnotation limits the number of concurrent
+	// HTTP/2 streams per connection for a route.
+	h2MaxConcurrentStreamsAnnotation = "haproxy.router.openshift.io/h2-max-concurrent-streams"
+
+	// minH2ConcurrentStreams and maxH2ConcurrentStreams bound the number of
+	// concurrent HTTP/2 streams that can be configured for a route.
+	minH2ConcurrentStreams = 1
+	maxH2ConcurrentStreams = 1000
+)
+
+// h2MaxConcurrentStreams returns the maximum number of concurrent HTTP/2
+// streams for a route from its annotation, clamped to a sane range, or def
+// if the annotation is absent or not an integer.
+func h2MaxConcurrentStreams(cfg ServiceAliasConfig, def int) int {
+	value := cfg.Annotations[h2MaxConcurrentStreamsAnnotation]
+	if len(value) == 0 {
+		return def
+	}
+
+	streams, err := strconv.Atoi(value)
+	if err != nil {
+		log.V(0).Info("ignoring invalid http/2 concurrent streams annotation", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+		return def
+	}
+
+	switch {
+	case streams < minH2ConcurrentStreams:
+		log.V(0).Info("clipping http/2 concurrent streams annotation", "namespace", cfg.Namespace, "name", cfg.Name, "value", value, "clipped", minH2ConcurrentStreams)
+		return minH2ConcurrentStreams
+	case streams > maxH2ConcurrentStreams:
+		log.V(0).Info("clipping http/2 concurrent streams annotation", "namespace", cfg.Namespace, "name", cfg.Name, "value", value, "clipped", maxH2ConcurrentStreams)
+		return maxH2ConcurrentStreams
+	}
+
+	return streams
+}
+
+// annotationWithinSize returns true if an annotation value is at most
+// maxBytes long, so that oversized values can be skipped instead of
+// bloating the generated configuration.
+func annotationWithinSize(value string, maxBytes int) bool {
+	if len(value) <= maxBytes {
+		return true
+	}
+
+	log.V(0).Info("annotation value exceeds maximum size", "size", len(value), "maxBytes", maxBytes)
+	return false
+}
+
+// backendIndexes returns a small integer index for each route in state
+// that is unique within the state, derived from the position of its key
+// among the sorted keys of the state. The indexes are stable for as long as
+// the set of routes does not change. They are computed once per render, see
+// templateData.BackendIndexes.
+func backendIndexes(state map[ServiceAliasConfigKey]ServiceAliasConfig) map[ServiceAliasConfigKey]int {
+	keys := make([]ServiceAliasConfigKey, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	indexes := make(map[ServiceAliasConfigKey]int, len(keys))
+	for i, k := range keys {
+		indexes[k] = i
+	}
+	return indexes
+}
+
+// backendIndex returns the index of a route from the backend indexes of
+// the template data (see backendIndexes), or -1 if the route is not in the
+// state.
+func backendIndex(key ServiceAliasConfigKey, td templateData) int {
+	if index, ok := td.BackendIndexes[key]; ok {
+		return index
+	}
+	return -1
+}
+
+// invalidVarNameCharsRegexp matches characters that are not allowed in an
+// haproxy variable name.
+var invalidVarNameCharsRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// setVarDirective returns an `http-request set-var` directive storing expr
+// in the transaction scoped variable name, so that acls can reuse the result
+// instead of recomputing it. Characters not allowed in a variable name are
+// replaced with underscores. The empty string is returned if name does not
+// start with a letter or if expr is empty or spans multiple lines.
+func setVarDirective(name, expr string) string {
+	name = invalidVarNameCharsRegexp.ReplaceAllString(name, "_")
+	if len(name) == 0 || !(name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') {
+		log.V(0).Info("setVarDirective invalid variable name", "name", name)
+		return ""
+	}
+
+	expr = strings.TrimSpace(expr)
+	if len(expr) == 0 || strings.ContainsAny(expr, "\r\n") {
+		log.V(0).Info("setVarDirective invalid expression", "name", name, "expr", expr)
+		return ""
+	}
+
+	return fmt.Sprintf("http-request set-var(txn.%s) %s", name, expr)
+}
+
+const (
+	// geoRoutingAnnotation enables GeoIP lookups of the client country for
+	// a route.
+	geoRoutingAnnotation = "haproxy.router.openshift.io/geo-routing"
+
+	// unknownCountryCode is the country code used for clients whose source
+	// address is not found in the GeoIP map.
+	unknownCountryCode = "ZZ"
+)
+
+// geoRoutingEnabled returns true if the GeoIP lookup of the client country
+// is enabled for a route.
+func geoRoutingEnabled(cfg ServiceAliasConfig) bool {
+	return isTrue(cfg.Annotations[geoRoutingAnnotation])
+}
+
+// geoCountryVarDirective returns the directive storing the client country,
+// looked up by source address in the given GeoIP map file, in the
+// txn.country variable. The empty string is returned if no map file is
+// given.
+func geoCountryVarDirective(mapFile string) string {
+	if len(mapFile) == 0 {
+		return ""
+	}
+	return setVarDirective("country", fmt.Sprintf("src,map_ip(%s,%s)", mapFile, unknownCountryCode))
+}
+
+// isoCountryCodes is the set of officially assigned ISO 3166-1 alpha-2
+// country codes.
+var isoCountryCodes = func() map[string]bool {
+	codes := make(map[string]bool)
+	for _, code := range strings.Fields(`
+		AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ
+		BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ
+		CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ
+		DE DJ DK DM DO DZ
+		EC EE EG EH ER ES ET
+		FI FJ FK FM FO FR
+		GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY
+		HK HM HN HR HT HU
+		ID IE IL IM IN IO IQ IR IS IT
+		JE JM JO JP
+		KE KG KH KI KM KN KP KR KW KY KZ
+		LA LB LC LI LK LR LS LT LU LV LY
+		MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ
+		NA NC NE NF NG NI NL NO NP NR NU NZ
+		OM
+		PA PE PF PG PH PK PL PM PN PR PS PT PW PY
+		QA
+		RE RO RS RU RW
+		SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ
+		TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ
+		UA UG UM US UY UZ
+		VA VC VE VG VI VN VU
+		WF WS
+		YE YT
+		ZA ZM ZW`) {
+		codes[code] = true
+	}
+	return codes
+}()
+
+// normalizeCountryList parses a comma separated list of ISO 3166-1 alpha-2
+// country codes, as used by country allow and deny lists. The codes are
+// upper-cased and duplicates removed. It returns false if the list is empty
+// or contains a code that is not a valid country code.
+func normalizeCountryList(value string) ([]string, bool) {
+	codes := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, code := range strings.Split(value, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) == 0 {
+			continue
+		}
+		if !isoCountryCodes[code] {
+			log.V(0).Info("normalizeCountryList found invalid country code", "code", code)
+			return nil, false
+		}
+		if !seen[code] {
+			seen[code] = true
+			codes = append(codes, code)
+		}
+	}
+
+	if len(codes) == 0 {
+		return nil, false
+	}
+	return codes, true
+}
+
+const (
+	// maintenanceWindowAnnotation sets a maintenance window for a route as
+	// an interval of two RFC 3339 times, <start>/<end>.
+	maintenanceWindowAnnotation = "haproxy.router.openshift.io/maintenance-window"
+)
+
+// inMaintenanceWindow returns true if now falls within the maintenance
+// window of a route, the start being inclusive and the end exclusive. A
+// missing or malformed window means the route is not in maintenance.
+func inMaintenanceWindow(cfg ServiceAliasConfig, now time.Time) bool {
+	value := cfg.Annotations[maintenanceWindowAnnotation]
+	if len(value) == 0 {
+		return false
+	}
+
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		log.V(0).Info("ignoring invalid maintenance window annotation", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+		return false
+	}
+
+	start, err := time.Parse(time.RFC3339, strings.TrimSpace(parts[0]))
+	if err != nil {
+		log.V(0).Info("ignoring invalid maintenance window start", "namespace", cfg.Namespace, "name", cfg.Name, "value", value, "error", err)
+		return false
+	}
+	end, err := time.Parse(time.RFC3339, strings.TrimSpace(parts[1]))
+	if err != nil {
+		log.V(0).Info("ignoring invalid maintenance window end", "namespace", cfg.Namespace, "name", cfg.Name, "value", value, "error", err)
+		return false
+	}
+	if !end.After(start) {
+		log.V(0).Info("ignoring maintenance window that ends before it starts", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+		return false
+	}
+
+	return !now.Before(start) && now.Before(end)
+}
+
+const (
+	// waitForBodyAnnotation sets how long to wait for the full request
+	// body of a route to be received before processing the request.
+	waitForBodyAnnotation = "haproxy.router.openshift.io/wait-for-body"
+
+	// waitForBodyAtLeastAnnotation sets the number of body bytes after
+	// which processing starts even if the full body was not received yet.
+	waitForBodyAtLeastAnnotation = "haproxy.router.openshift.io/wait-for-body.at-least"
+)
+
+// waitForBody returns the `http-request wait-for-body` directive for a
+// route that needs the full request body to be inspected, or the empty
+// string if the wait-for-body annotation is absent or invalid. The time
+// limit is clipped to the maximum allowed by haproxy and an invalid size
+// limit is ignored.
+func waitForBody(cfg ServiceAliasConfig) string {
+	value := cfg.Annotations[waitForBodyAnnotation]
+	if len(value) == 0 {
+		return ""
+	}
+
+	limit := clipHAProxyTimeoutValue(value)
+	if len(limit) == 0 {
+		return ""
+	}
+
+	directive := "http-request wait-for-body time " + limit
+	if atLeast := cfg.Annotations[waitForBodyAtLeastAnnotation]; len(atLeast) > 0 {
+		if n, err := strconv.Atoi(atLeast); err == nil && n > 0 {
+			directive = fmt.Sprintf("%s at-least %d", directive, n)
+		} else {
+			log.V(0).Info("ignoring invalid wait-for-body size annotation", "namespace", cfg.Namespace, "name", cfg.Name, "value", atLeast)
+		}
+	}
+
+	return directive
+}
+
+const (
+	// sendProxyAnnotationPrefix is the prefix of the annotations that
+	// enable the PROXY protocol towards the servers of a backend subset,
+	// e.g. haproxy.router.openshift.io/send-proxy.<subset>: v2
+	sendProxyAnnotationPrefix = "haproxy.router.openshift.io/send-proxy."
+)
+
+// sendProxyOptions maps PROXY protocol versions to their server option.
+var sendProxyOptions = map[string]string{
+	"v1":     "send-proxy",
+	"v2":     "send-proxy-v2",
+	"v2-ssl": "send-proxy-v2-ssl",
+}
+
+// proxyProtocolBySubset returns the PROXY protocol server option to use for
+// each backend subset of a route that has one configured via the
+// send-proxy.<subset> annotations. Subsets with an unknown PROXY protocol
+// version are ignored.
+func proxyProtocolBySubset(cfg ServiceAliasConfig) map[string]string {
+	result := make(map[string]string)
+	for k, v := range cfg.Annotations {
+		subset := strings.TrimPrefix(k, sendProxyAnnotationPrefix)
+		if subset == k || len(subset) == 0 {
+			continue
+		}
+
+		option, ok := sendProxyOptions[strings.ToLower(v)]
+		if !ok {
+			log.V(0).Info("ignoring invalid send-proxy annotation", "namespace", cfg.Namespace, "name", cfg.Name, "annotation", k, "value", v)
+			continue
+		}
+		result[subset] = option
+	}
+
+	return result
+}
+
+const (
+	// balanceAnnotation sets the load balancing algorithm of a route.
+	balanceAnnotation = "haproxy.router.openshift.io/balance"
+
+	// sessionAffinityAnnotation enables source based session affinity for
+	// a route.
+	sessionAffinityAnnotation = "haproxy.router.openshift.io/session-affinity"
+
+	// balanceAlgoPattern matches the valid values of the balance annotation.
+	balanceAlgoPattern = "roundrobin|leastconn|source|random"
+)
+
+// sessionAffinityEnabled returns true if source based session affinity is
+// enabled for a route.
+func sessionAffinityEnabled(cfg ServiceAliasConfig) bool {
+	return isTrue(cfg.Annotations[sessionAffinityAnnotation])
+}
+
+// effectiveBalance returns the load balancing algorithm for a route,
+// reconciling the balance annotation with session affinity: when affinity
+// is enabled, `source` balancing is enforced and a conflicting balance
+// annotation is overridden. Without affinity, the (valid) balance
+// annotation is returned, or the empty string to use the default.
+func effectiveBalance(cfg ServiceAliasConfig) string {
+	balance := firstMatch(balanceAlgoPattern, cfg.Annotations[balanceAnnotation])
+	if !sessionAffinityEnabled(cfg) {
+		return balance
+	}
+
+	if len(balance) > 0 && balance != "source" {
+		log.V(0).Info("session affinity overrides the balance annotation", "namespace", cfg.Namespace, "name", cfg.Name, "balance", balance)
+	}
+	return "source"
+}
+
+const (
+	// clientCAAnnotation holds the PEM encoded CA certificate(s) used to
+	// verify client certificates for a route.
+	clientCAAnnotation = "haproxy.router.openshift.io/client-ca"
+
+	// clientCAPostfix is the postfix of the file names client CA
+	// certificates are written to.
+	clientCAPostfix = "_client_ca"
+)
+
+// containsPEMCertificate returns true if data contains at least one PEM
+// encoded certificate that can be parsed.
+func containsPEMCertificate(data []byte) bool {
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return false
+		}
+		if block.Type == "CERTIFICATE" {
+			if _, err := x509.ParseCertificate(block.Bytes); err == nil {
+				return true
+			}
+		}
+		data = rest
+	}
+}
+
+// clientCAData returns the client CA certificate(s) in the client-ca
+// annotation of a route, or the empty string if the annotation is unset or
+// holds no valid certificate.
+func clientCAData(cfg ServiceAliasConfig) string {
+	ca := cfg.Annotations[clientCAAnnotation]
+	if len(ca) == 0 {
+		return ""
+	}
+
+	if !containsPEMCertificate([]byte(ca)) {
+		log.V(0).Info("ignoring client ca annotation without a valid certificate", "namespace", cfg.Namespace, "name", cfg.Name)
+		return ""
+	}
+	return ca
+}
+
+// clientCertAuth returns the bind options requiring clients of a route to
+// present a certificate signed by the CA in the client-ca annotation, and
+// whether client certificate authentication applies to the route. The
+// options refer to the CA file the certificate manager writes to the CA
+// certificate directory.
+func clientCertAuth(cfg ServiceAliasConfig, workingDir string, id ServiceAliasConfigKey) (string, bool) {
+	if len(clientCAData(cfg)) == 0 {
+		return "", false
+	}
+
+	name := path.Join(workingDir, caCertDir, fmt.Sprintf("%s%s.pem", id, clientCAPostfix))
+	return fmt.Sprintf("ca-file %s verify required", name), true
+}
+
+const (
+	// forwardClientCertDNAnnotation enables forwarding the subject of a
+	// client certificate to the backend. The value is either true, to use
+	// the default header name, or the name of the header to use.
+	forwardClientCertDNAnnotation = "haproxy.router.openshift.io/forward-client-cert-dn"
+
+	// defaultClientCertDNHeader is the default name of the header used to
+	// forward the subject of a client certificate.
+	defaultClientCertDNHeader = "X-SSL-Client-DN"
+)
+
+// headerNameRegexp matches a header name that is safe to emit verbatim
+// into the haproxy configuration.
+var headerNameRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
+// isValidHeaderName returns true if name is a valid HTTP header name that
+// is safe to use in the haproxy configuration.
+func isValidHeaderName(name string) bool {
+	return headerNameRegexp.MatchString(name)
+}
+
+// hopByHopHeaders are the lower-cased names of the hop-by-hop headers of
+// RFC 7230 section 6.1, which only apply to a single connection and must
+// not be set on forwarded requests or responses.
+var hopByHopHeaders = map[string]bool{
+	"connection":          true,
+	"keep-alive":          true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"proxy-connection":    true,
+	"te":                  true,
+	"trailer":             true,
+	"transfer-encoding":   true,
+	"upgrade":             true,
+}
+
+// isHopByHopHeader returns true if name is a hop-by-hop header name.
+func isHopByHopHeader(name string) bool {
+	return hopByHopHeaders[strings.ToLower(strings.TrimSpace(name))]
+}
+
+// clientCertHeader returns the directive forwarding the subject of the
+// client certificate to the backend for a route with client certificate
+// authentication and forwarding enabled, or the empty string otherwise.
+func clientCertHeader(cfg ServiceAliasConfig) string {
+	if len(cfg.Annotations[clientCAAnnotation]) == 0 {
+		return ""
+	}
+
+	header := cfg.Annotations[forwardClientCertDNAnnotation]
+	switch {
+	case len(header) == 0:
+		return ""
+	case isTrue(header):
+		header = defaultClientCertDNHeader
+	case isValidBool(header):
+		return ""
+	case !isValidHeaderName(header):
+		log.V(0).Info("ignoring invalid client certificate header name", "namespace", cfg.Namespace, "name", cfg.Name, "header", header)
+		return ""
+	case isHopByHopHeader(header):
+		log.V(0).Info("ignoring hop-by-hop client certificate header name", "namespace", cfg.Namespace, "name", cfg.Name, "header", header)
+		return ""
+	}
+
+	return fmt.Sprintf("http-request set-header %s %%[ssl_c_s_dn] if { ssl_c_used }", header)
+}
+
+// isValidBool returns true if s is parsable as a boolean.
+func isValidBool(s string) bool {
+	_, err := strconv.ParseBool(s)
+	return err == nil
+}
+
+const (
+	// clientCRLAnnotation holds the PEM encoded certificate revocation
+	// list used to check client certificates for a route.
+	clientCRLAnnotation = "haproxy.router.openshift.io/client-crl"
+
+	// clientCRLPostfix is the postfix of the file names client CRLs are
+	// written to.
+	clientCRLPostfix = "_client_crl"
+)
+
+// clientCRLData returns the CRL in the client-crl annotation of a route,
+// or the empty string if the annotation is unset or holds no valid PEM
+// encoded CRL.
+func clientCRLData(cfg ServiceAliasConfig) string {
+	crl := cfg.Annotations[clientCRLAnnotation]
+	if len(crl) == 0 {
+		return ""
+	}
+
+	block, _ := pem.Decode([]byte(crl))
+	if block == nil || block.Type != "X509 CRL" {
+		log.V(0).Info("ignoring client crl annotation without a pem encoded crl", "namespace", cfg.Namespace, "name", cfg.Name)
+		return ""
+	}
+	if _, err := x509.ParseRevocationList(block.Bytes); err != nil {
+		log.V(0).Info("ignoring invalid client crl annotation", "namespace", cfg.Namespace, "name", cfg.Name, "error", err)
+		return ""
+	}
+	return crl
+}
+
+// clientCRLFile returns the bind option checking client certificates of a
+// route against the CRL in the client-crl annotation, and whether CRL
+// checking applies to the route. The CRL must parse; the option refers to
+// the CRL file the certificate manager writes to the CA certificate
+// directory.
+func clientCRLFile(cfg ServiceAliasConfig, workingDir string, id ServiceAliasConfigKey) (string, bool) {
+	if len(clientCRLData(cfg)) == 0 {
+		return "", false
+	}
+
+	name := path.Join(workingDir, caCertDir, fmt.Sprintf("%s%s.pem", id, clientCRLPostfix))
+	return fmt.Sprintf("crl-file %s", name), true
+}
+
+const (
+	// allowedIssuersAnnotation holds the issuer DNs (one per line) of the
+	// client certificates accepted for a route.
+	allowedIssuersAnnotation = "haproxy.router.openshift.io/allowed-client-issuers"
+)
+
+// allowedIssuerACL returns the acl and deny rule rejecting requests with a
+// client certificate not issued by one of the issuers in the
+// allowed-client-issuers annotation, or the empty string if there are no
+// (valid) allowed issuers. Issuers containing quotes, backslashes or
+// control characters are ignored as they cannot be safely quoted.
+func allowedIssuerACL(cfg ServiceAliasConfig) string {
+	issuers := make([]string, 0)
+	for _, issuer := range strings.Split(cfg.Annotations[allowedIssuersAnnotation], "\n") {
+		issuer = strings.TrimSpace(issuer)
+		if len(issuer) == 0 {
+			continue
+		}
+		if strings.ContainsAny(issuer, "\"\\") || strings.IndexFunc(issuer, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+			log.V(0).Info("ignoring unsafe allowed client issuer", "namespace", cfg.Namespace, "name", cfg.Name, "issuer", strconv.Quote(issuer))
+			continue
+		}
+		issuers = append(issuers, strconv.Quote(issuer))
+	}
+
+	if len(issuers) == 0 {
+		return ""
+	}
+
+	return strings.Join([]string{
+		"acl allowed_client_issuer ssl_c_i_dn -m str " + strings.Join(issuers, " "),
+		"http-request deny if { ssl_c_used } !allowed_client_issuer",
+	}, "\n")
+}
+
+// needsHTTPSRedirect returns true if insecure requests for a route need to
+// be redirected to https at the frontend, which is the case for edge and
+// reencrypt routes with the Redirect insecure edge termination policy.
+func needsHTTPSRedirect(cfg ServiceAliasConfig) bool {
+	switch effectiveTLSMode(cfg) {
+	case routev1.TLSTerminationEdge, routev1.TLSTerminationReencrypt:
+		return cfg.InsecureEdgeTerminationPolicy == routev1.InsecureEdgeTerminationPolicyRedirect
+	default:
+		return false
+	}
+}
+
+// httpsRedirectRule returns the frontend rule redirecting insecure requests
+// for a route's host to https, or the empty string if the route does not
+// need a redirect or its host is not valid. The host is matched without
+// any port the client sends in the Host header, the same way as by the
+// use_backend rules (see routeMatchACLs), so for wildcard routes the rule
+// matches a single label in front of the route's subdomain.
+func httpsRedirectRule(cfg ServiceAliasConfig) string {
+	if !needsHTTPSRedirect(cfg) {
+		return ""
+	}
+
+	host := sanitizeHost(cfg.Host)
+	if len(host) == 0 {
+		return ""
+	}
+
+	if cfg.IsWildcard {
+		idx := strings.IndexRune(host, '.')
+		if idx <= 0 {
+			log.V(0).Info("httpsRedirectRule found wildcard route without subdomain", "namespace", cfg.Namespace, "name", cfg.Name, "host", host)
+			return ""
+		}
+	}
+
+	return "http-request redirect scheme https if " + hostACL(cfg, "hdr(host),field(1,:)", host)
+}
+
+// dedupeEndpoints returns the endpoints with duplicate IP:port pairs
+// removed, keeping the first endpoint seen for each pair. IP addresses are
+// compared in their canonical form so that differently written IPv6
+// addresses are recognized as duplicates.
+func dedupeEndpoints(endpoints []Endpoint) []Endpoint {
+	result := make([]Endpoint, 0, len(endpoints))
+	seen := make(map[string]bool, len(endpoints))
+	for _, ep := range endpoints {
+		ip := ep.IP
+		if parsed := net.ParseIP(ip); parsed != nil {
+			ip = parsed.String()
+		}
+
+		key := net.JoinHostPort(ip, ep.Port)
+		if seen[key] {
+			log.V(4).Info("dropping duplicate endpoint", "id", ep.ID, "address", key)
+			continue
+		}
+		seen[key] = true
+		result = append(result, ep)
+	}
+
+	return result
+}
+
+// cookiePath returns the Path attribute for a route's affinity cookie,
+// which is the cleaned route path, or "/" if the route has no path or its
+// path cannot be used in a cookie attribute.
+func cookiePath(cfg ServiceAliasConfig) string {
+	if len(cfg.Path) == 0 {
+		return "/"
+	}
+
+	if strings.IndexFunc(cfg.Path, func(r rune) bool { return r <= ' ' || r == ';' || r == 0x7f }) >= 0 {
+		log.V(0).Info("cookiePath found path unsuitable for a cookie, using /", "namespace", cfg.Namespace, "name", cfg.Name, "path", cfg.Path)
+		return "/"
+	}
+
+	return path.Clean("/" + cfg.Path)
+}
+
+const (
+	// cookieSameSiteAnnotation sets the SameSite attribute of a route's
+	// affinity cookie.
+	cookieSameSiteAnnotation = "router.openshift.io/cookie-same-site"
+)
+
+// cookieAttributes returns the haproxy cookie options setting the Secure
+// and SameSite attributes of a route's affinity cookie. Cookies of edge and
+// reencrypt routes that do not allow insecure traffic are marked secure
+// with the SameSite attribute from the cookie-same-site annotation,
+// defaulting to None. Other cookies are not secure and, since SameSite=None
+// requires the Secure attribute, only get an explicit Lax or Strict
+// SameSite attribute.
+func cookieAttributes(cfg ServiceAliasConfig) string {
+	sameSite := firstMatch("Lax|Strict|None", cfg.Annotations[cookieSameSiteAnnotation])
+
+	switch effectiveTLSMode(cfg) {
+	case routev1.TLSTerminationEdge, routev1.TLSTerminationReencrypt:
+		if cfg.InsecureEdgeTerminationPolicy != routev1.InsecureEdgeTerminationPolicyAllow {
+			if len(sameSite) == 0 {
+				sameSite = "None"
+			}
+			return "secure attr SameSite=" + sameSite
+		}
+	}
+
+	if sameSite == "Lax" || sameSite == "Strict" {
+		return "attr SameSite=" + sameSite
+	}
+	return ""
+}
+
+// rewriteTargetSafe returns false if the sanitized rewrite target contains
+// a ".." path segment, either literally or percent-encoded, that could
+// route requests outside of the intended backend path.
+func rewriteTargetSafe(target string) bool {
+	sanitized := rewritetarget.SanitizeInput(target)
+	decoded, _ := decodePath(target)
+	for _, p := range []string{sanitized, decoded} {
+		for _, segment := range strings.Split(p, "/") {
+			if segment == ".." {
+				log.V(0).Info("rewriteTargetSafe found path traversal in rewrite target", "target", target)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// collectGeneratedPaths returns the sorted paths of the files written for a
+// render of the template data: the certificate files of edge and reencrypt
+// routes, the destination CA files of reencrypt routes, the client CA and
+// CRL files of routes with client certificate annotations and the allowlist
+// files of routes whose allowlist is too large for an inline acl.
+func collectGeneratedPaths(td templateData) []string {
+	paths := make([]string, 0)
+	for k, cfg := range td.State {
+		cfg := cfg // avoid implicit memory aliasing (gosec G601)
+
+		switch cfg.TLSTermination {
+		case routev1.TLSTerminationEdge, routev1.TLSTerminationReencrypt:
+			if cert, ok := cfg.Certificates[generateCertKey(&cfg)]; ok {
+				paths = append(paths, path.Join(td.WorkingDir, certDir, cert.ID+".pem"))
+			}
+		}
+		if cfg.TLSTermination == routev1.TLSTerminationReencrypt {
+			if destCert, ok := cfg.Certificates[generateDestCertKey(&cfg)]; ok {
+				paths = append(paths, path.Join(td.WorkingDir, caCertDir, destCert.ID+".pem"))
+			}
+		}
+		if len(clientCAData(cfg)) > 0 {
+			paths = append(paths, path.Join(td.WorkingDir, caCertDir, fmt.Sprintf("%s%s.pem", k, clientCAPostfix)))
+		}
+		if len(clientCRLData(cfg)) > 0 {
+			paths = append(paths, path.Join(td.WorkingDir, caCertDir, fmt.Sprintf("%s%s.pem", k, clientCRLPostfix)))
+		}
+
+		allowlist := parseIPList(firstMatch(".+", cfg.Annotations["haproxy.router.openshift.io/ip_allowlist"], cfg.Annotations["haproxy.router.openshift.io/ip_whitelist"]))
+		if len(allowlist) > 0 && !validateHAProxyAllowlist(allowlist) {
+			paths = append(paths, path.Join(td.WorkingDir, allowlistDir, fmt.Sprintf("%s.txt", k)))
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// endpointWeight returns the weight of an endpoint clamped to the haproxy
+// server weight range of 0-256, or def if the endpoint has no valid weight.
+func endpointWeight(ep Endpoint, def int) int {
+	if len(ep.Weight) == 0 {
+		return def
+	}
+
+	weight, err := strconv.Atoi(ep.Weight)
+	if err != nil {
+		log.V(0).Info("endpointWeight found invalid weight", "endpoint", ep.ID, "value", ep.Weight, "error", err)
+		return def
+	}
+
+	switch {
+	case weight < 0:
+		log.V(0).Info("endpointWeight clamped out of range weight", "endpoint", ep.ID, "value", weight, "weight", 0)
+		return 0
+	case weight > 256:
+		log.V(0).Info("endpointWeight clamped out of range weight", "endpoint", ep.ID, "value", weight, "weight", 256)
+		return 256
+	}
+	return weight
+}
+
+const (
+	// backupServersAnnotation sets the number of backup servers of a route.
+	backupServersAnnotation = "haproxy.router.openshift.io/backup-servers"
+)
+
+// backupServerCount returns the number of backup servers requested for a
+// route, capped at the number of available servers. It returns zero if the
+// annotation is unset or invalid.
+func backupServerCount(cfg ServiceAliasConfig, available int) int {
+	value, ok := cfg.Annotations[backupServersAnnotation]
+	if !ok {
+		return 0
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		log.V(0).Info("backupServerCount found invalid backup server count", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+		return 0
+	}
+
+	if count > available {
+		return available
+	}
+	return count
+}
+
+// logFormatDirective returns the haproxy log format option for a route:
+// tcplog for passthrough routes, whose traffic is not inspected, and
+// httplog for all other routes.
+func logFormatDirective(cfg ServiceAliasConfig) string {
+	if effectiveTLSMode(cfg) == routev1.TLSTerminationPassthrough {
+		return "option tcplog"
+	}
+	return "option httplog"
+}
+
+const (
+	// timeoutAnnotation sets the server timeout of a route.
+	timeoutAnnotation = "haproxy.router.openshift.io/timeout"
+
+	// timeoutClientAnnotation sets the client timeout of a route.
+	timeoutClientAnnotation = "haproxy.router.openshift.io/timeout-client"
+
+	// timeoutTunnelAnnotation sets the tunnel timeout of a route.
+	timeoutTunnelAnnotation = "haproxy.router.openshift.io/timeout-tunnel"
+)
+
+// validateTimeoutConsistency compares the client, server and tunnel timeouts
+// of a route and returns a description of any inconsistency along with
+// false, or the empty string and true if the timeouts are consistent.
+// Timeouts that are unset or invalid are not compared.
+func validateTimeoutConsistency(cfg ServiceAliasConfig) (string, bool) {
+	parse := func(annotation string) (time.Duration, bool) {
+		value := clipHAProxyTimeoutValue(cfg.Annotations[annotation])
+		if len(value) == 0 {
+			return 0, false
+		}
+		duration, err := haproxytime.ParseDuration(value)
+		return duration, err == nil
+	}
+
+	server, hasServer := parse(timeoutAnnotation)
+	client, hasClient := parse(timeoutClientAnnotation)
+	tunnel, hasTunnel := parse(timeoutTunnelAnnotation)
+
+	var problems []string
+	if hasServer && hasClient && client < server {
+		problems = append(problems, fmt.Sprintf("client timeout %s is shorter than server timeout %s", client, server))
+	}
+	if hasServer && hasTunnel && tunnel < server {
+		problems = append(problems, fmt.Sprintf("tunnel timeout %s is shorter than server timeout %s", tunnel, server))
+	}
+	if len(problems) > 0 {
+		return strings.Join(problems, "; "), false
+	}
+	return "", true
+}
+
+const (
+	// keepAliveTimeoutAnnotation sets the http-keep-alive timeout of a route.
+	keepAliveTimeoutAnnotation = "haproxy.router.openshift.io/timeout-http-keep-alive"
+)
+
+// frontendIdleTimeout returns the largest clipped http-keep-alive timeout
+// of the routes, so the frontend idle timeout accommodates every route, or
+// def if no route sets a valid keep-alive timeout. Equal timeouts written
+// differently (60s and 1m) are broken by the lesser string, so the result
+// does not depend on the iteration order of the routes.
+func frontendIdleTimeout(td templateData, def string) string {
+	idle := def
+	var max time.Duration
+	for _, cfg := range td.State {
+		value := clipHAProxyTimeoutValue(cfg.Annotations[keepAliveTimeoutAnnotation])
+		if len(value) == 0 {
+			continue
+		}
+		duration, err := haproxytime.ParseDuration(value)
+		if err != nil || duration < max || duration <= 0 || (duration == max && value >= idle) {
+			continue
+		}
+		max = duration
+		idle = value
+	}
+	return idle
+}
+
+// annotationMinHAProxyVersions maps route annotations to the minimum haproxy
+// version providing the directives they are rendered into.
+var annotationMinHAProxyVersions = map[string]string{
+	normalizeURIAnnotation:       "2.4",
+	waitForBodyAnnotation:        "2.4",
+	waitForBodyAtLeastAnnotation: "2.4",
+}
+
+// requiresHAProxyVersion returns the minimum haproxy version required by the
+// annotations of a route, or the empty string if the route does not use any
+// annotation needing a specific haproxy version.
+func requiresHAProxyVersion(cfg ServiceAliasConfig) string {
+	required := ""
+	for annotation := range cfg.Annotations {
+		version, ok := annotationMinHAProxyVersions[annotation]
+		if ok && haproxyVersionLess(required, version) {
+			required = version
+		}
+	}
+	return required
+}
+
+// haproxyVersionLess returns true if the dotted haproxy version a is older
+// than b. The empty string is older than any version.
+func haproxyVersionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// defaultDHParam is the DH parameter size used for unknown security
+// profiles.
+const defaultDHParam = 2048
+
+// dhParamBits maps the ROUTER_CIPHERS security profiles to the DH parameter
+// size recommended by https://wiki.mozilla.org/Security/Server_Side_TLS.
+var dhParamBits = map[string]int{
+	"modern":       2048,
+	"intermediate": 2048,
+	"old":          1024,
+}
+
+// dhParam returns the tune.ssl.default-dh-param size for a security profile,
+// or defaultDHParam if the profile is unknown.
+func dhParam(profile string) int {
+	bits, ok := dhParamBits[profile]
+	if !ok {
+		log.V(0).Info("dhParam found unknown security profile, using default", "profile", profile, "bits", defaultDHParam)
+		return defaultDHParam
+	}
+	return bits
+}
+
+const (
+	// healthCheckExpectStatusAnnotation sets the status code, or range of
+	// status codes, expected from a route's http health checks.
+	healthCheckExpectStatusAnnotation = "haproxy.router.openshift.io/health-check-expect-status"
+
+	// defaultHTTPCheckExpectStatus is the range of status codes expected
+	// from http health checks by default.
+	defaultHTTPCheckExpectStatus = "200-399"
+)
+
+// isValidStatusCode returns true if value is an HTTP status code.
+func isValidStatusCode(value string) bool {
+	code, err := strconv.Atoi(value)
+	return err == nil && len(value) == 3 && code >= 100 && code <= 599
+}
+
+// httpCheckExpect returns the http-check expect directive for a route,
+// expecting the status code or status code range from the annotation, or
+// any 2xx or 3xx status if the annotation is unset or invalid.
+func httpCheckExpect(cfg ServiceAliasConfig) string {
+	status := defaultHTTPCheckExpectStatus
+	if value, ok := cfg.Annotations[healthCheckExpectStatusAnnotation]; ok {
+		low, high, isRange := strings.Cut(value, "-")
+		switch {
+		case !isRange && isValidStatusCode(value):
+			status = value
+		case isRange && isValidStatusCode(low) && isValidStatusCode(high) && low <= high:
+			status = value
+		default:
+			log.V(0).Info("httpCheckExpect found invalid status, using default", "namespace", cfg.Namespace, "name", cfg.Name, "value", value, "default", defaultHTTPCheckExpectStatus)
+		}
+	}
+	return "http-check expect status " + status
+}
+
+const (
+	// abortOnCloseAnnotation enables or disables option abortonclose for a
+	// route.
+	abortOnCloseAnnotation = "haproxy.router.openshift.io/abort-on-close"
+)
+
+// abortOnClose returns true if option abortonclose should be emitted for a
+// route, as set by the annotation, or def if the annotation is unset or
+// invalid.
+func abortOnClose(cfg ServiceAliasConfig, def bool) bool {
+	value, ok := cfg.Annotations[abortOnCloseAnnotation]
+	if !ok {
+		return def
+	}
+	if !isValidBool(value) {
+		log.V(0).Info("abortOnClose found invalid value, using default", "namespace", cfg.Namespace, "name", cfg.Name, "value", value, "default", def)
+		return def
+	}
+	return isTrue(value)
+}
+
+const (
+	// securityHeadersAnnotation enables the standard security response
+	// headers for a route.
+	securityHeadersAnnotation = "haproxy.router.openshift.io/security-headers"
+
+	// securityHeaderAnnotationPrefix is the prefix of the annotations that
+	// override the value of a standard security header, e.g.
+	// haproxy.router.openshift.io/security-headers.x-frame-options. An
+	// empty value omits the header.
+	securityHeaderAnnotationPrefix = securityHeadersAnnotation + "."
+)
+
+// standardSecurityHeaders is the bundle of security response headers set
+// by securityHeaders, in the order they are emitted.
+var standardSecurityHeaders = []HTTPHeader{
+	{Name: "X-Content-Type-Options", Value: "nosniff"},
+	{Name: "X-Frame-Options", Value: "DENY"},
+	{Name: "Referrer-Policy", Value: "strict-origin-when-cross-origin"},
+}
+
+// securityHeaders returns the http-response set-header directives for the
+// standard security headers if they are enabled for a route, applying the
+// per-header overrides from the route annotations. Overrides containing
+// newlines or other control characters, which would allow injecting config
+// lines, are ignored in favor of the default value.
+func securityHeaders(cfg ServiceAliasConfig) []string {
+	if !isTrue(cfg.Annotations[securityHeadersAnnotation]) {
+		return nil
+	}
+
+	directives := make([]string, 0, len(standardSecurityHeaders))
+	for _, header := range standardSecurityHeaders {
+		value := header.Value
+		if override, ok := cfg.Annotations[securityHeaderAnnotationPrefix+strings.ToLower(header.Name)]; ok {
+			if strings.IndexFunc(override, unicode.IsControl) < 0 {
+				value = override
+			} else {
+				log.V(0).Info("securityHeaders found invalid header value, using default", "namespace", cfg.Namespace, "name", cfg.Name, "header", header.Name, "value", strconv.Quote(override))
+			}
+		}
+		if len(value) == 0 {
+			continue
+		}
+		directives = append(directives, fmt.Sprintf("http-response set-header %s %s", header.Name, SanitizeHeaderValue(value)))
+	}
+	return directives
+}
+
+const (
+	// connectionModeAnnotation sets the HTTP connection mode of a route.
+	connectionModeAnnotation = "haproxy.router.openshift.io/connection-mode"
+)
+
+// connectionModeOptions maps the HTTP connection modes to their haproxy
+// option directive. The tunnel mode is not supported: option http-tunnel
+// has been ignored since haproxy 2.1.
+var connectionModeOptions = map[string]string{
+	"keep-alive":   "option http-keep-alive",
+	"server-close": "option http-server-close",
+	"close":        "option httpclose",
+}
+
+// connectionMode returns the option directive for the HTTP connection mode
+// of a route, using the def mode if the annotation is unset or invalid.
+func connectionMode(cfg ServiceAliasConfig, def string) string {
+	mode := def
+	if value, ok := cfg.Annotations[connectionModeAnnotation]; ok {
+		if _, valid := connectionModeOptions[value]; valid {
+			mode = value
+		} else if value == "tunnel" {
+			log.V(0).Info("connectionMode found unsupported tunnel mode, which haproxy ignores since 2.1, using default", "namespace", cfg.Namespace, "name", cfg.Name, "default", def)
+		} else {
+			log.V(0).Info("connectionMode found invalid mode, using default", "namespace", cfg.Namespace, "name", cfg.Name, "value", value, "default", def)
+		}
+	}
+	return connectionModeOptions[mode]
+}
+
+// serverlessBackends are the backends of the router configuration that
+// intentionally have no servers.
+var serverlessBackends = map[string]bool{
+	"openshift_default": true,
+}
+
+// validateConfigStructure scans a rendered haproxy configuration and returns
+// warnings for structurally incomplete sections: backends without servers
+// and frontends without a default_backend.
+func validateConfigStructure(rendered string) []string {
+	var warnings []string
+	var kind, name string
+	complete := true
+
+	endSection := func() {
+		if complete {
+			return
+		}
+		switch kind {
+		case "backend":
+			warnings = append(warnings, fmt.Sprintf("backend %s has no servers", name))
+		case "frontend":
+			warnings = append(warnings, fmt.Sprintf("frontend %s has no default_backend", name))
+		}
+	}
+
+	for _, line := range strings.Split(rendered, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			endSection()
+			kind, name = fields[0], ""
+			if len(fields) > 1 {
+				name = fields[1]
+			}
+			complete = (kind != "backend" && kind != "frontend") || serverlessBackends[name]
+			continue
+		}
+
+		switch {
+		case kind == "backend" && (fields[0] == "server" || fields[0] == "server-template"):
+			complete = true
+		case kind == "frontend" && fields[0] == "default_backend":
+			complete = true
+		}
+	}
+	endSection()
+
+	return warnings
+}
+
+// defaultReencryptPort is the backend port of a reencrypt route whose
+// target port cannot be determined from its endpoints.
+const defaultReencryptPort = 443
+
+// reencryptTargetPort returns the backend port of a reencrypt route: the
+// preferred port of the route, given by number or by endpoint port name,
+// or else the port of the service endpoints if they all share one. It
+// returns defaultReencryptPort if the port is ambiguous.
+func reencryptTargetPort(cfg ServiceAliasConfig, svc ServiceUnit) int {
+	if len(cfg.PreferPort) > 0 {
+		if port, err := strconv.Atoi(cfg.PreferPort); err == nil && isValidPort(cfg.PreferPort) {
+			log.V(4).Info("reencryptTargetPort using preferred port", "namespace", cfg.Namespace, "name", cfg.Name, "port", port)
+			return port
+		}
+		for _, ep := range svc.EndpointTable {
+			if ep.PortName != cfg.PreferPort {
+				continue
+			}
+			if port, err := strconv.Atoi(ep.Port); err == nil {
+				log.V(4).Info("reencryptTargetPort using preferred port name", "namespace", cfg.Namespace, "name", cfg.Name, "portName", cfg.PreferPort, "port", port)
+				return port
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	ports := make([]string, 0, 1)
+	for _, ep := range svc.EndpointTable {
+		if !seen[ep.Port] {
+			seen[ep.Port] = true
+			ports = append(ports, ep.Port)
+		}
+	}
+	if len(ports) == 1 {
+		if port, err := strconv.Atoi(ports[0]); err == nil {
+			log.V(4).Info("reencryptTargetPort using endpoint port", "namespace", cfg.Namespace, "name", cfg.Name, "port", port)
+			return port
+		}
+	}
+
+	log.V(0).Info("reencryptTargetPort found ambiguous target port, using default", "namespace", cfg.Namespace, "name", cfg.Name, "ports", ports, "port", defaultReencryptPort)
+	return defaultReencryptPort
+}
+
+const (
+	// dnsDiscoveryAnnotation holds the DNS SRV record used to discover the
+	// servers of a route.
+	dnsDiscoveryAnnotation = "haproxy.router.openshift.io/dns-discovery"
+
+	// discoveryResolvers is the name of the resolvers section used for DNS
+	// based service discovery.
+	discoveryResolvers = "cluster-dns"
+)
+
+// srvRecordRegexp matches a DNS SRV record name, e.g.
+// _https._tcp.service.namespace.svc.cluster.local.
+var srvRecordRegexp = regexp.MustCompile(`^(_[a-z0-9-]+\.){2}[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// serverTemplate returns a server-template line discovering up to count
+// servers of a route from the DNS SRV record in the annotation, and true if
+// DNS based discovery applies to the route.
+func serverTemplate(cfg ServiceAliasConfig, count int) (string, bool) {
+	record, ok := cfg.Annotations[dnsDiscoveryAnnotation]
+	if !ok || count <= 0 {
+		return "", false
+	}
+	if !srvRecordRegexp.MatchString(record) {
+		log.V(0).Info("serverTemplate found invalid SRV record", "namespace", cfg.Namespace, "name", cfg.Name, "value", record)
+		return "", false
+	}
+
+	return fmt.Sprintf("server-template _srv- %d %s check resolvers %s init-addr none", count, record, discoveryResolvers), true
+}
+
+const (
+	// cacheControlAnnotation holds the caching hints of a route as comma
+	// separated max-age and stale-while-revalidate values in seconds, e.g.
+	// "max-age=60,stale-while-revalidate=30".
+	cacheControlAnnotation = "haproxy.router.openshift.io/cache-control"
+)
+
+// cacheControlHint returns the http-response directive setting the
+// Cache-Control header from the caching hints of a route, or the empty
+// string if the annotation is unset or invalid.
+func cacheControlHint(cfg ServiceAliasConfig) string {
+	value := cfg.Annotations[cacheControlAnnotation]
+	if len(value) == 0 {
+		return ""
+	}
+
+	var hints []string
+	seen := make(map[string]bool)
+	for _, hint := range strings.Split(value, ",") {
+		key, seconds, _ := strings.Cut(strings.TrimSpace(hint), "=")
+		n, err := strconv.Atoi(seconds)
+		if (key != "max-age" && key != "stale-while-revalidate") || seen[key] || err != nil || n < 0 {
+			log.V(0).Info("cacheControlHint found invalid cache hint", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+			return ""
+		}
+		seen[key] = true
+		hints = append(hints, fmt.Sprintf("%s=%d", key, n))
+	}
+
+	return "http-response set-header Cache-Control " + SanitizeHeaderValue(strings.Join(hints, ", "))
+}
+
+const (
+	// uniqueIDFormatAnnotation sets the format of the unique request ID of a
+	// route.
+	uniqueIDFormatAnnotation = "haproxy.router.openshift.io/unique-id-format"
+
+	// uniqueIDHeaderName is the header carrying the unique request ID.
+	uniqueIDHeaderName = "X-Request-ID"
+)
+
+// uniqueIDFormatRegexp matches a unique-id-format made of literal text,
+// connection and timing log-format variables and a restricted set of side
+// effect free sample fetches.
+var uniqueIDFormatRegexp = regexp.MustCompile(`^([A-Za-z0-9_.:-]|\\ |%\{\+X\}o|%(ci|cp|fi|fp|Ts|ms|rt|pid|H)|%\[(uuid(\(4\))?|rand(\([0-9]+\))?|src|src_port|dst|dst_port|date)\])+$`)
+
+// uniqueIDFormat returns the unique-id-format of a route from the
+// annotation, or def if the annotation is unset or uses anything but the
+// allowed variables and sample fetches.
+func uniqueIDFormat(cfg ServiceAliasConfig, def string) string {
+	value, ok := cfg.Annotations[uniqueIDFormatAnnotation]
+	if !ok {
+		return def
+	}
+	if !uniqueIDFormatRegexp.MatchString(value) {
+		log.V(0).Info("uniqueIDFormat found unsafe format, using default", "namespace", cfg.Namespace, "name", cfg.Name, "value", value, "default", def)
+		return def
+	}
+	return value
+}
+
+// uniqueIDDirectives returns the directives generating the unique request
+// ID of a route and passing it to the backend in the X-Request-ID header.
+func uniqueIDDirectives(cfg ServiceAliasConfig, def string) []string {
+	return []string{
+		"unique-id-format " + uniqueIDFormat(cfg, def),
+		"unique-id-header " + uniqueIDHeaderName,
+	}
+}
+
+const (
+	// tracingAnnotation enables trace header propagation for a route.
+	tracingAnnotation = "haproxy.router.openshift.io/tracing"
+
+	// spanIDHeaderName is the header carrying the span ID injected by the
+	// router.
+	spanIDHeaderName = "X-Span-ID"
+)
+
+// tracePropagationHeaders returns the directive injecting a span ID into
+// requests of a route that have none, or nil if tracing is not enabled for
+// the route. The trace context headers themselves are passed to the
+// backend untouched: copying them onto themselves with req.hdr would keep
+// only the last member of a comma separated tracestate or baggage header.
+func tracePropagationHeaders(cfg ServiceAliasConfig) []string {
+	if !isTrue(cfg.Annotations[tracingAnnotation]) {
+		return nil
+	}
+	return []string{fmt.Sprintf("http-request set-header %[1]s %%[rand,hex] unless { req.hdr(%[1]s) -m found }", spanIDHeaderName)}
+}
+
+const (
+	// rateLimitAnnotation enables connection rate limiting for a route.
+	rateLimitAnnotation = "haproxy.router.openshift.io/rate-limit-connections"
+)
+
+// rateLimitThresholdAnnotations are the annotations setting the connection
+// rate limits of a route.
+var rateLimitThresholdAnnotations = []string{
+	rateLimitAnnotation + ".concurrent-tcp",
+	rateLimitAnnotation + ".rate-tcp",
+	rateLimitAnnotation + ".rate-http",
+}
+
+// detectRateLimitAllowlistOverlap returns true if a route both restricts
+// its sources with an allowlist and rate limits connections, in which case
+// the rate limits apply to the allowlisted sources.
+func detectRateLimitAllowlistOverlap(cfg ServiceAliasConfig) bool {
+	if !isTrue(cfg.Annotations[rateLimitAnnotation]) {
+		return false
+	}
+
+	limited := false
+	for _, annotation := range rateLimitThresholdAnnotations {
+		if isInteger(cfg.Annotations[annotation]) {
+			limited = true
+			break
+		}
+	}
+	if !limited {
+		return false
+	}
+
+	allowlist := parseIPList(firstMatch(".+", cfg.Annotations["haproxy.router.openshift.io/ip_allowlist"], cfg.Annotations["haproxy.router.openshift.io/ip_whitelist"]))
+	return len(allowlist) > 0
+}
+
+// rateLimitExemptACL returns the acl matching the sources in the allowlist
+// file of a route, so that they can be exempted from rate limit tracking,
+// or the empty string if the route has no allowlist file.
+func rateLimitExemptACL(allowlistFile string) string {
+	if len(allowlistFile) == 0 {
+		return ""
+	}
+	return "acl rate_limit_exempt src -f " + allowlistFile
+}
+
+// distinctCertCount returns the number of distinct certificates served by
+// the router, including the default certificate, as tracked by the
+// certificate index of the template data.
+func distinctCertCount(td templateData) int {
+	count := 0
+	for contents, uses := range td.CertificateIndex {
+		if len(contents) > 0 && uses > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+const (
+	// minSSLCacheSize is the haproxy default tune.ssl.cachesize, in
+	// number of sessions.
+	minSSLCacheSize = 20000
+
+	// maxSSLCacheSize caps tune.ssl.cachesize, which at around 200 bytes
+	// per session keeps the shared session cache below 200MB.
+	maxSSLCacheSize = 1000000
+
+	// sslCacheSessionsPerCert is the number of cached sessions reserved
+	// for each distinct certificate.
+	sslCacheSessionsPerCert = 100
+)
+
+// sslCacheSize returns the tune.ssl.cachesize for the number of distinct
+// certificates and the maximum number of frontend connections: a session
+// per connection plus sslCacheSessionsPerCert per certificate, kept
+// between minSSLCacheSize and maxSSLCacheSize.
+func sslCacheSize(distinctCerts int, maxConn int) int {
+	size := maxConn + distinctCerts*sslCacheSessionsPerCert
+	switch {
+	case size < minSSLCacheSize:
+		return minSSLCacheSize
+	case size > maxSSLCacheSize:
+		return maxSSLCacheSize
+	}
+	return size
+}
+
+// deprecatedAnnotationReplacements maps deprecated route annotations to the
+// annotations replacing them.
+var deprecatedAnnotationReplacements = map[string]string{
+	"haproxy.router.openshift.io/ip_whitelist": "haproxy.router.openshift.io/ip_allowlist",
+}
+
+// deprecatedAnnotations returns the deprecated annotations of a route,
+// according to mapping, mapped to their replacements.
+func deprecatedAnnotations(cfg ServiceAliasConfig, mapping map[string]string) map[string]string {
+	deprecated := make(map[string]string)
+	for annotation := range cfg.Annotations {
+		if replacement, ok := mapping[annotation]; ok {
+			log.V(0).Info("route uses deprecated annotation", "namespace", cfg.Namespace, "name", cfg.Name, "annotation", annotation, "replacement", replacement)
+			deprecated[annotation] = replacement
+		}
+	}
+	return deprecated
+}
+
+// migrateAnnotations returns a copy of the annotations of a route with the
+// deprecated annotations, according to mapping, translated to their
+// replacements. A replacement annotation set on the route takes precedence
+// over the deprecated one. The route annotations are not modified.
+func migrateAnnotations(cfg ServiceAliasConfig, mapping map[string]string) map[string]string {
+	migrated := make(map[string]string, len(cfg.Annotations))
+	for annotation, value := range cfg.Annotations {
+		replacement, deprecated := mapping[annotation]
+		if !deprecated {
+			migrated[annotation] = value
+			continue
+		}
+		if _, ok := cfg.Annotations[replacement]; !ok {
+			migrated[replacement] = value
+		}
+	}
+	return migrated
+}
+
+const (
+	// legacyRegexpAnnotation opts a route into the legacy route regexp
+	// generation during the migration to the new one.
+	legacyRegexpAnnotation = "haproxy.router.openshift.io/legacy-regexp"
+)
+
+// useLegacyRegexp returns true if a route opts into the legacy
+// generateRouteRegexp and genSubdomainWildcardRegexp matching. Routes use
+// the new regexp generation by default.
+func useLegacyRegexp(cfg ServiceAliasConfig) bool {
+	value, ok := cfg.Annotations[legacyRegexpAnnotation]
+	if !ok {
+		return false
+	}
+	if !isValidBool(value) {
+		log.V(0).Info("useLegacyRegexp found invalid value, using new regexp generation", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+		return false
+	}
+	return isTrue(value)
+}
+
+// shouldShuffle returns true if the endpoints of a route should be
+// shuffled for the given action. Shuffling is skipped for routes with
+// session affinity enabled, since it would defeat the affinity.
+func shouldShuffle(cfg ServiceAliasConfig, action string) bool {
+	if strings.ToLower(action) != "shuffle" {
+		return false
+	}
+	if sessionAffinityEnabled(cfg) {
+		log.V(4).Info("not shuffling endpoints of route with session affinity", "namespace", cfg.Namespace, "name", cfg.Name)
+		return false
+	}
+	return true
+}
+
+// serverID returns the haproxy server id of an endpoint assigned to the
+// given backend slot. Server ids derive from the slot rather than the
+// position of the endpoint in the endpoint table, so they stay stable as
+// other endpoints come and go. It returns 0, letting haproxy assign the
+// id, if the endpoint has no slot.
+func serverID(ep Endpoint, slot int) int {
+	if slot < 0 {
+		log.V(4).Info("serverID found endpoint without slot", "endpoint", ep.ID)
+		return 0
+	}
+	return slot + 1
+}
+
+// parseIPNet parses an IP address or CIDR into an IP network, treating an
+// IP address as a single host network.
+func parseIPNet(value string) (*net.IPNet, bool) {
+	if _, ipNet, err := net.ParseCIDR(value); err == nil {
+		return ipNet, true
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, false
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+}
+
+// allowlistOverlapsCluster returns true if any entry of a white space
+// separated allowlist overlaps one of the cluster network CIDRs, which
+// would allow traffic from inside the cluster network.
+func allowlistOverlapsCluster(value string, clusterCIDRs []string) bool {
+	clusterNets := make([]*net.IPNet, 0, len(clusterCIDRs))
+	for _, cidr := range clusterCIDRs {
+		if clusterNet, ok := parseIPNet(cidr); ok {
+			clusterNets = append(clusterNets, clusterNet)
+		}
+	}
+
+	for _, entry := range strings.Fields(value) {
+		entryNet, ok := parseIPNet(entry)
+		if !ok {
+			continue
+		}
+		for _, clusterNet := range clusterNets {
+			if entryNet.Contains(clusterNet.IP) || clusterNet.Contains(entryNet.IP) {
+				log.V(0).Info("allowlist entry overlaps the cluster network", "entry", entry, "cluster", clusterNet.String())
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const (
+	// behindProxyAnnotation indicates that the clients of a route connect
+	// through an L7 proxy that adds the X-Forwarded-For header.
+	behindProxyAnnotation = "haproxy.router.openshift.io/behind-proxy"
+)
+
+// allowlistSourceExpr returns the sample fetch providing the client IP for
+// the allowlist acl of a route: the connection source address, or the
+// last X-Forwarded-For address for a route behind a proxy, as the source
+// address is the proxy address then.
+func allowlistSourceExpr(cfg ServiceAliasConfig) string {
+	if isTrue(cfg.Annotations[behindProxyAnnotation]) {
+		return xffClientIPExpr(1)
+	}
+	return "src"
+}
+
+// xffClientIPExpr returns the sample fetch extracting the client IP at the
+// given depth, counted from the right, of the X-Forwarded-For chain, or the
+// empty string if depth is not positive.
+func xffClientIPExpr(depth int) string {
+	if depth < 1 {
+		log.V(0).Info("xffClientIPExpr found invalid depth", "depth", depth)
+		return ""
+	}
+	return fmt.Sprintf("req.hdr_ip(X-Forwarded-For,-%d)", depth)
+}
+
+// allowlistOrDenyAll returns the allowlist acl matching the sources in the
+// allowlist file at path, or an allowlist acl matching nothing if path is
+// empty because the file could not be generated, so that the rejection of
+// sources not in the allowlist fails closed.
+func allowlistOrDenyAll(path string) string {
+	if len(path) == 0 {
+		log.V(0).Info("allowlist file is missing, denying all sources")
+		return "acl allowlist always_false"
+	}
+	return "acl allowlist src -f " + path
+}
+
+// accessDecisionACLs returns the acls and reject rules for a route with an
+// allowlist file at allowPath and a blocklist file at denyPath, either of
+// which may be empty. Sources not in the allowlist are rejected first, then
+// allowlisted sources that are also in the blocklist are rejected.
+func accessDecisionACLs(allowPath, denyPath string) []string {
+	var acls, rules []string
+	if len(allowPath) > 0 {
+		acls = append(acls, "acl allowlist src -f "+allowPath)
+		rules = append(rules, "tcp-request content reject if !allowlist")
+	}
+	if len(denyPath) > 0 {
+		acls = append(acls, "acl blocklist src -f "+denyPath)
+		rules = append(rules, "tcp-request content reject if blocklist")
+	}
+	return append(acls, rules...)
+}
+
+const (
+	// timeoutClientFinAnnotation sets the client-fin timeout of a route.
+	timeoutClientFinAnnotation = "haproxy.router.openshift.io/timeout-client-fin"
+
+	// timeoutServerFinAnnotation sets the server-fin timeout of a route.
+	timeoutServerFinAnnotation = "haproxy.router.openshift.io/timeout-server-fin"
+)
+
+// finTimeouts returns the timeout client-fin and timeout server-fin
+// directives of a route with the clipped annotation values, skipping
+// timeouts that are unset or invalid.
+func finTimeouts(cfg ServiceAliasConfig) []string {
+	var directives []string
+	for _, timeout := range []struct{ name, annotation string }{
+		{"client-fin", timeoutClientFinAnnotation},
+		{"server-fin", timeoutServerFinAnnotation},
+	} {
+		if value := clipHAProxyTimeoutValue(cfg.Annotations[timeout.annotation]); len(value) > 0 {
+			directives = append(directives, fmt.Sprintf("timeout %s %s", timeout.name, value))
+		}
+	}
+	return directives
+}
+
+const (
+	// headerBufferSizeAnnotation sets the size in bytes of the headers a
+	// route needs to handle.
+	headerBufferSizeAnnotation = "haproxy.router.openshift.io/header-buffer-size"
+
+	// defaultBufsize is the haproxy default tune.bufsize.
+	defaultBufsize = 16384
+
+	// maxBufsize caps the tune.bufsize recommended for large headers.
+	maxBufsize = 131072
+)
+
+// headerBufferSize returns the tune.bufsize recommended for the header
+// size of a route: the requested size rounded up to a power of two, capped
+// at maxBufsize. It returns 0 if the annotation is unset or invalid.
+func headerBufferSize(cfg ServiceAliasConfig) int {
+	value, ok := cfg.Annotations[headerBufferSizeAnnotation]
+	if !ok {
+		return 0
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		log.V(0).Info("headerBufferSize found invalid header buffer size", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+		return 0
+	}
+
+	bufsize := defaultBufsize
+	for bufsize < size && bufsize < maxBufsize {
+		bufsize *= 2
+	}
+	if size > maxBufsize {
+		log.V(0).Info("headerBufferSize capped header buffer size", "namespace", cfg.Namespace, "name", cfg.Name, "value", size, "bufsize", maxBufsize)
+	}
+	return bufsize
+}
+
+// needsLargeHeaderBuffer returns true if a route needs a tune.bufsize
+// larger than the haproxy default to handle its headers.
+func needsLargeHeaderBuffer(cfg ServiceAliasConfig) bool {
+	return headerBufferSize(cfg) > defaultBufsize
+}
+
+// recommendedBufsize returns the tune.bufsize accommodating the largest
+// header buffer size required by the routes, or def if it is larger or no
+// route requires a header buffer size.
+func recommendedBufsize(td templateData, def int) int {
+	bufsize := def
+	for _, cfg := range td.State {
+		if size := headerBufferSize(cfg); size > bufsize {
+			bufsize = size
+		}
+	}
+	return bufsize
+}
+
+const (
+	// normalizeURIAnnotation holds a comma separated list of the URI
+	// normalizers applied to the requests of a route.
+	normalizeURIAnnotation = "haproxy.router.openshift.io/normalize-uri"
+)
+
+// uriNormalizers are the haproxy http-request normalize-uri normalizers.
+var uriNormalizers = map[string]bool{
+	"fragment-encode":           true,
+	"fragment-strip":            true,
+	"path-merge-slashes":        true,
+	"path-strip-dot":            true,
+	"path-strip-dotdot":         true,
+	"percent-decode-unreserved": true,
+	"percent-to-uppercase":      true,
+	"query-sort-by-name":        true,
+}
+
+// normalizeURIDirectives returns the http-request normalize-uri directives
+// for the normalizers of a route, in the order given by the annotation.
+// Unknown normalizers are ignored.
+func normalizeURIDirectives(cfg ServiceAliasConfig) []string {
+	var directives []string
+	seen := make(map[string]bool)
+	for _, normalizer := range strings.Split(cfg.Annotations[normalizeURIAnnotation], ",") {
+		normalizer = strings.TrimSpace(normalizer)
+		switch {
+		case len(normalizer) == 0, seen[normalizer]:
+		case !uriNormalizers[normalizer]:
+			log.V(0).Info("normalizeURIDirectives ignoring unknown normalizer", "namespace", cfg.Namespace, "name", cfg.Name, "normalizer", normalizer)
+		default:
+			seen[normalizer] = true
+			directives = append(directives, "http-request normalize-uri "+normalizer)
+		}
+	}
+	return directives
+}
+
+// multipleSlashesRegexp matches consecutive slashes in a path.
+var multipleSlashesRegexp = regexp.MustCompile(`/{2,}`)
+
+// detectNormalizationAmbiguity returns the sorted keys of the aliases whose
+// paths differ but become identical on the same host once percent-decoded
+// and with consecutive slashes merged, as requests for one of them may be
+// routed to the other.
+func detectNormalizationAmbiguity(aliases map[ServiceAliasConfigKey]ServiceAliasConfig) []ServiceAliasConfigKey {
+	groups := make(map[string][]ServiceAliasConfigKey)
+	for k, cfg := range aliases {
+		decoded, _ := decodePath(cfg.Path)
+		normalized := cfg.Host + multipleSlashesRegexp.ReplaceAllString(decoded, "/")
+		groups[normalized] = append(groups[normalized], k)
+	}
+
+	ambiguous := make([]ServiceAliasConfigKey, 0)
+	for normalized, keys := range groups {
+		paths := make(map[string]bool)
+		for _, k := range keys {
+			paths[aliases[k].Path] = true
+		}
+		if len(paths) > 1 {
+			log.V(0).Info("routes have ambiguous paths after normalization", "normalized", normalized, "routes", keys)
+			ambiguous = append(ambiguous, keys...)
+		}
+	}
+
+	sort.Slice(ambiguous, func(i, j int) bool {
+		return ambiguous[i] < ambiguous[j]
+	})
+	return ambiguous
+}
+
+const (
+	// compressionAnnotation enables response compression for a route.
+	compressionAnnotation = "haproxy.router.openshift.io/compression"
+
+	// compressionLevelAnnotation sets the compression level of a route.
+	compressionLevelAnnotation = "haproxy.router.openshift.io/compression.level"
+
+	// defaultCompressionLevel is the compression level used if a route does
+	// not set a valid one.
+	defaultCompressionLevel = 6
+)
+
+// compressionOffload returns whether response compression is enabled for a
+// route and its compression level, between 1 and 9. An invalid level is
+// replaced with defaultCompressionLevel.
+func compressionOffload(cfg ServiceAliasConfig) (bool, int) {
+	if !isTrue(cfg.Annotations[compressionAnnotation]) {
+		return false, 0
+	}
+
+	value, ok := cfg.Annotations[compressionLevelAnnotation]
+	if !ok {
+		return true, defaultCompressionLevel
+	}
+	level, err := strconv.Atoi(value)
+	if err != nil || level < 1 || level > 9 {
+		log.V(0).Info("compressionOffload found invalid compression level, using default", "namespace", cfg.Namespace, "name", cfg.Name, "value", value, "default", defaultCompressionLevel)
+		return true, defaultCompressionLevel
+	}
+	return true, level
+}
+
+// knownRouteAnnotations are the route annotations understood by the
+// router.
+var knownRouteAnnotations = map[string]bool{
+	"haproxy.router.openshift.io/backend-config-snippet":     true,
+	"haproxy.router.openshift.io/disable_cookies":            true,
+	"haproxy.router.openshift.io/h1-adjust-case":             true,
+	"haproxy.router.openshift.io/hsts_header":                true,
+	"haproxy.router.openshift.io/ip_allowlist":               true,
+	"haproxy.router.openshift.io/ip_whitelist":               true,
+	"haproxy.router.openshift.io/pod-concurrent-connections": true,
+	"haproxy.router.openshift.io/rewrite-target":             true,
+	"haproxy.router.openshift.io/set-forwarded-headers":      true,
+	"router.openshift.io/cookie_name":                        true,
+	"router.openshift.io/haproxy.health.check.interval":      true,
+	"router.openshift.io/pool-size":                          true,
+	abortOnCloseAnnotation:                                   true,
+	allowedIssuersAnnotation:                                 true,
+	backupServersAnnotation:                                  true,
+	backendProtocolAnnotation:                                true,
+	backendSNIAnnotation:                                     true,
+	balanceAnnotation:                                        true,
+	behindProxyAnnotation:                                    true,
+	cacheControlAnnotation:                                   true,
+	clientCAAnnotation:                                       true,
+	clientCRLAnnotation:                                      true,
+	compressionAnnotation:                                    true,
+	compressionLevelAnnotation:                               true,
+	connRateLimitAnnotation:                                  true,
+	connectionModeAnnotation:                                 true,
+	cookieSameSiteAnnotation:                                 true,
+	defaultCertificateAnnotation:                             true,
+	disableForwardedHeadersAnnotation:                        true,
+	dnsDiscoveryAnnotation:                                   true,
+	dscpAnnotation:                                           true,
+	forwardClientCertDNAnnotation:                            true,
+	geoRoutingAnnotation:                                     true,
+	h2MaxConcurrentStreamsAnnotation:                         true,
+	hashHeaderAnnotation:                                     true,
+	headerBufferSizeAnnotation:                               true,
+	healthCheckExpectStatusAnnotation:                        true,
+	http3Annotation:                                          true,
+	keepAliveTimeoutAnnotation:                               true,
+	legacyRegexpAnnotation:                                   true,
+	maintenanceWindowAnnotation:                              true,
+	normalizeURIAnnotation:                                   true,
+	preserveHostAnnotation:                                   true,
+	rateLimitAnnotation:                                      true,
+	rateLimitAnnotation + ".concurrent-tcp":                  true,
+	rateLimitAnnotation + ".rate-tcp":                        true,
+	rateLimitAnnotation + ".rate-http":                       true,
+	securityHeadersAnnotation:                                true,
+	sessionAffinityAnnotation:                                true,
+	sniInspectDelayAnnotation:                                true,
+	sslCiphersAnnotation:                                     true,
+	sslMinVersionAnnotation:                                  true,
+	stripPrefixAnnotation:                                    true,
+	tcpCheckPortAnnotation:                                   true,
+	timeoutAnnotation:                                        true,
+	timeoutClientAnnotation:                                  true,
+	timeoutClientFinAnnotation:                               true,
+	timeoutServerFinAnnotation:                               true,
+	timeoutTunnelAnnotation:                                  true,
+	tracingAnnotation:                                        true,
+	uniqueIDFormatAnnotation:                                 true,
+	verifyBackendHostAnnotation:                              true,
+	waitForBodyAnnotation:                                    true,
+	waitForBodyAtLeastAnnotation:                             true,
+}
+
+// knownRouteAnnotationPrefixes are the prefixes of the route annotation
+// families understood by the router.
+var knownRouteAnnotationPrefixes = []string{
+	sendProxyAnnotationPrefix,
+	securityHeaderAnnotationPrefix,
+}
+
+// isKnownRouteAnnotation returns true if annotation is understood by the
+// router.
+func isKnownRouteAnnotation(annotation string) bool {
+	if knownRouteAnnotations[annotation] {
+		return true
+	}
+	for _, prefix := range knownRouteAnnotationPrefixes {
+		if strings.HasPrefix(annotation, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// closestRouteAnnotation returns the known route annotation closest to
+// annotation if it is likely a typo of it, or the empty string otherwise.
+func closestRouteAnnotation(annotation string) string {
+	const maxTypoDistance = 2
+
+	closest, distance := "", maxTypoDistance+1
+	for known := range knownRouteAnnotations {
+		if d := editDistance(annotation, known); d < distance || (d == distance && known < closest) {
+			closest, distance = known, d
+		}
+	}
+	return closest
+}
+
+// routeTimeoutAnnotations are the route annotations holding a timeout.
+var routeTimeoutAnnotations = []string{
+	timeoutAnnotation,
+	timeoutClientAnnotation,
+	timeoutClientFinAnnotation,
+	timeoutServerFinAnnotation,
+	timeoutTunnelAnnotation,
+	keepAliveTimeoutAnnotation,
+}
+
+// validateRouteAnnotations returns diagnostics for the annotations of a
+// route: unknown and deprecated annotations, likely typos, invalid or out
+// of range values and conflicting settings. The diagnostics are ordered by
+// annotation name, followed by the conflicts.
+func validateRouteAnnotations(cfg ServiceAliasConfig) []string {
+	var diagnostics []string
+
+	annotations := make([]string, 0, len(cfg.Annotations))
+	for annotation := range cfg.Annotations {
+		if strings.HasPrefix(annotation, "haproxy.router.openshift.io/") || strings.HasPrefix(annotation, "router.openshift.io/") {
+			annotations = append(annotations, annotation)
+		}
+	}
+	sort.Strings(annotations)
+
+	for _, annotation := range annotations {
+		if replacement, ok := deprecatedAnnotationReplacements[annotation]; ok {
+			diagnostics = append(diagnostics, fmt.Sprintf("annotation %s is deprecated, use %s", annotation, replacement))
+		} else if !isKnownRouteAnnotation(annotation) {
+			if closest := closestRouteAnnotation(annotation); len(closest) > 0 {
+				diagnostics = append(diagnostics, fmt.Sprintf("unknown annotation %s, did you mean %s?", annotation, closest))
+			} else {
+				diagnostics = append(diagnostics, fmt.Sprintf("unknown annotation %s", annotation))
+			}
+		}
+	}
+
+	for _, annotation := range routeTimeoutAnnotations {
+		value, ok := cfg.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		switch clipped := clipHAProxyTimeoutValue(value); {
+		case len(clipped) == 0:
+			diagnostics = append(diagnostics, fmt.Sprintf("annotation %s has invalid timeout %q", annotation, value))
+		case clipped != value:
+			diagnostics = append(diagnostics, fmt.Sprintf("annotation %s timeout %q exceeds the maximum of %s", annotation, value, clipped))
+		}
+	}
+	if value, ok := cfg.Annotations[h2MaxConcurrentStreamsAnnotation]; ok {
+		if streams, err := strconv.Atoi(value); err != nil || streams < minH2ConcurrentStreams || streams > maxH2ConcurrentStreams {
+			diagnostics = append(diagnostics, fmt.Sprintf("annotation %s value %q is not between %d and %d", h2MaxConcurrentStreamsAnnotation, value, minH2ConcurrentStreams, maxH2ConcurrentStreams))
+		}
+	}
+	if value, ok := cfg.Annotations[compressionLevelAnnotation]; ok {
+		if level, err := strconv.Atoi(value); err != nil || level < 1 || level > 9 {
+			diagnostics = append(diagnostics, fmt.Sprintf("annotation %s value %q is not between 1 and 9", compressionLevelAnnotation, value))
+		}
+	}
+	if value, ok := cfg.Annotations[tcpCheckPortAnnotation]; ok && !isValidPort(value) {
+		diagnostics = append(diagnostics, fmt.Sprintf("annotation %s value %q is not a valid port", tcpCheckPortAnnotation, value))
+	}
+
+	if description, consistent := validateTimeoutConsistency(cfg); !consistent {
+		diagnostics = append(diagnostics, description)
+	}
+	if balance := firstMatch(balanceAlgoPattern, cfg.Annotations[balanceAnnotation]); sessionAffinityEnabled(cfg) && len(balance) > 0 && balance != "source" {
+		diagnostics = append(diagnostics, fmt.Sprintf("session affinity overrides balance %s", balance))
+	}
+	if detectRateLimitAllowlistOverlap(cfg) {
+		diagnostics = append(diagnostics, "rate limits apply to the allowlisted sources")
+	}
+
+	return diagnostics
+}
+
+// formatDiagnosticsJSON returns the diagnostics of a route as a compact
+// JSON array, suitable for a route status condition message.
+func formatDiagnosticsJSON(diags []string) string {
+	if diags == nil {
+		diags = []string{}
+	}
+	data, err := json.Marshal(diags)
+	if err != nil {
+		log.Error(err, "unable to marshal route diagnostics")
+		return "[]"
+	}
+	return string(data)
+}
+
+const (
+	// hashHeaderAnnotation holds the name of the request header whose value
+	// consistently maps the requests of a route to its servers.
+	hashHeaderAnnotation = "haproxy.router.openshift.io/balance.hash-header"
+)
+
+// headerHashExpr returns the directives balancing the requests of a route
+// by consistent hashing of the header named by the annotation, one per
+// line, and true if header hashing applies to the route.
+func headerHashExpr(cfg ServiceAliasConfig) (string, bool) {
+	header, ok := cfg.Annotations[hashHeaderAnnotation]
+	if !ok {
+		return "", false
+	}
+	if !isValidHeaderName(header) {
+		log.V(0).Info("headerHashExpr found invalid header name", "namespace", cfg.Namespace, "name", cfg.Name, "header", header)
+		return "", false
+	}
+	return fmt.Sprintf("balance hdr(%s)\nhash-type consistent", header), true
+}
+
+const (
+	// backendProtocolAnnotation sets the protocol spoken to the backend of
+	// a route.
+	backendProtocolAnnotation = "haproxy.router.openshift.io/backend-protocol"
+)
+
+// detectBackendProtocolConflict reports whether the backend protocol of a
+// route contradicts its TLS termination: cleartext h2c cannot be spoken to
+// the backend of reencrypt and passthrough routes, whose backend traffic is
+// encrypted. It returns a description of the conflict and true if one is
+// found.
+func detectBackendProtocolConflict(cfg ServiceAliasConfig) (string, bool) {
+	protocol := strings.ToLower(cfg.Annotations[backendProtocolAnnotation])
+	if protocol != "h2c" {
+		return "", false
+	}
+
+	switch termination := effectiveTLSMode(cfg); termination {
+	case routev1.TLSTerminationReencrypt, routev1.TLSTerminationPassthrough:
+		log.V(0).Info("backend protocol conflicts with TLS termination", "namespace", cfg.Namespace, "name", cfg.Name, "protocol", protocol, "termination", termination)
+		return fmt.Sprintf("backend protocol %s conflicts with %s termination, which encrypts traffic to the backend", protocol, termination), true
+	}
+	return "", false
+}
+
+const (
+	// backendSNIAnnotation sets the host name used to reach the backend of
+	// a reencrypt route.
+	backendSNIAnnotation = "haproxy.router.openshift.io/backend-sni"
+
+	// verifyBackendHostAnnotation enables or disables the verification of
+	// the backend certificate host name of a reencrypt route.
+	verifyBackendHostAnnotation = "haproxy.router.openshift.io/verify-backend-host"
+)
+
+// verifyHost returns the verifyhost server option of a reencrypt route,
+// verifying the backend certificate against the backend SNI annotation or
+// else the route host, or the empty string for other routes and when
+// verification is disabled.
+func verifyHost(cfg ServiceAliasConfig) string {
+	if effectiveTLSMode(cfg) != routev1.TLSTerminationReencrypt {
+		return ""
+	}
+	if value, ok := cfg.Annotations[verifyBackendHostAnnotation]; ok && isValidBool(value) && !isTrue(value) {
+		return ""
+	}
+
+	host := ""
+	if sni, ok := cfg.Annotations[backendSNIAnnotation]; ok {
+		host = sanitizeHost(sni)
+	}
+	if len(host) == 0 {
+		host = sanitizeHost(cfg.Host)
+	}
+	if len(host) == 0 {
+		return ""
+	}
+	return "verifyhost " + host
+}
+
+// routeMatchACLs returns the anonymous acls matching the requests of a
+// route in an http frontend: its host (see hostACL) and its path prefix.
+func routeMatchACLs(cfg ServiceAliasConfig, host string) string {
+	acls := hostACL(cfg, "hdr(host),field(1,:)", host)
+	if len(cfg.Path) > 0 && cfg.Path != "/" {
+		acls = fmt.Sprintf("%s { path_beg %s }", acls, cfg.Path)
+	}
+	return acls
+}
+
+// hostACL returns the anonymous acl matching the host of a route in the
+// given sample fetch. A wildcard route covers a single label in front of
+// its subdomain, as with genSubdomainWildcardRegexp, so its host is
+// matched with a regular expression rather than by suffix.
+func hostACL(cfg ServiceAliasConfig, fetch, host string) string {
+	if cfg.IsWildcard {
+		if idx := strings.IndexRune(host, '.'); idx > 0 {
+			return fmt.Sprintf("{ %s -m reg -i '^[^.]*%s$' }", fetch, regexp.QuoteMeta(host[idx:]))
+		}
+	}
+	return fmt.Sprintf("{ %s -i %s }", fetch, host)
+}
+
+// renderFrontend returns the frontend sections of the router configuration
+// for the routes in the template data: the public frontend serving http
+// routes and redirecting insecure requests, the public_ssl frontend routing
+// passthrough routes by SNI, and the fe_sni frontend terminating TLS for
+// edge and reencrypt routes. Routes are matched in orderUseBackendRules
+// order, with the https redirects of the public frontend ahead of its
+// use_backend rules as haproxy processes them first anyway. The inspect
+// delay of the public_ssl frontend is the longest sniInspectDelay of the
+// passthrough routes.
+func renderFrontend(td templateData) string {
+	var redirects, public, publicSSL, feSNI []string
+	inspectDelay := sniInspectDelay(ServiceAliasConfig{TLSTermination: routev1.TLSTerminationPassthrough})
+	for _, k := range orderUseBackendRules(td.State) {
+		cfg := td.State[k]
+		if isUnmatchableRoute(cfg) {
+			continue
+		}
+		host := sanitizeHost(cfg.Host)
+		if len(host) == 0 {
+			continue
+		}
+
+		termination := effectiveTLSMode(cfg)
+		backend := fmt.Sprintf("%s:%s", templateutil.GenerateBackendNamePrefix(termination), k)
+		useBackend := fmt.Sprintf("  use_backend %s if %s", backend, routeMatchACLs(cfg, host))
+
+		switch termination {
+		case routev1.TLSTerminationPassthrough:
+			if _, _, ok := passthroughSNIMapEntry(cfg); ok {
+				publicSSL = append(publicSSL, fmt.Sprintf("  use_backend %s if %s", backend, hostACL(cfg, "req_ssl_sni", host)))
+				if delay := sniInspectDelay(cfg); inspectDelayLess(inspectDelay, delay) {
+					inspectDelay = delay
+				}
+			}
+		case routev1.TLSTerminationEdge, routev1.TLSTerminationReencrypt:
+			feSNI = append(feSNI, useBackend)
+			if rule := httpsRedirectRule(cfg); len(rule) > 0 {
+				redirects = append(redirects, "  "+rule)
+			} else if cfg.InsecureEdgeTerminationPolicy == routev1.InsecureEdgeTerminationPolicyAllow {
+				public = append(public, useBackend)
+			}
+		default:
+			public = append(public, useBackend)
+		}
+	}
+
+	bindOptions := "ssl crt " + firstMatch(".+", td.DefaultCertificate, "/var/lib/haproxy/conf/default_pub_keys.pem") +
+		" crt-list " + path.Join(td.WorkingDir, "conf", "cert_config.map") + " accept-proxy"
+	if !td.DisableHTTP2 {
+		bindOptions += " alpn h2,http/1.1"
+	}
+
+	var out strings.Builder
+	out.WriteString("frontend public\n")
+	fmt.Fprintf(&out, "  bind :%s\n", servicePort("ROUTER_SERVICE_HTTP_PORT", "80"))
+	out.WriteString("  mode http\n")
+	for _, line := range append(redirects, public...) {
+		out.WriteString(line + "\n")
+	}
+	out.WriteString("  default_backend openshift_default\n\n")
+
+	out.WriteString("frontend public_ssl\n")
+	fmt.Fprintf(&out, "  bind :%s\n", env("ROUTER_SERVICE_HTTPS_PORT", "443"))
+	out.WriteString("  mode tcp\n")
+	fmt.Fprintf(&out, "  tcp-request inspect-delay %s\n", inspectDelay)
+	out.WriteString("  tcp-request content accept if { req_ssl_hello_type 1 }\n")
+	for _, line := range publicSSL {
+		out.WriteString(line + "\n")
+	}
+	out.WriteString("  default_backend be_sni\n\n")
+
+	out.WriteString("frontend fe_sni\n")
+	fmt.Fprintf(&out, "  bind unix@/var/lib/haproxy/run/haproxy-sni.sock %s\n", bindOptions)
+	out.WriteString("  mode http\n")
+	for _, line := range feSNI {
+		out.WriteString(line + "\n")
+	}
+	out.WriteString("  default_backend openshift_default\n")
+
+	return out.String()
+}
+
+// inspectDelayLess returns true if the inspect delay a is shorter than b.
+// Delays that can not be parsed are considered shorter than valid ones.
+func inspectDelayLess(a, b string) bool {
+	db, err := haproxytime.ParseDuration(b)
+	if err != nil {
+		return false
+	}
+	da, err := haproxytime.ParseDuration(a)
+	return err != nil || da < db
+}
+
+// orderUseBackendRules returns the keys of the given aliases in the order in
+// which their use_backend rules should be emitted. Like orderAllAliases it
+// puts the most specific host first, but rules for the same host are kept
+// together and ordered by path specificity so that a nested path is always
+// matched before the path it is nested under.
+func orderUseBackendRules(aliases map[ServiceAliasConfigKey]ServiceAliasConfig) []ServiceAliasConfigKey {
+	keys := make([]ServiceAliasConfigKey, 0, len(aliases))
+	for k := range aliases {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := aliases[keys[i]], aliases[keys[j]]
+		if hi, hj := hostSpecificity(a), hostSpecificity(b); hi != hj {
+			return hi > hj
+		}
+		if ha, hb := strings.ToLower(a.Host), strings.ToLower(b.Host); ha != hb {
+			return ha < hb
+		}
+		if pi, pj := pathSpecificity(a.Path), pathSpecificity(b.Path); pi != pj {
+			return pi > pj
+		}
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
+// isRoutableEndpoint returns false if the endpoint's address is a loopback
+// (127.0.0.0/8, ::1) or link-local (169.254.0.0/16, fe80::/10) address.
+// Such endpoints point back at the router host itself or at a network that
+// is not reachable from it and indicate a misconfigured endpoints object,
+// so they should not be served. Addresses that can not be parsed are left
+// for the caller to deal with.
+func isRoutableEndpoint(ep Endpoint) bool {
+	ip := net.ParseIP(ep.IP)
+	if ip == nil {
+		return true
+	}
+
+	switch {
+	case ip.IsLoopback():
+		log.V(0).Info("endpoint has a loopback address and will not be served", "id", ep.ID, "ip", ep.IP)
+		return false
+	case ip.IsLinkLocalUnicast():
+		log.V(0).Info("endpoint has a link-local address and will not be served", "id", ep.ID, "ip", ep.IP)
+		return false
+	}
+
+	return true
+}
+
+// routeFingerprint returns a fingerprint of a route and its endpoints made
+// up of separate hashes of the route configuration, its certificates and
+// its endpoints, in the form "config=<hash> certs=<hash> endpoints=<hash>",
+// so that comparing fingerprints tells which part of a route changed. As
+// in changeKind, fields derived from the endpoints, persistence state and
+// the order of the endpoints are not significant.
+func routeFingerprint(cfg ServiceAliasConfig, eps []Endpoint) string {
+	cfg = withoutDerivedState(cfg)
+	certs := cfg.Certificates
+	cfg.Certificates = nil
+
+	endpoints := make([]string, 0, len(eps))
+	for _, ep := range eps {
+		endpoints = append(endpoints, fmt.Sprintf("%#v", ep))
+	}
+	sort.Strings(endpoints)
+
+	return fmt.Sprintf("config=%s certs=%s endpoints=%s", fingerprintHash(cfg), fingerprintHash(certs), fingerprintHash(endpoints))
+}
+
+// fingerprintHash returns a short hash of the go syntax representation of
+// v. Map keys are printed in sorted order, so the hash is stable.
+func fingerprintHash(v interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%#v", v)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// parseRouteFingerprint splits a fingerprint returned by routeFingerprint
+// into its parts, keyed by part name.
+func parseRouteFingerprint(fingerprint string) map[string]string {
+	parts := map[string]string{}
+	for _, field := range strings.Fields(fingerprint) {
+		if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+			parts[kv[0]] = kv[1]
+		}
+	}
+	return parts
+}
+
+// reloadReason summarizes why a reload is happening, given the route
+// fingerprints (see routeFingerprint) before and after the change, e.g.
+// "3 routes added, 1 cert changed, 2 endpoints changed". A route whose
+// fingerprint can not be broken down into parts is counted as changed.
+func reloadReason(prev, curr map[ServiceAliasConfigKey]string) string {
+	var added, removed, routes, certs, endpoints int
+	for k, fingerprint := range curr {
+		old, ok := prev[k]
+		if !ok {
+			added++
+			continue
+		}
+		if old == fingerprint {
+			continue
+		}
+
+		oldParts, newParts := parseRouteFingerprint(old), parseRouteFingerprint(fingerprint)
+		if len(oldParts) == 0 || len(newParts) == 0 {
+			routes++
+			continue
+		}
+		if oldParts["config"] != newParts["config"] {
+			routes++
+		}
+		if oldParts["certs"] != newParts["certs"] {
+			certs++
+		}
+		if oldParts["endpoints"] != newParts["endpoints"] {
+			endpoints++
+		}
+	}
+	for k := range prev {
+		if _, ok := curr[k]; !ok {
+			removed++
+		}
+	}
+
+	var reasons []string
+	for _, r := range []struct {
+		count            int
+		singular, plural string
+	}{
+		{added, "route added", "routes added"},
+		{removed, "route removed", "routes removed"},
+		{routes, "route changed", "routes changed"},
+		{certs, "cert changed", "certs changed"},
+		{endpoints, "endpoint changed", "endpoints changed"},
+	} {
+		switch {
+		case r.count == 1:
+			reasons = append(reasons, fmt.Sprintf("1 %s", r.singular))
+		case r.count > 1:
+			reasons = append(reasons, fmt.Sprintf("%d %s", r.count, r.plural))
+		}
+	}
+
+	if len(reasons) == 0 {
+		return "no changes"
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// shouldUseRuntimeAPI returns true if the given changes, as classified by
+// changeKind and keyed by route, can all be applied through the haproxy
+// runtime api instead of a full reload. That is the case when at least one
+// route changed and every change is endpoint-only; any structural change
+// requires a reload.
+func shouldUseRuntimeAPI(changes map[ServiceAliasConfigKey]string) bool {
+	endpointChanges := 0
+	for k, kind := range changes {
+		switch kind {
+		case changeKindNone:
+		case changeKindEndpoints:
+			endpointChanges++
+		default:
+			log.V(4).Info("route change requires a reload", "key", k, "kind", kind)
+			return false
+		}
+	}
+
+	return endpointChanges > 0
+}
+
+// maxBindLines is the maximum number of bind lines bindLines generates for
+// a single frontend.
+const maxBindLines = 16
+
+// bindAddress returns the address a frontend binds to for the given port
+// on all interfaces, e.g. ":80".
+func bindAddress(port int) string {
+	return net.JoinHostPort("", strconv.Itoa(port))
+}
+
+// bindLines returns a bind directive with the given bind options for each
+// of the given ports. Invalid ports are skipped, duplicates are dropped
+// keeping the order of their first occurrence, and at most maxBindLines
+// directives are returned so that a misconfigured port list can not blow
+// up the generated configuration.
+func bindLines(ports []int, opts string) []string {
+	opts = strings.TrimSpace(opts)
+
+	var lines []string
+	seen := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			log.V(0).Info("skipping bind line for invalid port", "port", port)
+			continue
+		}
+		if seen[port] {
+			continue
+		}
+		seen[port] = true
+
+		if len(lines) == maxBindLines {
+			log.V(0).Info("capping number of bind lines", "ports", len(ports), "max", maxBindLines)
+			break
+		}
+
+		line := "bind " + bindAddress(port)
+		if len(opts) > 0 {
+			line += " " + opts
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// matchesDefaultWildcard returns true if a route is a wildcard covering the
+// same hosts as the router's default wildcard, i.e. a wildcard route for a
+// host in the default domain "apps.example.com" (which may itself be given
+// as a "*." wildcard). A wildcard covers a single label in front of its
+// subdomain, as with hostACL, so wildcards for a parent or a subdomain of
+// the default domain do not overlap with it. Such a route would shadow the
+// router's own wildcard and capture traffic meant for other routes.
+func matchesDefaultWildcard(cfg ServiceAliasConfig, defaultDomain string) bool {
+	if !cfg.IsWildcard {
+		return false
+	}
+
+	domain := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(defaultDomain)), ".")
+	domain = strings.TrimPrefix(domain, "*.")
+	subdomain := strings.TrimSuffix(strings.ToLower(routeapihelpers.GetDomainForHost(cfg.Host)), ".")
+	if len(domain) == 0 || subdomain != domain {
+		return false
+	}
+
+	log.V(0).Info("route host shadows the router's default wildcard", "namespace", cfg.Namespace, "name", cfg.Name, "host", cfg.Host, "defaultDomain", domain)
+	return true
+}
+
+// keepAliveTimeout returns the timeout http-keep-alive value of a route
+// from its timeout-http-keep-alive annotation, clipped to what haproxy
+// allows, or def if the annotation is unset or invalid.
+func keepAliveTimeout(cfg ServiceAliasConfig, def string) string {
+	if value := clipHAProxyTimeoutValue(cfg.Annotations[keepAliveTimeoutAnnotation]); len(value) > 0 {
+		return value
+	}
+	return def
+}
+
+// tcpBlocklistReject returns the rule rejecting connections from the
+// sources in the blocklist file at blocklistPath at the tcp layer, as
+// needed for passthrough routes where no http processing takes place, or
+// the empty string if there is no blocklist file.
+func tcpBlocklistReject(blocklistPath string) string {
+	if len(blocklistPath) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("tcp-request connection reject if { src -f %s }", blocklistPath)
+}
+
+// allowlistACL returns the allowlist acl and the rule rejecting sources not
+// in the allowlist for a route, or the empty string if the route has no
+// allowlist. An allowlist short enough for a single config line is inlined
+// in the acl, a longer one is read from the allowlist file at path, and an
+// empty path then denies all sources, as with allowlistOrDenyAll.
+// Passthrough routes are filtered on the connection source address, other
+// routes at the http layer where the client IP may be taken from the
+// X-Forwarded-For header (see allowlistSourceExpr).
+func allowlistACL(cfg ServiceAliasConfig, path string) string {
+	allowlist := parseIPList(firstMatch(".+", cfg.Annotations["haproxy.router.openshift.io/ip_allowlist"], cfg.Annotations["haproxy.router.openshift.io/ip_whitelist"]))
+	if len(allowlist) == 0 {
+		return ""
+	}
+
+	expr, reject := allowlistSourceExpr(cfg), "http-request deny if !allowlist"
+	if cfg.TLSTermination == routev1.TLSTerminationPassthrough {
+		expr, reject = "src", "tcp-request content reject if !allowlist"
+	}
+
+	var acl string
+	switch {
+	case validateHAProxyAllowlist(allowlist):
+		acl = fmt.Sprintf("acl allowlist %s %s", expr, allowlist)
+	case len(path) > 0:
+		acl = fmt.Sprintf("acl allowlist %s -f %s", expr, path)
+	default:
+		acl = allowlistOrDenyAll(path)
+	}
+	return acl + "\n" + reject
+}
+
+// detectBindConflicts returns the bind specifications in binds that
+// collide with an earlier one, i.e. that bind the same address and port.
+// Each bind is a bind line or its address, optionally followed by bind
+// options; an address without a host (":80") binds all interfaces and so
+// collides with any address on the same port.
+func detectBindConflicts(binds []string) []string {
+	type listener struct{ host, port string }
+
+	var conflicts []string
+	var seen []listener
+	for _, bind := range binds {
+		fields := strings.Fields(bind)
+		if len(fields) > 0 && fields[0] == "bind" {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(fields[0])
+		if err != nil {
+			// Not a host:port address, e.g. a unix socket path, which only
+			// collides with the exact same address.
+			host, port = fields[0], ""
+		}
+
+		conflict := false
+		for _, l := range seen {
+			if l.port == port && (l.host == host || (len(port) > 0 && (len(l.host) == 0 || len(host) == 0))) {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			log.V(0).Info("bind conflicts with an earlier bind", "bind", bind)
+			conflicts = append(conflicts, bind)
+			continue
+		}
+		seen = append(seen, listener{host: host, port: port})
+	}
+
+	return conflicts
+}
+
+// shouldBindIPv6 returns true if the frontends should also bind IPv6
+// addresses, given the value of ROUTER_IP_V4_V6_MODE. Only the exact
+// values "v6" and "v4v6" enable IPv6 binds; an unset value means the
+// default "v4" mode, and any other value is rejected so that an IPv4-only
+// cluster never gets binds it can not satisfy.
+func shouldBindIPv6(env string) bool {
+	switch env {
+	case "v6", "v4v6":
+		return true
+	case "", "v4":
+		return false
+	}
+
+	log.V(0).Info("invalid ROUTER_IP_V4_V6_MODE value, not binding IPv6 addresses", "value", env)
+	return false
+}
+
+// statsAuthConfig returns the stats realm and stats auth directives
+// protecting the stats page with the given plaintext credentials, as
+// expected by stats auth, or nil if the stats credentials are not
+// configured or not valid. The user must not contain white space or a
+// colon as it is separated from the password by a colon, and neither may
+// contain white space or control characters, which would split the
+// directive or inject further ones. The password is never logged.
+func statsAuthConfig(user, password string) []string {
+	if len(user) == 0 || len(password) == 0 {
+		return nil
+	}
+	if strings.Contains(user, ":") || strings.IndexFunc(user, isSpaceOrControl) >= 0 {
+		log.V(0).Info("invalid stats user, not enabling stats authentication", "user", strconv.Quote(user))
+		return nil
+	}
+	if strings.IndexFunc(password, isSpaceOrControl) >= 0 {
+		log.V(0).Info("invalid stats password, not enabling stats authentication", "user", user)
+		return nil
+	}
+
+	return []string{
+		`stats realm Haproxy\ Statistics`,
+		fmt.Sprintf("stats auth %s:%s", user, password),
+	}
+}
+
+// isSpaceOrControl returns true if r is a white space or control character.
+func isSpaceOrControl(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+// statsAllowlistACL returns the rule restricting the stats page to the
+// sources in value, a white space separated list of IPs and CIDRs, or the
+// empty string if value is empty and the stats page is not restricted.
+// Unlike parseIPList, any invalid entry makes the whole list invalid, in
+// which case all requests are denied so that a typo does not expose the
+// stats page.
+func statsAllowlistACL(value string) string {
+	sources := strings.Fields(value)
+	if len(sources) == 0 {
+		return ""
+	}
+
+	for _, source := range sources {
+		if net.ParseIP(source) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(source); err != nil {
+			log.V(0).Info("invalid stats allowlist entry, denying all requests to the stats page", "entry", source)
+			return "http-request deny"
+		}
+	}
+
+	return fmt.Sprintf("http-request deny unless { src %s }", strings.Join(sources, " "))
+}
+
+// globalMaxConnRate returns the maxconnrate of the global section from env,
+// the value of the ROUTER_MAX_CONN_RATE override, or def if the override is
+// unset or not a positive integer.
+func globalMaxConnRate(env string, def int) int {
+	if len(env) == 0 {
+		return def
+	}
+
+	rate, err := strconv.Atoi(env)
+	if err != nil || rate < 1 {
+		log.V(0).Info("invalid maxconnrate override, using default", "value", env, "default", def)
+		return def
+	}
+	return rate
+}
+
+const (
+	// http3Annotation opts an edge or reencrypt route into HTTP/3.
+	http3Annotation = "haproxy.router.openshift.io/http3"
+)
+
+// http3Eligible returns true if HTTP/3 (QUIC) can be offered for a route:
+// the route terminates TLS at the router, HTTP/2 is enabled, as HTTP/3
+// clients are discovered through it, and the route opts in with the http3
+// annotation. Whether the haproxy build supports QUIC is left to the
+// template.
+func http3Eligible(cfg ServiceAliasConfig, td templateData) bool {
+	switch effectiveTLSMode(cfg) {
+	case routev1.TLSTerminationEdge, routev1.TLSTerminationReencrypt:
+	default:
+		return false
+	}
+
+	if td.DisableHTTP2 || !isTrue(cfg.Annotations[http3Annotation]) {
+		return false
+	}
+	return true
+}
+
+// altSvcMaxAge is the number of seconds clients may remember that HTTP/3
+// is available.
+const altSvcMaxAge = 86400
+
+// altSvcHeader returns the directive advertising HTTP/3 on the given udp
+// port through the Alt-Svc response header, for routes that are
+// http3Eligible, or the empty string if the port is not valid.
+func altSvcHeader(port int) string {
+	if port < 1 || port > 65535 {
+		log.V(0).Info("invalid HTTP/3 port, not advertising HTTP/3", "port", port)
+		return ""
+	}
+	return fmt.Sprintf(`http-response set-header Alt-Svc "h3=\":%d\"; ma=%d"`, port, altSvcMaxAge)
+}
+
+const (
+	// dscpAnnotation sets the DSCP value (0-63) of the packets sent to the
+	// clients of a route.
+	dscpAnnotation = "haproxy.router.openshift.io/dscp"
+)
+
+// dscpMarking returns the directive marking the response packets of a
+// route with the DSCP value of its dscp annotation, or the empty string if
+// the annotation is unset or not a valid DSCP value. The DSCP value makes
+// up the upper six bits of the TOS field.
+func dscpMarking(cfg ServiceAliasConfig) string {
+	value, ok := cfg.Annotations[dscpAnnotation]
+	if !ok {
+		return ""
+	}
+
+	dscp, err := strconv.Atoi(value)
+	if err != nil || dscp < 0 || dscp > 63 {
+		log.V(0).Info("invalid dscp value, not marking packets", "namespace", cfg.Namespace, "name", cfg.Name, "value", value)
+		return ""
+	}
+	return fmt.Sprintf("http-request set-tos %d", dscp<<2)
+}
+
+// backendFingerprint returns a fingerprint of the parts of a route that
+// determine its backend: the services and their weights, the backend type,
+// the preferred port, the annotations, the path (used by rewrite-target),
+// the routing key (used for the cookie), the insecure edge termination
+// policy (which sets the secure flag of the cookie), the custom request and
+// response headers and, for reencrypt routes, the destination CA
+// certificate, the per-route file it is written to and hostname
+// verification. Routes with the same backend fingerprint get identical
+// backends, whatever their host.
+func backendFingerprint(cfg ServiceAliasConfig) string {
+	backend := struct {
+		Type                          string
+		ServiceUnits                  map[ServiceUnitKey]int32
+		PreferPort                    string
+		Annotations                   map[string]string
+		Path                          string
+		RoutingKeyName                string
+		InsecureEdgeTerminationPolicy routev1.InsecureEdgeTerminationPolicyType
+		HTTPRequestHeaders            []HTTPHeader
+		HTTPResponseHeaders           []HTTPHeader
+		DestinationCA                 string
+		DestinationCAFile             string
+		VerifyServiceHostname         bool
+	}{
+		Type:                          templateutil.GenerateBackendNamePrefix(cfg.TLSTermination),
+		ServiceUnits:                  cfg.ServiceUnits,
+		PreferPort:                    cfg.PreferPort,
+		Annotations:                   cfg.Annotations,
+		Path:                          cfg.Path,
+		RoutingKeyName:                cfg.RoutingKeyName,
+		InsecureEdgeTerminationPolicy: cfg.InsecureEdgeTerminationPolicy,
+		HTTPRequestHeaders:            cfg.HTTPRequestHeaders,
+		HTTPResponseHeaders:           cfg.HTTPResponseHeaders,
+	}
+	if cfg.TLSTermination == routev1.TLSTerminationReencrypt {
+		if destCert, ok := cfg.Certificates[cfg.Host+destCertPostfix]; ok && len(destCert.Contents) > 0 {
+			backend.DestinationCA = destCert.Contents
+			backend.DestinationCAFile = destCert.ID
+		}
+		backend.VerifyServiceHostname = cfg.VerifyServiceHostname
+	}
+	return fingerprintHash(backend)
+}
+
+// consolidateBackends groups the routes in the template data by their
+// backend fingerprint (see backendFingerprint), so that routes with
+// identical backends can share a single backend referenced by each of
+// their use_backend rules. The keys of each group are sorted.
+func consolidateBackends(td templateData) map[string][]ServiceAliasConfigKey {
+	groups := make(map[string][]ServiceAliasConfigKey)
+	for k, cfg := range td.State {
+		fingerprint := backendFingerprint(cfg)
+		groups[fingerprint] = append(groups[fingerprint], k)
+	}
+
+	for fingerprint, keys := range groups {
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		if len(keys) > 1 {
+			log.V(4).Info("routes share a backend", "fingerprint", fingerprint, "routes", keys)
+		}
+	}
+	return groups
+}
+
+// sharedBackendName returns the name of the backend shared by the routes
+// consolidated under the given backend fingerprint (see
+// consolidateBackends). The name is derived from a hash of the
+// fingerprint, so it is stable across reloads and distinct fingerprints
+// get distinct names.
+func sharedBackendName(fingerprint string) string {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return "be_shared:" + hex.EncodeToString(sum[:16])
+}
+
+const (
+	// disableForwardedHeadersAnnotation disables the injection of the
+	// Forwarded and X-Forwarded-* headers into the requests of a route.
+	disableForwardedHeadersAnnotation = "haproxy.router.openshift.io/disable-forwarded-headers"
+)
+
+// disableForwardedHeaders returns true if no Forwarded or X-Forwarded-*
+// headers should be added to the requests of a route, for backends that
+// reject unexpected forwarding headers.
+func disableForwardedHeaders(cfg ServiceAliasConfig) bool {
+	return isTrue(cfg.Annotations[disableForwardedHeadersAnnotation])
+}
+
+const (
+	// stripPrefixAnnotation sets a path prefix that is removed from the
+	// requests of a route before they are forwarded to its backend.
+	stripPrefixAnnotation = "haproxy.router.openshift.io/strip-prefix"
+)
+
+// stripPrefixPattern matches the path prefixes accepted by stripPathPrefix:
+// one or more segments of unreserved characters, with an optional trailing
+// slash.
+var stripPrefixPattern = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+/?$`)
+
+// stripPathPrefix returns the directive removing the path prefix in the
+// strip-prefix annotation of a route from its requests, e.g. /api/v1 ->
+// /v1 for the prefix /api, or the empty string if the annotation is unset
+// or not a valid prefix. Prefixes containing ".." segments are rejected so
+// that the stripped path can not escape the intended backend path.
+func stripPathPrefix(cfg ServiceAliasConfig) string {
+	prefix, ok := cfg.Annotations[stripPrefixAnnotation]
+	if !ok {
+		return ""
+	}
+
+	if !stripPrefixPattern.MatchString(prefix) || !rewriteTargetSafe(prefix) {
+		log.V(0).Info("invalid strip prefix, not stripping the path", "namespace", cfg.Namespace, "name", cfg.Name, "prefix", prefix)
+		return ""
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	return fmt.Sprintf(`http-request replace-path ^%s(/|$)(.*)$ '/\2'`, regexp.QuoteMeta(prefix))
+}
+
+// endpointFilterStages are the stages of the endpoint filtering pipeline,
+// in the order they are applied by effectiveEndpoints.
+var endpointFilterStages = []struct {
+	name   string
+	filter func(alias ServiceAliasConfig, endpoints []Endpoint) []Endpoint
+}{
+	{"preferPort", func(alias ServiceAliasConfig, endpoints []Endpoint) []Endpoint {
+		return endpointsForAlias(alias, ServiceUnit{EndpointTable: endpoints})
+	}},
+	{"routable", func(alias ServiceAliasConfig, endpoints []Endpoint) []Endpoint {
+		routable := make([]Endpoint, 0, len(endpoints))
+		for _, ep := range endpoints {
+			if isRoutableEndpoint(ep) {
+				routable = append(routable, ep)
+			}
+		}
+		return routable
+	}},
+	{"dedupe", func(alias ServiceAliasConfig, endpoints []Endpoint) []Endpoint {
+		return dedupeEndpoints(endpoints)
+	}},
+}
+
+// effectiveEndpoints returns the endpoints of a service that a route should
+// be served by. It is the single place the endpoint filters are composed,
+// in this order: the endpoints not matching the route's PreferPort are
+// dropped (endpointsForAlias), then the endpoints that are not routable
+// (isRoutableEndpoint), then duplicate addresses (dedupeEndpoints).
+// Readiness needs no filter here: addresses that are not ready are kept out
+// of the service's EndpointTable when the endpoints are converted.
+func effectiveEndpoints(alias ServiceAliasConfig, svc ServiceUnit) []Endpoint {
+	endpoints := svc.EndpointTable
+	for _, stage := range endpointFilterStages {
+		endpoints = stage.filter(alias, endpoints)
+	}
+
+	if len(endpoints) == 0 && len(svc.EndpointTable) > 0 {
+		log.V(0).Info("no endpoints left for route after filtering", "namespace", alias.Namespace, "name", alias.Name, "service", svc.Name, "preferPort", alias.PreferPort)
+	}
+	return endpoints
+}
+
+// describeEndpointFiltering returns a trace of the endpoint filtering
+// pipeline of effectiveEndpoints for a route and service: the number of
+// endpoints in the service's table followed by the number of endpoints
+// each stage kept and dropped, with the ids of the dropped endpoints, to
+// help diagnose why an endpoint is not served.
+func describeEndpointFiltering(alias ServiceAliasConfig, svc ServiceUnit) []string {
+	endpoints := svc.EndpointTable
+	trace := []string{fmt.Sprintf("table: %d endpoints", len(endpoints))}
+	for _, stage := range endpointFilterStages {
+		kept := stage.filter(alias, endpoints)
+
+		remaining := make(map[Endpoint]int, len(kept))
+		for _, ep := range kept {
+			remaining[ep]++
+		}
+		var dropped []string
+		for _, ep := range endpoints {
+			if remaining[ep] > 0 {
+				remaining[ep]--
+				continue
+			}
+			dropped = append(dropped, ep.ID)
+		}
+
+		line := fmt.Sprintf("%s: kept %d, dropped %d", stage.name, len(kept), len(dropped))
+		if len(dropped) > 0 {
+			line += fmt.Sprintf(" (%s)", strings.Join(dropped, ", "))
+		}
+		trace = append(trace, line)
+		endpoints = kept
+	}
+	return trace
+}
+
+// generationClock returns the time used by generationComment. It can be
+// replaced with a fixed clock for testing.
+var generationClock = time.Now
+
+// generationComment returns a comment recording when the configuration
+// with the given checksum was generated if it differs from the checksum
+// of the previous configuration, or the empty string if the configuration
+// did not change, so that re-rendering an unchanged configuration does not
+// produce a diff.
+func generationComment(configChecksum string, prevChecksum string) string {
+	if configChecksum == prevChecksum {
+		return ""
+	}
+	return fmt.Sprintf("# Generated at %s (checksum %s)", generationClock().UTC().Format(time.RFC3339), configChecksum)
+}
+
+// referencedMapsExist returns the map files in referenced that are not in
+// generated, in the order they are first referenced, so that a template
+// referring to a map file that is never written is caught before haproxy
+// fails to load the configuration. Map file paths are compared in their
+// cleaned form.
+func referencedMapsExist(referenced []string, generated []string) []string {
+	exists := make(map[string]bool, len(generated))
+	for _, name := range generated {
+		exists[path.Clean(name)] = true
+	}
+
+	var missing []string
+	for _, name := range referenced {
+		cleaned := path.Clean(name)
+		if exists[cleaned] {
+			continue
+		}
+		log.V(0).Info("referenced map file is not generated", "map", name)
+		missing = append(missing, name)
+		exists[cleaned] = true
+	}
+	return missing
+}
+
+// l4RateLimitTrack returns the rule tracking the connections of a
+// passthrough route's clients in the stick table named table, for the
+// rate-limit-connections concurrent-tcp and rate-tcp limits, or the empty
+// string if the route is not a passthrough route or has no tcp rate limit.
+// The sc1 counter is used so that the tracking does not clash with the sc2
+// counter tracked by the backend's own stick table. An empty table tracks
+// in the stick table of the current proxy.
+func l4RateLimitTrack(cfg ServiceAliasConfig, table string) string {
+	if cfg.TLSTermination != routev1.TLSTerminationPassthrough || !isTrue(cfg.Annotations[rateLimitAnnotation]) {
+		return ""
+	}
+	if !isInteger(cfg.Annotations[rateLimitAnnotation+".concurrent-tcp"]) && !isInteger(cfg.Annotations[rateLimitAnnotation+".rate-tcp"]) {
+		return ""
+	}
+
+	if len(table) == 0 {
+		return "tcp-request content track-sc1 src"
+	}
+	return fmt.Sprintf("tcp-request content track-sc1 src table %s", table)
+}
+
+// reloadWarmupMaxConn returns the maxconn to use while a freshly reloaded
+// haproxy warms up: warmupFraction percent of baseMaxConn, but at least 1.
+// A warmupFraction outside of 1-100 is ignored and baseMaxConn is returned
+// unchanged, as is a baseMaxConn that is not positive.
+func reloadWarmupMaxConn(baseMaxConn int, warmupFraction int) int {
+	if warmupFraction < 1 || warmupFraction > 100 {
+		log.V(0).Info("invalid reload warmup fraction, not limiting connections", "fraction", warmupFraction)
+		return baseMaxConn
+	}
+	if baseMaxConn < 1 {
+		return baseMaxConn
+	}
+
+	if maxConn := baseMaxConn * warmupFraction / 100; maxConn > 0 {
+		return maxConn
+	}
+	return 1
+}
+
+// chainIsComplete returns true if the certificate bundle in contents
+// carries the chain of its leaf certificate, the first certificate in the
+// bundle: either the leaf is self-signed or the bundle contains the
+// certificate that issued it. Blocks other than certificates, like the
+// private key, are ignored. An error is returned if the bundle contains no
+// certificate or a certificate can not be parsed.
+func chainIsComplete(contents string) (bool, error) {
+	var certs []*x509.Certificate
+	data := []byte(contents)
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		data = rest
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return false, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return false, fmt.Errorf("no certificate found")
+	}
+
+	leaf := certs[0]
+	if bytes.Equal(leaf.RawIssuer, leaf.RawSubject) && leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil {
+		return true, nil
+	}
+	for _, issuer := range certs[1:] {
+		if bytes.Equal(leaf.RawIssuer, issuer.RawSubject) && leaf.CheckSignatureFrom(issuer) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// routeChainIsComplete returns true if the certificate of a route carries
+// its chain, checking the route certificate together with the CA
+// certificate of the route, which is where routes usually supply their
+// intermediates and which the certificate manager appends to the route
+// certificate when writing it out. See chainIsComplete.
+func routeChainIsComplete(cfg ServiceAliasConfig) (bool, error) {
+	contents := cfg.Certificates[generateCertKey(&cfg)].Contents
+	if ca, ok := cfg.Certificates[generateCACertKey(&cfg)]; ok && len(ca.Contents) > 0 {
+		contents = contents + "\n" + ca.Contents
+	}
+	return chainIsComplete(contents)
+}
+
+// sniNamesForCert returns the server names that should be mapped to a
+// route's certificate: the route host followed by the other DNS subject
+// alternative names of the leaf certificate, lowercased, deduplicated and
+// sorted, so that a certificate covering several host names serves all of
+// them. Wildcard names are kept as wildcards, as a crt-list sni filter,
+// but only a wildcard for a whole leftmost label is valid; other names
+// with a wildcard are dropped. If the certificate can not be parsed, only
+// the route host is returned.
+func sniNamesForCert(cert Certificate, routeHost string) []string {
+	routeHost = strings.ToLower(routeHost)
+	names := []string{routeHost}
+
+	var block *pem.Block
+	for data := []byte(cert.Contents); ; {
+		block, data = pem.Decode(data)
+		if block == nil {
+			return names
+		}
+		if block.Type == "CERTIFICATE" {
+			break
+		}
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.V(0).Info("unable to parse certificate, serving route host only", "id", cert.ID, "error", err.Error())
+		return names
+	}
+
+	seen := map[string]bool{routeHost: true}
+	var additional []string
+	for _, name := range leaf.DNSNames {
+		name = strings.ToLower(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+			log.V(0).Info("ignoring invalid wildcard subject alternative name", "id", cert.ID, "name", name)
+			continue
+		}
+		additional = append(additional, name)
+	}
+	sort.Strings(additional)
+
+	return append(names, additional...)
+}
+
+var helperFunctions = template.FuncMap{
+	"endpointsForAlias":        endpointsForAlias,        //returns the list of valid endpoints
+	"processEndpointsForAlias": processEndpointsForAlias, //returns the list of valid endpoints after processing them
+	"env":                      env,                      //tries to get an environment variable, returns the first non-empty default value or "" on failure
+	"matchPattern":             matchPattern,             //anchors provided regular expression and evaluates against given string
+	"isInteger":                isInteger,                //determines if a given variable is an integer
+	"matchValues":              matchValues,              //compares a given string to a list of allowed strings
+
+	"genSubdomainWildcardRegexp": genSubdomainWildcardRegexp,             //generates a regular expression matching the subdomain for hosts (and paths) with a wildcard policy
+	"generateRouteRegexp":        generateRouteRegexp,                    //generates a regular expression matching the route hosts (and paths)
+	"genCertificateHostName":     genCertificateHostName,                 //generates host name to use for serving/matching certificates
+	"genBackendNamePrefix":       templateutil.GenerateBackendNamePrefix, //generates the prefix for the backend name
+
+	"isTrue":     isTrue,     //determines if a given variable is a true value
+	"firstMatch": firstMatch, //anchors provided regular expression and evaluates against given strings, returns the first matched string or ""
+
+	"getHTTPAliasesGroupedByHost": getHTTPAliasesGroupedByHost, //returns HTTP(S) aliases grouped by their host
+	"getPrimaryAliasKey":          getPrimaryAliasKey,          //returns the key of the primary alias for a group of aliases
+
+	"generateHAProxyMap":           generateHAProxyMap,           //generates a haproxy map content
+	"validateHAProxyAllowlist":     validateHAProxyAllowlist,     //validates a haproxy allowlist (acl) content
+	"generateHAProxyAllowlistFile": generateHAProxyAllowlistFile, //generates a haproxy allowlist file for use in an acl
+
+	"clipHAProxyTimeoutValue": clipHAProxyTimeoutValue, //clips extrodinarily high timeout values to be below the maximum allowed timeout value
+	"parseIPList":             parseIPList,             //parses the list of IPs/CIDRs (IPv4/IPv6)
+
+	"indent":                          indent,                          //indents a multiline string with specified number of spaces
+	"processRewriteTarget":            rewritetarget.SanitizeInput,     //sanitizes `haproxy.router.openshift.io/rewrite-target` annotation
+	"preserveHostHeader":              preserveHostHeader,              //returns the Host header rewrite directive for a route honoring the preserve-host annotation
+	"forwardedProto":                  forwardedProto,                  //returns the X-Forwarded-Proto header value for a route
+	"forwardedPort":                   forwardedPort,                   //returns the X-Forwarded-Port header value for a route
+	"isUnmatchableRoute":              isUnmatchableRoute,              //determines if a route has neither a host nor a path to match on
+	"orderAllAliases":                 orderAllAliases,                 //returns the keys of all aliases in acl evaluation order
+	"sniInspectDelay":                 sniInspectDelay,                 //returns the tcp-request inspect-delay value for a passthrough route
+	"featureEnabled":                  featureEnabled,                  //returns the boolean value of an environment variable, or a default if unset or ambiguous
+	"tcpCheckExpr":                    tcpCheckExpr,                    //returns the tcp health check directives for a passthrough route
+	"retryAfterHeader":                retryAfterHeader,                //returns the Retry-After header directive for rate limited responses
+	"h2MaxConcurrentStreams":          h2MaxConcurrentStreams,          //returns the maximum number of concurrent http/2 streams for a route
+	"annotationWithinSize":            annotationWithinSize,            //determines if an annotation value fits within a maximum size
+	"backendIndex":                    backendIndex,                    //returns a small index for a route, unique within the current state
+	"setVarDirective":                 setVarDirective,                 //returns a http-request set-var directive storing an expression in a transaction variable
+	"geoRoutingEnabled":               geoRoutingEnabled,               //determines if GeoIP lookups are enabled for a route
+	"geoCountryVarDirective":          geoCountryVarDirective,          //returns the directive storing the client country from a GeoIP map
+	"waitForBody":                     waitForBody,                     //returns the http-request wait-for-body directive for a route
+	"proxyProtocolBySubset":           proxyProtocolBySubset,           //returns the PROXY protocol server option for each backend subset of a route
+	"effectiveBalance":                effectiveBalance,                //returns the load balancing algorithm for a route considering session affinity
+	"clientCertHeader":                clientCertHeader,                //returns the directive forwarding the client certificate subject to the backend
+	"allowedIssuerACL":                allowedIssuerACL,                //returns the acl denying client certificates from issuers that are not allowed
+	"needsHTTPSRedirect":              needsHTTPSRedirect,              //determines if insecure requests for a route need to be redirected to https
+	"httpsRedirectRule":               httpsRedirectRule,               //returns the frontend rule redirecting insecure requests for a route host to https
+	"dedupeEndpoints":                 dedupeEndpoints,                 //returns the endpoints with duplicate IP:port pairs removed
+	"cookiePath":                      cookiePath,                      //returns the Path attribute for a route affinity cookie
+	"cookieAttributes":                cookieAttributes,                //returns the Secure and SameSite options for a route affinity cookie
+	"endpointWeight":                  endpointWeight,                  //returns the clamped weight of an endpoint
+	"backupServerCount":               backupServerCount,               //returns the number of backup servers to emit for a route
+	"logFormatDirective":              logFormatDirective,              //returns the httplog or tcplog option for a route
+	"frontendIdleTimeout":             frontendIdleTimeout,             //returns the frontend idle timeout accommodating the largest route keep-alive timeout
+	"dhParam":                         dhParam,                         //returns the tune.ssl.default-dh-param size for a security profile
+	"httpCheckExpect":                 httpCheckExpect,                 //returns the http-check expect directive for a route
+	"abortOnClose":                    abortOnClose,                    //determines if option abortonclose should be emitted for a route
+	"securityHeaders":                 securityHeaders,                 //returns the directives setting the standard security response headers for a route
+	"connectionMode":                  connectionMode,                  //returns the option directive for the HTTP connection mode of a route
+	"cacheControlHint":                cacheControlHint,                //returns the directive setting the Cache-Control header from the caching hints of a route
+	"uniqueIDFormat":                  uniqueIDFormat,                  //returns the validated unique-id-format of a route
+	"uniqueIDDirectives":              uniqueIDDirectives,              //returns the directives generating and forwarding the unique request ID of a route
+	"tracePropagationHeaders":         tracePropagationHeaders,         //returns the directive injecting a span ID for a route with tracing enabled
+	"detectRateLimitAllowlistOverlap": detectRateLimitAllowlistOverlap, //determines if the rate limits of a route apply to its allowlisted sources
+	"rateLimitExemptACL":              rateLimitExemptACL,              //returns the acl exempting the allowlisted sources of a route from rate limiting
+	"distinctCertCount":               distinctCertCount,               //returns the number of distinct certificates served by the router
+	"sslCacheSize":                    sslCacheSize,                    //returns the tune.ssl.cachesize scaled to the certificate and connection counts
+	"useLegacyRegexp":                 useLegacyRegexp,                 //determines if a route opts into the legacy route regexp generation
+	"serverID":                        serverID,                        //returns the stable haproxy server id of an endpoint from its backend slot
+	"allowlistSourceExpr":             allowlistSourceExpr,             //returns the sample fetch providing the client IP for the allowlist of a route
+	"xffClientIPExpr":                 xffClientIPExpr,                 //returns the sample fetch extracting the client IP at a depth of the X-Forwarded-For chain
+	"allowlistOrDenyAll":              allowlistOrDenyAll,              //returns the allowlist acl for an allowlist file, denying all sources if the file is missing
+	"accessDecisionACLs":              accessDecisionACLs,              //returns the acls and reject rules combining the allowlist and blocklist of a route
+	"finTimeouts":                     finTimeouts,                     //returns the timeout client-fin and server-fin directives of a route
+	"recommendedBufsize":              recommendedBufsize,              //returns the tune.bufsize accommodating the largest route header buffer size
+	"normalizeURIDirectives":          normalizeURIDirectives,          //returns the http-request normalize-uri directives of a route
+	"verifyHost":                      verifyHost,                      //returns the verifyhost server option of a reencrypt route
+	"renderFrontend":                  renderFrontend,                  //returns the frontend sections of the router configuration for the routes
+	"isRoutableEndpoint":              isRoutableEndpoint,              //returns false for loopback and link-local endpoints
+	"matchesDefaultWildcard":          matchesDefaultWildcard,          //returns true if a host shadows the router's default wildcard
+	"keepAliveTimeout":                keepAliveTimeout,                //returns the clipped http-keep-alive timeout of a route
+	"tcpBlocklistReject":              tcpBlocklistReject,              //rejects blocklisted sources at the tcp layer
+	"allowlistACL":                    allowlistACL,                    //returns the allowlist acl and reject rule at the layer matching the route
+	"shouldBindIPv6":                  shouldBindIPv6,                  //returns true if the ip mode enables IPv6 binds
+	"statsAuthConfig":                 statsAuthConfig,                 //returns the stats authentication directives
+	"statsAllowlistACL":               statsAllowlistACL,               //restricts the stats page to an allowlist
+	"globalMaxConnRate":               globalMaxConnRate,               //returns the validated global maxconnrate
+	"http3Eligible":                   http3Eligible,                   //returns true if HTTP/3 can be offered for a route
+	"altSvcHeader":                    altSvcHeader,                    //advertises HTTP/3 on a udp port
+	"dscpMarking":                     dscpMarking,                     //returns the tos marking of a route
+	"sharedBackendName":               sharedBackendName,               //returns the backend name shared by consolidated routes
+	"disableForwardedHeaders":         disableForwardedHeaders,         //returns true if forwarding headers are disabled for a route
+	"stripPathPrefix":                 stripPathPrefix,                 //returns the directive stripping the path prefix of a route
+	"effectiveEndpoints":              effectiveEndpoints,              //returns the filtered endpoints a route is served by
+	"generationComment":               generationComment,               //returns a generation timestamp comment when the configuration changed
+	"l4RateLimitTrack":                l4RateLimitTrack,                //returns the track-sc1 rule for rate limited passthrough routes
+	"sniNamesForCert":                 sniNamesForCert,                 //returns the server names a route certificate should serve
+}
+
+// HelperFunctionNames returns the sorted names of the helper functions
+// available to router templates.
+func HelperFunctionNames() []string {
+	names := make([]string, 0, len(helperFunctions))
+	for name := range helperFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateTemplate parses the router template source with the helper
+// functions and returns any parse error, such as a syntax error or a
+// reference to an unknown helper function.
+func ValidateTemplate(src string) error {
+	_, err := template.New("config").Funcs(helperFunctions).Parse(src)
+	return err
+}
+
+// RenderDryRun executes the router template source against the given
+// template data and returns the rendered configuration. Helper functions
+// that write files are replaced with stubs returning the file name they
+// would write, so a dry run never touches the disk.
+func RenderDryRun(src string, td templateData) (string, error) {
+	funcs := make(template.FuncMap, len(helperFunctions))
+	for name, fn := range helperFunctions {
+		funcs[name] = fn
+	}
+	funcs["generateHAProxyAllowlistFile"] = func(workingDir string, id ServiceAliasConfigKey, value string) string {
+		return path.Join(workingDir, allowlistDir, fmt.Sprintf("%s.txt", id))
+	}
+
+	tmpl, err := template.New("config").Funcs(funcs).Parse(src)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, td); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// HelperSetVersion returns a hash of the names of the helper functions
+// available to router templates, which changes whenever a helper function
+// is added or removed.
+func HelperSetVersion() string {
+	return helperSetVersion(HelperFunctionNames())
+}
+
+// helperSetVersion returns a hash of the sorted helper function names.
+func helperSetVersion(names []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(names, "\n")))
+	return hex.EncodeToString(sum[:])
+}
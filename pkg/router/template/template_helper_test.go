@@ -1,18 +1,29 @@
 package templaterouter
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/md5"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"math/rand"
 	"os"
 	"path"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	routev1 "github.com/openshift/api/route/v1"
 	templateutil "github.com/openshift/router/pkg/router/template/util"
+	haproxyutil "github.com/openshift/router/pkg/router/template/util/haproxy"
 )
 
 func buildServiceAliasConfig(name, namespace, host, path string, termination routev1.TLSTerminationType, policy routev1.InsecureEdgeTerminationPolicyType, wildcard bool) ServiceAliasConfig {
@@ -410,18 +421,18 @@ func TestGenerateHAProxyCertConfigMap(t *testing.T) {
 	}
 
 	expectedOrder := []string{
+		"/path/to/router/certs/devel2:foo-wildcard-route.pem",
 		"/path/to/router/certs/zzz:zed-route.pem",
-		"/path/to/router/certs/test:api-route.pem",
 		"/path/to/router/certs/stg:api-route.pem",
-		"/path/to/router/certs/prod:wildcard-route.pem",
 		"/path/to/router/certs/prod:backend-route.pem",
 		"/path/to/router/certs/prod:api-route.pem",
 		"/path/to/router/certs/prod:api-path-route.pem",
-		"/path/to/router/certs/devel2:foo-wildcard-test.pem",
-		"/path/to/router/certs/devel2:foo-wildcard-route.pem",
 		"/path/to/router/certs/dev:reencrypt-route.pem",
 		"/path/to/router/certs/dev:api-route.pem",
 		"/path/to/router/certs/dev:admin-route.pem",
+		"/path/to/router/certs/prod:wildcard-route.pem",
+		"/path/to/router/certs/devel2:foo-wildcard-test.pem",
+		"/path/to/router/certs/test:api-route.pem",
 	}
 
 	lines := generateHAProxyCertConfigMap(td)
@@ -526,18 +537,18 @@ func TestGenerateHAProxyMap(t *testing.T) {
 	}
 
 	certBackendOrder := []string{
+		"/path/to/router/certs/devel2:foo-wildcard-route.pem",
 		"/path/to/router/certs/zzz:zed-route.pem",
-		"/path/to/router/certs/test:api-route.pem",
 		"/path/to/router/certs/stg:api-route.pem",
-		"/path/to/router/certs/prod:wildcard-route.pem",
 		"/path/to/router/certs/prod:backend-route.pem",
 		"/path/to/router/certs/prod:api-route.pem",
 		"/path/to/router/certs/prod:api-path-route.pem",
-		"/path/to/router/certs/devel2:foo-wildcard-test.pem",
-		"/path/to/router/certs/devel2:foo-wildcard-route.pem",
 		"/path/to/router/certs/dev:reencrypt-route.pem",
 		"/path/to/router/certs/dev:api-route.pem",
 		"/path/to/router/certs/dev:admin-route.pem",
+		"/path/to/router/certs/prod:wildcard-route.pem",
+		"/path/to/router/certs/devel2:foo-wildcard-test.pem",
+		"/path/to/router/certs/test:api-route.pem",
 	}
 
 	for _, tc := range []struct {
@@ -1165,3 +1176,6247 @@ func TestIndent(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodePath(t *testing.T) {
+	testCases := []struct {
+		name            string
+		path            string
+		expectedPath    string
+		expectedChanged bool
+	}{
+		{
+			name:            "encoded path",
+			path:            "/foo%20bar/%7Euser",
+			expectedPath:    "/foo bar/~user",
+			expectedChanged: true,
+		},
+		{
+			name:            "encoded slash",
+			path:            "/a%2Fb",
+			expectedPath:    "/a/b",
+			expectedChanged: true,
+		},
+		{
+			name:            "already decoded path",
+			path:            "/foo/bar",
+			expectedPath:    "/foo/bar",
+			expectedChanged: false,
+		},
+		{
+			name:            "empty path",
+			path:            "",
+			expectedPath:    "",
+			expectedChanged: false,
+		},
+		{
+			name:            "invalid encoding",
+			path:            "/foo%zzbar",
+			expectedPath:    "/foo%zzbar",
+			expectedChanged: false,
+		},
+		{
+			name:            "truncated encoding",
+			path:            "/foo%2",
+			expectedPath:    "/foo%2",
+			expectedChanged: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path, changed := decodePath(tc.path)
+			if path != tc.expectedPath {
+				t.Errorf("Expected path %q, got %q", tc.expectedPath, path)
+			}
+			if changed != tc.expectedChanged {
+				t.Errorf("Expected changed to be %v, got %v", tc.expectedChanged, changed)
+			}
+		})
+	}
+}
+
+func TestPreserveHostHeader(t *testing.T) {
+	testCases := []struct {
+		name        string
+		host        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "preserve on",
+			host:        "www.example.com",
+			annotations: map[string]string{preserveHostAnnotation: "true"},
+			expected:    "http-request set-header Host www.example.com",
+		},
+		{
+			name:        "preserve on with mixed case host",
+			host:        "WWW.Example.com",
+			annotations: map[string]string{preserveHostAnnotation: "true"},
+			expected:    "http-request set-header Host www.example.com",
+		},
+		{
+			name:        "preserve on with unsafe host",
+			host:        "www.example.com\nhttp-request deny",
+			annotations: map[string]string{preserveHostAnnotation: "true"},
+			expected:    "",
+		},
+		{
+			name:        "preserve off",
+			host:        "www.example.com",
+			annotations: map[string]string{preserveHostAnnotation: "false"},
+			expected:    "",
+		},
+		{
+			name:     "default",
+			host:     "www.example.com",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{
+				Host:           tc.host,
+				TLSTermination: routev1.TLSTerminationReencrypt,
+				Annotations:    tc.annotations,
+			}
+			if got := preserveHostHeader(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	testCases := []struct {
+		name        string
+		termination routev1.TLSTerminationType
+		expected    string
+	}{
+		{
+			name:        "edge",
+			termination: routev1.TLSTerminationEdge,
+			expected:    "https",
+		},
+		{
+			name:        "reencrypt",
+			termination: routev1.TLSTerminationReencrypt,
+			expected:    "https",
+		},
+		{
+			name:        "passthrough",
+			termination: routev1.TLSTerminationPassthrough,
+			expected:    "http",
+		},
+		{
+			name:        "insecure",
+			termination: "",
+			expected:    "http",
+		},
+		{
+			name:        "unknown termination",
+			termination: "bogus",
+			expected:    "http",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{TLSTermination: tc.termination}
+			if got := forwardedProto(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestForwardedPort(t *testing.T) {
+	testCases := []struct {
+		name        string
+		termination routev1.TLSTerminationType
+		httpPort    string
+		httpsPort   string
+		expected    string
+	}{
+		{
+			name:     "configured http port",
+			httpPort: "8080",
+			expected: "8080",
+		},
+		{
+			name:     "default http port",
+			expected: "80",
+		},
+		{
+			name:     "invalid http port",
+			httpPort: "eighty",
+			expected: "80",
+		},
+		{
+			name:     "out of range http port",
+			httpPort: "70000",
+			expected: "80",
+		},
+		{
+			name:        "edge route uses the https port",
+			termination: routev1.TLSTerminationEdge,
+			httpPort:    "8080",
+			expected:    "443",
+		},
+		{
+			name:        "reencrypt route uses the configured https port",
+			termination: routev1.TLSTerminationReencrypt,
+			httpsPort:   "8443",
+			expected:    "8443",
+		},
+		{
+			name:        "invalid https port",
+			termination: routev1.TLSTerminationEdge,
+			httpsPort:   "443a",
+			expected:    "443",
+		},
+		{
+			name:        "passthrough route uses the http port",
+			termination: routev1.TLSTerminationPassthrough,
+			httpPort:    "8080",
+			expected:    "8080",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ROUTER_SERVICE_HTTP_PORT", tc.httpPort)
+			t.Setenv("ROUTER_SERVICE_HTTPS_PORT", tc.httpsPort)
+			cfg := ServiceAliasConfig{TLSTermination: tc.termination}
+			if got := forwardedPort(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestIsUnmatchableRoute(t *testing.T) {
+	testCases := []struct {
+		name     string
+		host     string
+		path     string
+		expected bool
+	}{
+		{
+			name:     "host only",
+			host:     "www.example.com",
+			expected: false,
+		},
+		{
+			name:     "path only",
+			path:     "/api",
+			expected: false,
+		},
+		{
+			name:     "both empty",
+			expected: true,
+		},
+		{
+			name:     "no host and root path",
+			path:     "/",
+			expected: true,
+		},
+		{
+			name:     "both present",
+			host:     "www.example.com",
+			path:     "/api",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Host: tc.host, Path: tc.path}
+			if got := isUnmatchableRoute(cfg); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestOrderAllAliases(t *testing.T) {
+	aliases := map[ServiceAliasConfigKey]ServiceAliasConfig{
+		"ns:wildcard":          {Host: "wild.example.com", IsWildcard: true},
+		"ns:wildcard-path":     {Host: "wild.example.com", Path: "/api", IsWildcard: true},
+		"ns:specific":          {Host: "www.example.com"},
+		"ns:specific-path":     {Host: "www.example.com", Path: "/api"},
+		"ns:specific-deep":     {Host: "www.example.com", Path: "/api/v1/"},
+		"ns:deeper-host":       {Host: "a.www.example.com"},
+		"ns:short-host":        {Host: "example.com"},
+		"ns:another-specific":  {Host: "app.example.com"},
+		"ns:no-host-with-path": {Path: "/health"},
+	}
+
+	expected := []ServiceAliasConfigKey{
+		"ns:deeper-host",
+		"ns:specific-deep",
+		"ns:specific-path",
+		"ns:another-specific",
+		"ns:specific",
+		"ns:wildcard-path",
+		"ns:wildcard",
+		"ns:short-host",
+		"ns:no-host-with-path",
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := orderAllAliases(aliases); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	}
+
+	if got := orderAllAliases(nil); len(got) != 0 {
+		t.Errorf("Expected no keys for empty aliases, got %v", got)
+	}
+}
+
+func TestSNIInspectDelay(t *testing.T) {
+	testCases := []struct {
+		name        string
+		termination routev1.TLSTerminationType
+		annotations map[string]string
+		env         string
+		expected    string
+	}{
+		{
+			name:        "configured delay",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{sniInspectDelayAnnotation: "10s"},
+			expected:    "10s",
+		},
+		{
+			name:        "overflowing delay is clipped",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{sniInspectDelayAnnotation: "9999999999999999d"},
+			expected:    templateutil.HaproxyMaxTimeout,
+		},
+		{
+			name:        "invalid delay uses default",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{sniInspectDelayAnnotation: "soon"},
+			expected:    defaultSNIInspectDelay,
+		},
+		{
+			name:        "default",
+			termination: routev1.TLSTerminationPassthrough,
+			expected:    defaultSNIInspectDelay,
+		},
+		{
+			name:        "default from environment",
+			termination: routev1.TLSTerminationPassthrough,
+			env:         "3s",
+			expected:    "3s",
+		},
+		{
+			name:        "not a passthrough route",
+			termination: routev1.TLSTerminationEdge,
+			annotations: map[string]string{sniInspectDelayAnnotation: "10s"},
+			expected:    "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ROUTER_INSPECT_DELAY", tc.env)
+			cfg := ServiceAliasConfig{
+				TLSTermination: tc.termination,
+				Annotations:    tc.annotations,
+			}
+			if got := sniInspectDelay(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestPassthroughSNIMapEntry(t *testing.T) {
+	testCases := []struct {
+		name          string
+		cfg           ServiceAliasConfig
+		expectedKey   string
+		expectedValue string
+		expectedOK    bool
+	}{
+		{
+			name:          "passthrough route",
+			cfg:           buildServiceAliasConfig("pt-route", "prod", "passthrough.example.com", "", routev1.TLSTerminationPassthrough, routev1.InsecureEdgeTerminationPolicyNone, false),
+			expectedKey:   `^passthrough\.example\.com$`,
+			expectedValue: "be_tcp:prod:pt-route",
+			expectedOK:    true,
+		},
+		{
+			name:          "wildcard passthrough route",
+			cfg:           buildServiceAliasConfig("pt-route", "prod", "passthrough.example.com", "", routev1.TLSTerminationPassthrough, routev1.InsecureEdgeTerminationPolicyNone, true),
+			expectedKey:   `^[^\.]*\.example\.com$`,
+			expectedValue: "be_tcp:prod:pt-route",
+			expectedOK:    true,
+		},
+		{
+			name: "edge route",
+			cfg:  buildServiceAliasConfig("edge-route", "prod", "edge.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, false),
+		},
+		{
+			name: "passthrough route with path",
+			cfg:  buildServiceAliasConfig("pt-route", "prod", "passthrough.example.com", "/path", routev1.TLSTerminationPassthrough, routev1.InsecureEdgeTerminationPolicyNone, false),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, value, ok := passthroughSNIMapEntry(tc.cfg)
+			if ok != tc.expectedOK {
+				t.Fatalf("Expected ok to be %v, got %v", tc.expectedOK, ok)
+			}
+			if key != tc.expectedKey || value != tc.expectedValue {
+				t.Errorf("Expected entry %q %q, got %q %q", tc.expectedKey, tc.expectedValue, key, value)
+			}
+		})
+	}
+}
+
+func TestDetectTerminationCollision(t *testing.T) {
+	testCases := []struct {
+		name              string
+		aliases           map[string]ServiceAliasConfig
+		expectedHost      string
+		expectedCollision bool
+	}{
+		{
+			name: "collision",
+			aliases: map[string]ServiceAliasConfig{
+				"ns:edge":        {Host: "www.example.com", TLSTermination: routev1.TLSTerminationEdge},
+				"ns:passthrough": {Host: "www.example.com", TLSTermination: routev1.TLSTerminationPassthrough},
+			},
+			expectedHost:      "www.example.com",
+			expectedCollision: true,
+		},
+		{
+			name: "collision with insecure route",
+			aliases: map[string]ServiceAliasConfig{
+				"ns:insecure":    {Host: "b.example.com"},
+				"ns:passthrough": {Host: "b.example.com", TLSTermination: routev1.TLSTerminationPassthrough},
+				"ns:other-edge":  {Host: "a.example.com", TLSTermination: routev1.TLSTerminationEdge},
+				"ns:other-pt":    {Host: "a.example.com", TLSTermination: routev1.TLSTerminationPassthrough},
+			},
+			expectedHost:      "a.example.com",
+			expectedCollision: true,
+		},
+		{
+			name: "consistent group",
+			aliases: map[string]ServiceAliasConfig{
+				"ns:edge":      {Host: "www.example.com", TLSTermination: routev1.TLSTerminationEdge},
+				"ns:edge-path": {Host: "www.example.com", Path: "/api", TLSTermination: routev1.TLSTerminationEdge},
+				"ns:reencrypt": {Host: "www.example.com", Path: "/secure", TLSTermination: routev1.TLSTerminationReencrypt},
+				"ns:pt":        {Host: "pt.example.com", TLSTermination: routev1.TLSTerminationPassthrough},
+			},
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			host, collision := detectTerminationCollision(tc.aliases)
+			if collision != tc.expectedCollision {
+				t.Fatalf("Expected collision to be %v, got %v", tc.expectedCollision, collision)
+			}
+			if host != tc.expectedHost {
+				t.Errorf("Expected host %q, got %q", tc.expectedHost, host)
+			}
+		})
+	}
+}
+
+func TestSortCertConfigMapLines(t *testing.T) {
+	testCases := []struct {
+		name     string
+		lines    []string
+		expected []string
+	}{
+		{
+			name: "wildcard does not shadow specific host",
+			lines: []string{
+				"/path/to/router/certs/a:wildcard.pem [alpn h2,http/1.1] *.example.com",
+				"/path/to/router/certs/b:specific.pem [alpn h2,http/1.1] www.example.com",
+			},
+			expected: []string{
+				"/path/to/router/certs/b:specific.pem [alpn h2,http/1.1] www.example.com",
+				"/path/to/router/certs/a:wildcard.pem [alpn h2,http/1.1] *.example.com",
+			},
+		},
+		{
+			name: "shared path prefixes",
+			lines: []string{
+				"/path/to/router/certs/ns:route.pem *.apps.example.com",
+				"/path/to/router/certs/ns:route-a.pem a.apps.example.com",
+				"/path/to/router/certs/ns:route-b.pem b.apps.example.com",
+				"/path/to/router/certs/ns:route-c.pem example.com",
+			},
+			expected: []string{
+				"/path/to/router/certs/ns:route-b.pem b.apps.example.com",
+				"/path/to/router/certs/ns:route-a.pem a.apps.example.com",
+				"/path/to/router/certs/ns:route.pem *.apps.example.com",
+				"/path/to/router/certs/ns:route-c.pem example.com",
+			},
+		},
+		{
+			name:     "empty",
+			lines:    []string{},
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sortCertConfigMapLines(tc.lines)
+			if !reflect.DeepEqual(tc.lines, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, tc.lines)
+			}
+		})
+	}
+}
+
+func TestCertHostSpecificityMatchesRoutes(t *testing.T) {
+	testCases := []struct {
+		certHost string
+		cfg      ServiceAliasConfig
+	}{
+		{certHost: "www.example.com", cfg: ServiceAliasConfig{Host: "www.example.com"}},
+		{certHost: "*.example.com", cfg: ServiceAliasConfig{Host: "www.example.com", IsWildcard: true}},
+		{certHost: "*.apps.example.com", cfg: ServiceAliasConfig{Host: "www.apps.example.com", IsWildcard: true}},
+		{certHost: "", cfg: ServiceAliasConfig{}},
+	}
+
+	for _, tc := range testCases {
+		if got, want := certHostSpecificity(tc.certHost), hostSpecificity(tc.cfg); got != want {
+			t.Errorf("Expected specificity %d for %q, got %d", want, tc.certHost, got)
+		}
+	}
+}
+
+func TestCrtListOptions(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		alpn        bool
+		expected    string
+	}{
+		{
+			name:     "alpn only",
+			alpn:     true,
+			expected: "[alpn h2,http/1.1]",
+		},
+		{
+			name:     "no options",
+			alpn:     false,
+			expected: "",
+		},
+		{
+			name: "extra options",
+			annotations: map[string]string{
+				sslCiphersAnnotation:    "ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-GCM-SHA384",
+				sslMinVersionAnnotation: "TLSv1.2",
+			},
+			alpn:     true,
+			expected: "[alpn h2,http/1.1 ciphers ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-GCM-SHA384 ssl-min-ver TLSv1.2]",
+		},
+		{
+			name: "extra options without alpn",
+			annotations: map[string]string{
+				sslMinVersionAnnotation: "TLSv1.3",
+			},
+			alpn:     false,
+			expected: "[ssl-min-ver TLSv1.3]",
+		},
+		{
+			name: "invalid extra options",
+			annotations: map[string]string{
+				sslCiphersAnnotation:    "AES128] [verify none",
+				sslMinVersionAnnotation: "TLSv9",
+			},
+			alpn:     true,
+			expected: "[alpn h2,http/1.1]",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := crtListOptions(cfg, tc.alpn); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDetectDuplicateSNI(t *testing.T) {
+	testCases := []struct {
+		name     string
+		lines    []string
+		expected []string
+	}{
+		{
+			name: "duplicate SNI",
+			lines: []string{
+				"/path/to/router/certs/ns:a.pem [alpn h2,http/1.1] www.example.com",
+				"/path/to/router/certs/ns:b.pem www.example.com",
+				"/path/to/router/certs/ns:c.pem *.example.com",
+				"/path/to/router/certs/ns:d.pem *.example.com",
+				"/path/to/router/certs/ns:e.pem other.example.com",
+			},
+			expected: []string{"*.example.com", "www.example.com"},
+		},
+		{
+			name: "same certificate repeated",
+			lines: []string{
+				"/path/to/router/certs/ns:a.pem www.example.com",
+				"/path/to/router/certs/ns:a.pem www.example.com",
+			},
+			expected: []string{},
+		},
+		{
+			name: "unique SNI",
+			lines: []string{
+				"/path/to/router/certs/ns:a.pem [alpn h2,http/1.1] www.example.com",
+				"/path/to/router/certs/ns:b.pem [alpn h2,http/1.1] api.example.com",
+			},
+			expected: []string{},
+		},
+		{
+			name:     "no lines",
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := detectDuplicateSNI(tc.lines); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestGenerateHAProxyCertConfigMapWildcardPrecedence(t *testing.T) {
+	state := map[ServiceAliasConfigKey]ServiceAliasConfig{
+		"a:wildcard":      buildServiceAliasConfig("wildcard", "a", "wild.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, true),
+		"b:app":           buildServiceAliasConfig("app", "b", "app.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, false),
+		"c:api":           buildServiceAliasConfig("api", "c", "api.example.com", "", routev1.TLSTerminationReencrypt, routev1.InsecureEdgeTerminationPolicyNone, false),
+		"z:apex":          buildServiceAliasConfig("apex", "z", "example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, false),
+		"y:deep-wildcard": buildServiceAliasConfig("deep-wildcard", "y", "x.app.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, true),
+	}
+	td := templateData{
+		WorkingDir:   "/path/to",
+		State:        state,
+		ServiceUnits: make(map[ServiceUnitKey]ServiceUnit),
+	}
+
+	expectedOrder := []string{
+		"/path/to/router/certs/y:deep-wildcard.pem [alpn h2,http/1.1] *.app.example.com",
+		"/path/to/router/certs/c:api.pem [alpn h2,http/1.1] api.example.com",
+		"/path/to/router/certs/b:app.pem [alpn h2,http/1.1] app.example.com",
+		"/path/to/router/certs/a:wildcard.pem [alpn h2,http/1.1] *.example.com",
+		"/path/to/router/certs/z:apex.pem [alpn h2,http/1.1] example.com",
+	}
+
+	if lines := generateHAProxyCertConfigMap(td); !reflect.DeepEqual(lines, expectedOrder) {
+		t.Errorf("Expected %v, got %v", expectedOrder, lines)
+	}
+}
+
+func TestDefaultCertEntry(t *testing.T) {
+	designated := buildServiceAliasConfig("designated", "prod", "www.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, false)
+	designated.Annotations = map[string]string{defaultCertificateAnnotation: "true"}
+	otherDesignated := buildServiceAliasConfig("other", "zzz", "other.example.com", "", routev1.TLSTerminationReencrypt, routev1.InsecureEdgeTerminationPolicyNone, false)
+	otherDesignated.Annotations = map[string]string{defaultCertificateAnnotation: "true"}
+
+	testCases := []struct {
+		name          string
+		state         map[ServiceAliasConfigKey]ServiceAliasConfig
+		expectedEntry string
+		expectedOK    bool
+	}{
+		{
+			name: "configured default",
+			state: map[ServiceAliasConfigKey]ServiceAliasConfig{
+				"dev:api":         buildServiceAliasConfig("api", "dev", "api.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, false),
+				"prod:designated": designated,
+			},
+			expectedEntry: "/path/to/router/certs/prod:designated.pem",
+			expectedOK:    true,
+		},
+		{
+			name: "no default available",
+			state: map[ServiceAliasConfigKey]ServiceAliasConfig{
+				"dev:insecure":    buildServiceAliasConfig("insecure", "dev", "insecure.example.com", "", "", routev1.InsecureEdgeTerminationPolicyNone, false),
+				"dev:passthrough": buildServiceAliasConfig("passthrough", "dev", "pt.example.com", "", routev1.TLSTerminationPassthrough, routev1.InsecureEdgeTerminationPolicyNone, false),
+			},
+		},
+		{
+			name: "multiple designated candidates",
+			state: map[ServiceAliasConfigKey]ServiceAliasConfig{
+				"zzz:other":       otherDesignated,
+				"prod:designated": designated,
+			},
+			expectedEntry: "/path/to/router/certs/prod:designated.pem",
+			expectedOK:    true,
+		},
+		{
+			name: "first available",
+			state: map[ServiceAliasConfigKey]ServiceAliasConfig{
+				"prod:api": buildServiceAliasConfig("api", "prod", "api.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, false),
+				"dev:api":  buildServiceAliasConfig("api", "dev", "api.dev.example.com", "", routev1.TLSTerminationReencrypt, routev1.InsecureEdgeTerminationPolicyNone, false),
+			},
+			expectedEntry: "/path/to/router/certs/dev:api.pem",
+			expectedOK:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			td := templateData{WorkingDir: "/path/to", State: tc.state}
+			entry, ok := defaultCertEntry(td)
+			if ok != tc.expectedOK {
+				t.Fatalf("Expected ok to be %v, got %v", tc.expectedOK, ok)
+			}
+			if entry != tc.expectedEntry {
+				t.Errorf("Expected %q, got %q", tc.expectedEntry, entry)
+			}
+		})
+	}
+}
+
+func TestFeatureEnabled(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		unset    bool
+		def      bool
+		expected bool
+	}{
+		{
+			name:     "set true",
+			value:    "true",
+			def:      false,
+			expected: true,
+		},
+		{
+			name:     "set true numeric",
+			value:    "1",
+			def:      false,
+			expected: true,
+		},
+		{
+			name:     "set false",
+			value:    "false",
+			def:      true,
+			expected: false,
+		},
+		{
+			name:     "unset uses default",
+			unset:    true,
+			def:      true,
+			expected: true,
+		},
+		{
+			name:     "empty uses default",
+			value:    "",
+			def:      true,
+			expected: true,
+		},
+		{
+			name:     "ambiguous value uses default",
+			value:    "yes",
+			def:      false,
+			expected: false,
+		},
+		{
+			name:     "ambiguous value uses true default",
+			value:    "enabled",
+			def:      true,
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ROUTER_TEST_FEATURE", tc.value)
+			if tc.unset {
+				os.Unsetenv("ROUTER_TEST_FEATURE")
+			}
+			if got := featureEnabled("ROUTER_TEST_FEATURE", tc.def); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestReloadJitter(t *testing.T) {
+	source := reloadJitterSource
+	t.Cleanup(func() { reloadJitterSource = source })
+	reloadJitterSource = rand.New(rand.NewSource(1))
+
+	testCases := []struct {
+		name      string
+		base      int
+		maxJitter int
+	}{
+		{
+			name:      "small jitter",
+			base:      5,
+			maxJitter: 1,
+		},
+		{
+			name:      "large jitter",
+			base:      30,
+			maxJitter: 60,
+		},
+		{
+			name:      "zero base",
+			base:      0,
+			maxJitter: 10,
+		},
+		{
+			name:      "no jitter",
+			base:      5,
+			maxJitter: 0,
+		},
+		{
+			name:      "negative jitter",
+			base:      5,
+			maxJitter: -3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			upper := tc.base + tc.maxJitter
+			if tc.maxJitter < 0 {
+				upper = tc.base
+			}
+			for i := 0; i < 100; i++ {
+				if got := reloadJitter(tc.base, tc.maxJitter); got < tc.base || got > upper {
+					t.Fatalf("Expected a value in [%d, %d], got %d", tc.base, upper, got)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeKind(t *testing.T) {
+	cfg := buildServiceAliasConfig("route", "ns", "www.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, false)
+	cfg.ActiveEndpoints = 2
+	ep1 := Endpoint{ID: "ept:ns:1", IP: "10.0.0.1", Port: "8080"}
+	ep2 := Endpoint{ID: "ept:ns:2", IP: "10.0.0.2", Port: "8080"}
+	ep3 := Endpoint{ID: "ept:ns:3", IP: "10.0.0.3", Port: "8080"}
+
+	endpointsOnly := buildServiceAliasConfig("route", "ns", "www.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, false)
+	endpointsOnly.ActiveEndpoints = 3
+	endpointsOnly.Status = ServiceAliasConfigStatusSaved
+
+	structural := buildServiceAliasConfig("route", "ns", "www.example.com", "/api", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, false)
+	structural.ActiveEndpoints = 2
+
+	scaledFromZero := buildServiceAliasConfig("route", "ns", "www.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyNone, false)
+	scaledFromZero.ServiceUnits = map[ServiceUnitKey]int32{"ns/svc": 100}
+	scaledFromZero.ServiceUnitNames = map[ServiceUnitKey]int32{"ns/svc": 0}
+	scaledFromZero.ActiveServiceUnits = 0
+	scaledToOne := scaledFromZero
+	scaledToOne.ServiceUnitNames = map[ServiceUnitKey]int32{"ns/svc": 256}
+	scaledToOne.ActiveServiceUnits = 1
+	scaledToOne.ActiveEndpoints = 1
+
+	testCases := []struct {
+		name     string
+		prev     ServiceAliasConfig
+		curr     ServiceAliasConfig
+		prevEps  []Endpoint
+		currEps  []Endpoint
+		expected string
+	}{
+		{
+			name:     "no change",
+			prev:     cfg,
+			curr:     cfg,
+			prevEps:  []Endpoint{ep1, ep2},
+			currEps:  []Endpoint{ep1, ep2},
+			expected: changeKindNone,
+		},
+		{
+			name:     "reordered endpoints",
+			prev:     cfg,
+			curr:     cfg,
+			prevEps:  []Endpoint{ep1, ep2},
+			currEps:  []Endpoint{ep2, ep1},
+			expected: changeKindNone,
+		},
+		{
+			name:     "endpoints changed",
+			prev:     cfg,
+			curr:     endpointsOnly,
+			prevEps:  []Endpoint{ep1, ep2},
+			currEps:  []Endpoint{ep1, ep2, ep3},
+			expected: changeKindEndpoints,
+		},
+		{
+			name:     "endpoint replaced",
+			prev:     cfg,
+			curr:     cfg,
+			prevEps:  []Endpoint{ep1, ep2},
+			currEps:  []Endpoint{ep1, ep3},
+			expected: changeKindEndpoints,
+		},
+		{
+			name:     "structural change",
+			prev:     cfg,
+			curr:     structural,
+			prevEps:  []Endpoint{ep1, ep2},
+			currEps:  []Endpoint{ep1, ep2, ep3},
+			expected: changeKindStructural,
+		},
+		{
+			name:     "scaled from zero",
+			prev:     scaledFromZero,
+			curr:     scaledToOne,
+			currEps:  []Endpoint{ep1},
+			expected: changeKindEndpoints,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := changeKind(tc.prev, tc.curr, tc.prevEps, tc.currEps); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestEndpointRuntimeCommands(t *testing.T) {
+	ep1 := Endpoint{ID: "pod:ns:1", IP: "10.0.0.1", Port: "8080"}
+	ep2 := Endpoint{ID: "pod:ns:2", IP: "fd00::2", Port: "8443"}
+	injected := Endpoint{ID: "pod:ns:3", IP: "10.0.0.3\nshutdown sessions server be_http:ns:route/pod:ns:1", Port: "8080"}
+
+	testCases := []struct {
+		name     string
+		added    map[string]Endpoint
+		removed  []string
+		expected []string
+	}{
+		{
+			name:  "additions",
+			added: map[string]Endpoint{"_dynamic-pod-2": ep2, "_dynamic-pod-1": ep1},
+			expected: []string{
+				"set server be_http:ns:route/_dynamic-pod-1 addr 10.0.0.1 port 8080",
+				"enable server be_http:ns:route/_dynamic-pod-1",
+				"set server be_http:ns:route/_dynamic-pod-2 addr fd00::2 port 8443",
+				"enable server be_http:ns:route/_dynamic-pod-2",
+			},
+		},
+		{
+			name:    "removals",
+			removed: []string{"pod:ns:1", "_dynamic-pod-1"},
+			expected: []string{
+				"disable server be_http:ns:route/pod:ns:1",
+				"disable server be_http:ns:route/_dynamic-pod-1",
+			},
+		},
+		{
+			name:    "mixed changes",
+			added:   map[string]Endpoint{"_dynamic-pod-1": ep2},
+			removed: []string{"pod:ns:1"},
+			expected: []string{
+				"set server be_http:ns:route/_dynamic-pod-1 addr fd00::2 port 8443",
+				"enable server be_http:ns:route/_dynamic-pod-1",
+				"disable server be_http:ns:route/pod:ns:1",
+			},
+		},
+		{
+			name:    "unsafe commands are dropped",
+			added:   map[string]Endpoint{"_dynamic-pod-1": injected, "_dynamic-pod-2": ep1},
+			removed: []string{"pod:ns:1;shutdown frontend public"},
+			expected: []string{
+				"set server be_http:ns:route/_dynamic-pod-2 addr 10.0.0.1 port 8080",
+				"enable server be_http:ns:route/_dynamic-pod-2",
+			},
+		},
+		{
+			name:     "no changes",
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := endpointRuntimeCommands("be_http:ns:route", tc.added, tc.removed); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidateRuntimeCommand(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cmd      string
+		expected bool
+	}{
+		{
+			name:     "valid command",
+			cmd:      "set server be_http:ns:route/pod:ns:1 addr 10.0.0.1 port 8080",
+			expected: true,
+		},
+		{
+			name:     "valid ipv6 command",
+			cmd:      "set server be_http:ns:route/pod:ns:1 addr fd00::1 port 8080",
+			expected: true,
+		},
+		{
+			name:     "empty command",
+			cmd:      "  ",
+			expected: false,
+		},
+		{
+			name:     "newline",
+			cmd:      "disable server be_http:ns:route/pod:ns:1\nshutdown sessions server be_http:ns:route/pod:ns:2",
+			expected: false,
+		},
+		{
+			name:     "carriage return",
+			cmd:      "disable server be_http:ns:route/pod:ns:1\r",
+			expected: false,
+		},
+		{
+			name:     "control character",
+			cmd:      "disable server be_http:ns:route/pod\x00:ns:1",
+			expected: false,
+		},
+		{
+			name:     "command separator",
+			cmd:      "disable server be_http:ns:route/pod:ns:1; disable frontend public",
+			expected: false,
+		},
+		{
+			name:     "non ascii",
+			cmd:      "disable server be_http:ns:route/pöd",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := validateRuntimeCommand(tc.cmd); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestWarmupOrder(t *testing.T) {
+	now := time.Now()
+	endpoints := []Endpoint{
+		{ID: "new-1", IP: "10.0.0.1", Port: "8080"},
+		{ID: "old-2", IP: "10.0.0.2", Port: "8080"},
+		{ID: "new-3", IP: "10.0.0.3", Port: "8080"},
+		{ID: "older-4", IP: "10.0.0.4", Port: "8080"},
+		{ID: "old-5", IP: "10.0.0.5", Port: "8080"},
+	}
+	lastSeen := map[string]time.Time{
+		"old-2":   now.Add(-time.Hour),
+		"older-4": now.Add(-24 * time.Hour),
+		"old-5":   now.Add(-time.Hour),
+	}
+
+	expected := []string{"older-4", "old-2", "old-5", "new-1", "new-3"}
+	ordered := warmupOrder(endpoints, lastSeen)
+	got := make([]string, 0, len(ordered))
+	for _, ep := range ordered {
+		got = append(got, ep.ID)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	if endpoints[0].ID != "new-1" {
+		t.Errorf("Expected input endpoints to be left unchanged, got %v", endpoints)
+	}
+
+	if got := warmupOrder(endpoints, nil); !reflect.DeepEqual(got, endpoints) {
+		t.Errorf("Expected original order when no endpoints are established, got %v", got)
+	}
+}
+
+func TestTCPCheckExpr(t *testing.T) {
+	testCases := []struct {
+		name        string
+		termination routev1.TLSTerminationType
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "passthrough route",
+			termination: routev1.TLSTerminationPassthrough,
+			expected:    "option tcp-check",
+		},
+		{
+			name:        "passthrough route with check port",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{tcpCheckPortAnnotation: "8443"},
+			expected:    "option tcp-check\ntcp-check connect port 8443",
+		},
+		{
+			name:        "passthrough route with invalid check port",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{tcpCheckPortAnnotation: "99999"},
+			expected:    "option tcp-check",
+		},
+		{
+			name:        "edge route",
+			termination: routev1.TLSTerminationEdge,
+			annotations: map[string]string{tcpCheckPortAnnotation: "8443"},
+			expected:    "",
+		},
+		{
+			name:     "insecure route",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{TLSTermination: tc.termination, Annotations: tc.annotations}
+			if got := tcpCheckExpr(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestConnRateLimit(t *testing.T) {
+	testCases := []struct {
+		name           string
+		annotations    map[string]string
+		expectedCount  int
+		expectedPeriod string
+		expectedOK     bool
+	}{
+		{
+			name:           "valid",
+			annotations:    map[string]string{connRateLimitAnnotation: "100/10s"},
+			expectedCount:  100,
+			expectedPeriod: "10s",
+			expectedOK:     true,
+		},
+		{
+			name:           "valid with default unit",
+			annotations:    map[string]string{connRateLimitAnnotation: "20/500"},
+			expectedCount:  20,
+			expectedPeriod: "500",
+			expectedOK:     true,
+		},
+		{
+			name:        "invalid period",
+			annotations: map[string]string{connRateLimitAnnotation: "100/fortnight"},
+		},
+		{
+			name:        "invalid count",
+			annotations: map[string]string{connRateLimitAnnotation: "-5/10s"},
+		},
+		{
+			name:        "missing period",
+			annotations: map[string]string{connRateLimitAnnotation: "100"},
+		},
+		{
+			name: "absent annotation",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			count, period, ok := connRateLimit(ServiceAliasConfig{Annotations: tc.annotations})
+			if ok != tc.expectedOK {
+				t.Fatalf("Expected ok to be %v, got %v", tc.expectedOK, ok)
+			}
+			if count != tc.expectedCount || period != tc.expectedPeriod {
+				t.Errorf("Expected %d/%q, got %d/%q", tc.expectedCount, tc.expectedPeriod, count, period)
+			}
+		})
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	testCases := []struct {
+		name     string
+		seconds  int
+		expected string
+	}{
+		{
+			name:     "valid value",
+			seconds:  30,
+			expected: "http-response set-header Retry-After 30",
+		},
+		{
+			name:     "zero",
+			seconds:  0,
+			expected: "",
+		},
+		{
+			name:     "negative",
+			seconds:  -1,
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := retryAfterHeader(tc.seconds); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestH2MaxConcurrentStreams(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    int
+	}{
+		{
+			name:        "in range",
+			annotations: map[string]string{h2MaxConcurrentStreamsAnnotation: "250"},
+			expected:    250,
+		},
+		{
+			name:        "over range",
+			annotations: map[string]string{h2MaxConcurrentStreamsAnnotation: "100000"},
+			expected:    maxH2ConcurrentStreams,
+		},
+		{
+			name:        "under range",
+			annotations: map[string]string{h2MaxConcurrentStreamsAnnotation: "0"},
+			expected:    minH2ConcurrentStreams,
+		},
+		{
+			name:        "invalid",
+			annotations: map[string]string{h2MaxConcurrentStreamsAnnotation: "lots"},
+			expected:    100,
+		},
+		{
+			name:     "default",
+			expected: 100,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := h2MaxConcurrentStreams(ServiceAliasConfig{Annotations: tc.annotations}, 100); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAnnotationWithinSize(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		maxBytes int
+		expected bool
+	}{
+		{
+			name:     "empty value",
+			value:    "",
+			maxBytes: 0,
+			expected: true,
+		},
+		{
+			name:     "under the limit",
+			value:    "/rewrite",
+			maxBytes: 16,
+			expected: true,
+		},
+		{
+			name:     "at the limit",
+			value:    strings.Repeat("a", 16),
+			maxBytes: 16,
+			expected: true,
+		},
+		{
+			name:     "over the limit",
+			value:    strings.Repeat("a", 17),
+			maxBytes: 16,
+			expected: false,
+		},
+		{
+			name:     "multi-byte characters count as bytes",
+			value:    "ééé",
+			maxBytes: 3,
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := annotationWithinSize(tc.value, tc.maxBytes); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestBackendIndex(t *testing.T) {
+	state := buildTestTemplateState()
+	td := templateData{State: state, BackendIndexes: backendIndexes(state)}
+
+	seen := make(map[int]ServiceAliasConfigKey)
+	for k := range td.State {
+		index := backendIndex(k, td)
+		if index < 0 || index >= len(td.State) {
+			t.Errorf("Expected index of %s to be in [0, %d), got %d", k, len(td.State), index)
+		}
+		if other, ok := seen[index]; ok {
+			t.Errorf("Expected unique indexes, got %d for both %s and %s", index, k, other)
+		}
+		seen[index] = k
+
+		for i := 0; i < 5; i++ {
+			if again := backendIndex(k, td); again != index {
+				t.Errorf("Expected stable index %d for %s, got %d", index, k, again)
+			}
+		}
+	}
+
+	if index := backendIndex("dev:admin-route", td); index != 0 {
+		t.Errorf("Expected the alphabetically first route to have index 0, got %d", index)
+	}
+
+	if index := backendIndex("missing:route", td); index != -1 {
+		t.Errorf("Expected -1 for a route not in the state, got %d", index)
+	}
+
+	if indexes := backendIndexes(nil); len(indexes) != 0 {
+		t.Errorf("Expected no indexes for an empty state, got %v", indexes)
+	}
+}
+
+func TestSetVarDirective(t *testing.T) {
+	testCases := []struct {
+		name     string
+		varName  string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "valid name and expression",
+			varName:  "host",
+			expr:     "req.hdr(host),lower",
+			expected: "http-request set-var(txn.host) req.hdr(host),lower",
+		},
+		{
+			name:     "name is sanitized",
+			varName:  "base-path.v1",
+			expr:     "path",
+			expected: "http-request set-var(txn.base_path_v1) path",
+		},
+		{
+			name:     "name starting with a digit",
+			varName:  "1host",
+			expr:     "req.hdr(host)",
+			expected: "",
+		},
+		{
+			name:     "empty name",
+			varName:  "",
+			expr:     "req.hdr(host)",
+			expected: "",
+		},
+		{
+			name:     "empty expression",
+			varName:  "host",
+			expr:     " ",
+			expected: "",
+		},
+		{
+			name:     "multi-line expression",
+			varName:  "host",
+			expr:     "req.hdr(host)\nhttp-request deny",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := setVarDirective(tc.varName, tc.expr); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestGeoRoutingEnabled(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    bool
+	}{
+		{
+			name:        "enabled",
+			annotations: map[string]string{geoRoutingAnnotation: "true"},
+			expected:    true,
+		},
+		{
+			name:        "disabled",
+			annotations: map[string]string{geoRoutingAnnotation: "false"},
+			expected:    false,
+		},
+		{
+			name:     "absent",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := geoRoutingEnabled(ServiceAliasConfig{Annotations: tc.annotations}); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+
+	if got, expected := geoCountryVarDirective("/var/lib/haproxy/conf/geoip.map"), "http-request set-var(txn.country) src,map_ip(/var/lib/haproxy/conf/geoip.map,ZZ)"; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if got := geoCountryVarDirective(""); got != "" {
+		t.Errorf("Expected no directive without a map file, got %q", got)
+	}
+}
+
+func TestNormalizeCountryList(t *testing.T) {
+	testCases := []struct {
+		name          string
+		value         string
+		expectedCodes []string
+		expectedValid bool
+	}{
+		{
+			name:          "valid list",
+			value:         "US,DE,JP",
+			expectedCodes: []string{"US", "DE", "JP"},
+			expectedValid: true,
+		},
+		{
+			name:          "mixed case and spaces",
+			value:         "us, De ,jP",
+			expectedCodes: []string{"US", "DE", "JP"},
+			expectedValid: true,
+		},
+		{
+			name:          "duplicates",
+			value:         "fr,FR,gb",
+			expectedCodes: []string{"FR", "GB"},
+			expectedValid: true,
+		},
+		{
+			name:          "invalid code",
+			value:         "US,XX",
+			expectedValid: false,
+		},
+		{
+			name:          "alpha-3 code",
+			value:         "USA",
+			expectedValid: false,
+		},
+		{
+			name:          "empty",
+			value:         " , ",
+			expectedValid: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			codes, valid := normalizeCountryList(tc.value)
+			if valid != tc.expectedValid {
+				t.Fatalf("Expected valid to be %v, got %v", tc.expectedValid, valid)
+			}
+			if !reflect.DeepEqual(codes, tc.expectedCodes) {
+				t.Errorf("Expected %v, got %v", tc.expectedCodes, codes)
+			}
+		})
+	}
+
+	if len(isoCountryCodes) != 249 {
+		t.Errorf("Expected 249 assigned country codes, got %d", len(isoCountryCodes))
+	}
+}
+
+func TestInMaintenanceWindow(t *testing.T) {
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		window   string
+		expected bool
+	}{
+		{
+			name:     "inside",
+			window:   "2024-03-10T10:00:00Z/2024-03-10T14:00:00Z",
+			expected: true,
+		},
+		{
+			name:     "inside with time zone offsets",
+			window:   "2024-03-10T11:00:00+01:00 / 2024-03-10T15:00:00+02:00",
+			expected: true,
+		},
+		{
+			name:     "at the start",
+			window:   "2024-03-10T12:00:00Z/2024-03-10T14:00:00Z",
+			expected: true,
+		},
+		{
+			name:     "at the end",
+			window:   "2024-03-10T10:00:00Z/2024-03-10T12:00:00Z",
+			expected: false,
+		},
+		{
+			name:     "outside",
+			window:   "2024-03-11T10:00:00Z/2024-03-11T14:00:00Z",
+			expected: false,
+		},
+		{
+			name:     "malformed window",
+			window:   "tomorrow at noon",
+			expected: false,
+		},
+		{
+			name:     "malformed end",
+			window:   "2024-03-10T10:00:00Z/later",
+			expected: false,
+		},
+		{
+			name:     "end before start",
+			window:   "2024-03-10T14:00:00Z/2024-03-10T10:00:00Z",
+			expected: false,
+		},
+		{
+			name:     "absent",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: map[string]string{}}
+			if len(tc.window) > 0 {
+				cfg.Annotations[maintenanceWindowAnnotation] = tc.window
+			}
+			if got := inMaintenanceWindow(cfg, now); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestWaitForBody(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "configured",
+			annotations: map[string]string{waitForBodyAnnotation: "2s"},
+			expected:    "http-request wait-for-body time 2s",
+		},
+		{
+			name: "configured with size",
+			annotations: map[string]string{
+				waitForBodyAnnotation:        "500ms",
+				waitForBodyAtLeastAnnotation: "16384",
+			},
+			expected: "http-request wait-for-body time 500ms at-least 16384",
+		},
+		{
+			name: "invalid size",
+			annotations: map[string]string{
+				waitForBodyAnnotation:        "2s",
+				waitForBodyAtLeastAnnotation: "16k",
+			},
+			expected: "http-request wait-for-body time 2s",
+		},
+		{
+			name:        "overflowing time",
+			annotations: map[string]string{waitForBodyAnnotation: "9999999999999999d"},
+			expected:    "http-request wait-for-body time " + templateutil.HaproxyMaxTimeout,
+		},
+		{
+			name:        "invalid time",
+			annotations: map[string]string{waitForBodyAnnotation: "forever"},
+			expected:    "",
+		},
+		{
+			name:     "absent",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := waitForBody(ServiceAliasConfig{Annotations: tc.annotations}); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolBySubset(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    map[string]string
+	}{
+		{
+			name: "multiple subsets",
+			annotations: map[string]string{
+				sendProxyAnnotationPrefix + "legacy":  "v1",
+				sendProxyAnnotationPrefix + "canary":  "V2",
+				sendProxyAnnotationPrefix + "tls":     "v2-ssl",
+				sendProxyAnnotationPrefix + "bad":     "v3",
+				"haproxy.router.openshift.io/balance": "roundrobin",
+			},
+			expected: map[string]string{
+				"legacy": "send-proxy",
+				"canary": "send-proxy-v2",
+				"tls":    "send-proxy-v2-ssl",
+			},
+		},
+		{
+			name: "single subset",
+			annotations: map[string]string{
+				sendProxyAnnotationPrefix + "stable": "v2",
+			},
+			expected: map[string]string{
+				"stable": "send-proxy-v2",
+			},
+		},
+		{
+			name: "empty subset name",
+			annotations: map[string]string{
+				sendProxyAnnotationPrefix: "v2",
+			},
+			expected: map[string]string{},
+		},
+		{
+			name:     "no annotations",
+			expected: map[string]string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := proxyProtocolBySubset(ServiceAliasConfig{Annotations: tc.annotations}); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestEffectiveBalance(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name: "affinity overrides roundrobin",
+			annotations: map[string]string{
+				sessionAffinityAnnotation: "true",
+				balanceAnnotation:         "roundrobin",
+			},
+			expected: "source",
+		},
+		{
+			name: "affinity keeps source",
+			annotations: map[string]string{
+				sessionAffinityAnnotation: "true",
+				balanceAnnotation:         "source",
+			},
+			expected: "source",
+		},
+		{
+			name: "affinity without balance",
+			annotations: map[string]string{
+				sessionAffinityAnnotation: "true",
+			},
+			expected: "source",
+		},
+		{
+			name: "no affinity",
+			annotations: map[string]string{
+				balanceAnnotation: "leastconn",
+			},
+			expected: "leastconn",
+		},
+		{
+			name: "no affinity with invalid balance",
+			annotations: map[string]string{
+				sessionAffinityAnnotation: "false",
+				balanceAnnotation:         "fastest",
+			},
+			expected: "",
+		},
+		{
+			name:     "no annotations",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := effectiveBalance(ServiceAliasConfig{Annotations: tc.annotations}); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	workDir := "/var/lib/haproxy"
+
+	testCases := []struct {
+		name            string
+		annotations     map[string]string
+		expectedOptions string
+		expectedOK      bool
+	}{
+		{
+			name:            "mTLS enabled",
+			annotations:     map[string]string{clientCAAnnotation: testCACertificate},
+			expectedOptions: "ca-file /var/lib/haproxy/router/cacerts/ns:route_client_ca.pem verify required",
+			expectedOK:      true,
+		},
+		{
+			name:        "invalid ca",
+			annotations: map[string]string{clientCAAnnotation: "not a certificate"},
+		},
+		{
+			name: "mTLS disabled",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			options, ok := clientCertAuth(ServiceAliasConfig{Annotations: tc.annotations}, workDir, "ns:route")
+			if ok != tc.expectedOK {
+				t.Fatalf("Expected ok to be %v, got %v", tc.expectedOK, ok)
+			}
+			if options != tc.expectedOptions {
+				t.Errorf("Expected %q, got %q", tc.expectedOptions, options)
+			}
+		})
+	}
+}
+
+func TestClientCertHeader(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name: "enabled with default header",
+			annotations: map[string]string{
+				clientCAAnnotation:            testCACertificate,
+				forwardClientCertDNAnnotation: "true",
+			},
+			expected: "http-request set-header X-SSL-Client-DN %[ssl_c_s_dn] if { ssl_c_used }",
+		},
+		{
+			name: "enabled with custom header",
+			annotations: map[string]string{
+				clientCAAnnotation:            testCACertificate,
+				forwardClientCertDNAnnotation: "X-Client-Subject",
+			},
+			expected: "http-request set-header X-Client-Subject %[ssl_c_s_dn] if { ssl_c_used }",
+		},
+		{
+			name: "unsafe header name",
+			annotations: map[string]string{
+				clientCAAnnotation:            testCACertificate,
+				forwardClientCertDNAnnotation: "X-Client %[src]",
+			},
+			expected: "",
+		},
+		{
+			name: "hop-by-hop header name",
+			annotations: map[string]string{
+				clientCAAnnotation:            testCACertificate,
+				forwardClientCertDNAnnotation: "Connection",
+			},
+			expected: "",
+		},
+		{
+			name: "forwarding disabled",
+			annotations: map[string]string{
+				clientCAAnnotation:            testCACertificate,
+				forwardClientCertDNAnnotation: "false",
+			},
+			expected: "",
+		},
+		{
+			name: "mTLS disabled",
+			annotations: map[string]string{
+				forwardClientCertDNAnnotation: "true",
+			},
+			expected: "",
+		},
+		{
+			name:     "no annotations",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := clientCertHeader(ServiceAliasConfig{Annotations: tc.annotations}); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+// testClientCRL is a valid (expired) CRL, the same as the placeholder CRL
+// used by the crl package.
+const testClientCRL = `-----BEGIN X509 CRL-----
+MIIBzzCBuAIBATANBgkqhkiG9w0BAQsFADBhMQswCQYDVQQGEwJVUzELMAkGA1UE
+CAwCTkMxEDAOBgNVBAcMB1JhbGVpZ2gxDDAKBgNVBAoMA09TNDEMMAoGA1UECwwD
+RW5nMRcwFQYDVQQDDA5QbGFjZWhvbGRlciBDQRcNMDAwMTAxMDAwMDAwWhcNMDAw
+MTAxMDEwMDAwWqAjMCEwHwYDVR0jBBgwFoAUbaqyU8VAswFgefsu6pOdvqK1nfgw
+DQYJKoZIhvcNAQELBQADggEBAD8W+OmWHp9Pg7914rA5QOk+pUCZ4F7++fbmGPpc
+9gdNOxkeCrZ3sdBeEs0P3+tSf8dLcpI5PKEbL+bC3wrIM3yzsD+mIZkvV/FGhgE1
+s7b6IA/8FYsmNWIjgAWBAp13zh0AH3qhpI01tm+cQETz6r249TWQ+p04pEA89+XT
+7CE99nHd8yNDOESs1xZreSFkIF/Hmm8y4I0o/+8wpjA9e3PJ7O25ZB2OGX4FufMf
+tVa0xfWd9czWFqM1DjU3ME0mVi6lr38AhUDoG6sFbHk+TfzTp4ykVUpXIHu4bJTG
+DPfV3SE277EvsrsGFYIsxWgXskITjzb9no9fnodd/jG46tw=
+-----END X509 CRL-----
+`
+
+func TestClientCRLFile(t *testing.T) {
+	workDir := "/var/lib/haproxy"
+
+	testCases := []struct {
+		name           string
+		annotations    map[string]string
+		expectedOption string
+		expectedOK     bool
+	}{
+		{
+			name:           "valid crl",
+			annotations:    map[string]string{clientCRLAnnotation: testClientCRL},
+			expectedOption: "crl-file /var/lib/haproxy/router/cacerts/ns:route_client_crl.pem",
+			expectedOK:     true,
+		},
+		{
+			name:        "certificate instead of crl",
+			annotations: map[string]string{clientCRLAnnotation: testCACertificate},
+		},
+		{
+			name:        "corrupt crl",
+			annotations: map[string]string{clientCRLAnnotation: "-----BEGIN X509 CRL-----\nMIIBzzCBuAIBATANBgkqhkiG9w0BAQsFADBh\n-----END X509 CRL-----\n"},
+		},
+		{
+			name: "absent annotation",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			option, ok := clientCRLFile(ServiceAliasConfig{Annotations: tc.annotations}, workDir, "ns:route")
+			if ok != tc.expectedOK {
+				t.Fatalf("Expected ok to be %v, got %v", tc.expectedOK, ok)
+			}
+			if option != tc.expectedOption {
+				t.Errorf("Expected %q, got %q", tc.expectedOption, option)
+			}
+		})
+	}
+}
+
+func TestAllowedIssuerACL(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "valid issuer list",
+			annotations: map[string]string{allowedIssuersAnnotation: "/C=US/O=Example/CN=Example CA\n/CN=Other CA\n"},
+			expected:    "acl allowed_client_issuer ssl_c_i_dn -m str \"/C=US/O=Example/CN=Example CA\" \"/CN=Other CA\"\nhttp-request deny if { ssl_c_used } !allowed_client_issuer",
+		},
+		{
+			name:        "unsafe issuers are dropped",
+			annotations: map[string]string{allowedIssuersAnnotation: "/CN=Example CA\n/CN=Bad\" || \"\n/CN=Bad\\CA"},
+			expected:    "acl allowed_client_issuer ssl_c_i_dn -m str \"/CN=Example CA\"\nhttp-request deny if { ssl_c_used } !allowed_client_issuer",
+		},
+		{
+			name:        "empty issuer list",
+			annotations: map[string]string{allowedIssuersAnnotation: " \n "},
+			expected:    "",
+		},
+		{
+			name:     "absent annotation",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := allowedIssuerACL(ServiceAliasConfig{Annotations: tc.annotations}); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestNeedsHTTPSRedirect(t *testing.T) {
+	testCases := []struct {
+		name        string
+		termination routev1.TLSTerminationType
+		policy      routev1.InsecureEdgeTerminationPolicyType
+		expected    bool
+	}{
+		{
+			name:        "edge with redirect",
+			termination: routev1.TLSTerminationEdge,
+			policy:      routev1.InsecureEdgeTerminationPolicyRedirect,
+			expected:    true,
+		},
+		{
+			name:        "reencrypt with redirect",
+			termination: routev1.TLSTerminationReencrypt,
+			policy:      routev1.InsecureEdgeTerminationPolicyRedirect,
+			expected:    true,
+		},
+		{
+			name:        "edge with allow",
+			termination: routev1.TLSTerminationEdge,
+			policy:      routev1.InsecureEdgeTerminationPolicyAllow,
+			expected:    false,
+		},
+		{
+			name:        "edge with none",
+			termination: routev1.TLSTerminationEdge,
+			policy:      routev1.InsecureEdgeTerminationPolicyNone,
+			expected:    false,
+		},
+		{
+			name:        "passthrough with redirect",
+			termination: routev1.TLSTerminationPassthrough,
+			policy:      routev1.InsecureEdgeTerminationPolicyRedirect,
+			expected:    false,
+		},
+		{
+			name:     "insecure",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{TLSTermination: tc.termination, InsecureEdgeTerminationPolicy: tc.policy}
+			if got := needsHTTPSRedirect(cfg); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHTTPSRedirectRule(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cfg      ServiceAliasConfig
+		expected string
+	}{
+		{
+			name:     "specific host",
+			cfg:      buildServiceAliasConfig("route", "ns", "www.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyRedirect, false),
+			expected: "http-request redirect scheme https if { hdr(host),field(1,:) -i www.example.com }",
+		},
+		{
+			name:     "wildcard host",
+			cfg:      buildServiceAliasConfig("route", "ns", "www.apps.example.com", "", routev1.TLSTerminationReencrypt, routev1.InsecureEdgeTerminationPolicyRedirect, true),
+			expected: `http-request redirect scheme https if { hdr(host),field(1,:) -m reg -i '^[^.]*\.apps\.example\.com$' }`,
+		},
+		{
+			name:     "unsafe host",
+			cfg:      buildServiceAliasConfig("route", "ns", "www.example.com }", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyRedirect, false),
+			expected: "",
+		},
+		{
+			name:     "non-redirect route",
+			cfg:      buildServiceAliasConfig("route", "ns", "www.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyAllow, false),
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := httpsRedirectRule(tc.cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHTTPSRedirectRuleHostWithPort(t *testing.T) {
+	cfg := buildServiceAliasConfig("route", "ns", "edge.example.com", "", routev1.TLSTerminationEdge, routev1.InsecureEdgeTerminationPolicyRedirect, false)
+	rule := httpsRedirectRule(cfg)
+
+	// Evaluate the rule's host fetch on a Host header with a port, as
+	// haproxy does: field(1,:) keeps the part before the first colon.
+	hostHeader := "edge.example.com:8080"
+	fetched := strings.SplitN(hostHeader, ":", 2)[0]
+	if !strings.Contains(rule, "hdr(host),field(1,:) -i "+fetched+" ") {
+		t.Errorf("Expected rule %q to match Host header %q", rule, hostHeader)
+	}
+}
+
+func TestDedupeEndpoints(t *testing.T) {
+	testCases := []struct {
+		name      string
+		endpoints []Endpoint
+		expected  []string
+	}{
+		{
+			name: "duplicates present",
+			endpoints: []Endpoint{
+				{ID: "1", IP: "10.0.0.1", Port: "8080"},
+				{ID: "2", IP: "10.0.0.2", Port: "8080"},
+				{ID: "3", IP: "10.0.0.1", Port: "8080"},
+				{ID: "4", IP: "10.0.0.1", Port: "8443"},
+			},
+			expected: []string{"1", "2", "4"},
+		},
+		{
+			name: "none present",
+			endpoints: []Endpoint{
+				{ID: "1", IP: "10.0.0.1", Port: "8080"},
+				{ID: "2", IP: "10.0.0.2", Port: "8080"},
+			},
+			expected: []string{"1", "2"},
+		},
+		{
+			name: "ipv6 duplicates",
+			endpoints: []Endpoint{
+				{ID: "1", IP: "fd00:0:0:0::1", Port: "8080"},
+				{ID: "2", IP: "fd00::1", Port: "8080"},
+				{ID: "3", IP: "FD00::1", Port: "8080"},
+				{ID: "4", IP: "fd00::2", Port: "8080"},
+			},
+			expected: []string{"1", "4"},
+		},
+		{
+			name:     "empty",
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := make([]string, 0)
+			for _, ep := range dedupeEndpoints(tc.endpoints) {
+				got = append(got, ep.ID)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCookiePath(t *testing.T) {
+	testCases := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{
+			name:     "nested path",
+			path:     "/api/v1/",
+			expected: "/api/v1",
+		},
+		{
+			name:     "unclean path",
+			path:     "api//v1/../v2",
+			expected: "/api/v2",
+		},
+		{
+			name:     "root path",
+			path:     "/",
+			expected: "/",
+		},
+		{
+			name:     "empty path",
+			path:     "",
+			expected: "/",
+		},
+		{
+			name:     "path with attribute separator",
+			path:     "/api; Domain=example.com",
+			expected: "/",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cookiePath(ServiceAliasConfig{Path: tc.path}); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	testCases := []struct {
+		name        string
+		termination routev1.TLSTerminationType
+		policy      routev1.InsecureEdgeTerminationPolicyType
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "edge",
+			termination: routev1.TLSTerminationEdge,
+			policy:      routev1.InsecureEdgeTerminationPolicyRedirect,
+			expected:    "secure attr SameSite=None",
+		},
+		{
+			name:        "reencrypt with explicit SameSite",
+			termination: routev1.TLSTerminationReencrypt,
+			policy:      routev1.InsecureEdgeTerminationPolicyNone,
+			annotations: map[string]string{cookieSameSiteAnnotation: "Strict"},
+			expected:    "secure attr SameSite=Strict",
+		},
+		{
+			name:        "edge allowing insecure traffic",
+			termination: routev1.TLSTerminationEdge,
+			policy:      routev1.InsecureEdgeTerminationPolicyAllow,
+			expected:    "",
+		},
+		{
+			name:     "http",
+			expected: "",
+		},
+		{
+			name:        "http with explicit SameSite",
+			annotations: map[string]string{cookieSameSiteAnnotation: "Lax"},
+			expected:    "attr SameSite=Lax",
+		},
+		{
+			name:        "http with SameSite None",
+			annotations: map[string]string{cookieSameSiteAnnotation: "None"},
+			expected:    "",
+		},
+		{
+			name:        "edge with invalid SameSite",
+			termination: routev1.TLSTerminationEdge,
+			annotations: map[string]string{cookieSameSiteAnnotation: "Sometimes"},
+			expected:    "secure attr SameSite=None",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{
+				TLSTermination:                tc.termination,
+				InsecureEdgeTerminationPolicy: tc.policy,
+				Annotations:                   tc.annotations,
+			}
+			if got := cookieAttributes(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRewriteTargetSafe(t *testing.T) {
+	testCases := []struct {
+		name     string
+		target   string
+		expected bool
+	}{
+		{name: "clean target", target: "/api/v1", expected: true},
+		{name: "root target", target: "/", expected: true},
+		{name: "dots within a segment", target: "/foo..bar/", expected: true},
+		{name: "traversal attempt", target: "/api/../admin", expected: false},
+		{name: "trailing traversal", target: "/api/..", expected: false},
+		{name: "encoded traversal attempt", target: "/api/%2e%2e/admin", expected: false},
+		{name: "absolute target", target: "/srv/www/", expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rewriteTargetSafe(tc.target); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDedupeCertLines(t *testing.T) {
+	testCases := []struct {
+		name     string
+		lines    []string
+		expected []string
+	}{
+		{
+			name:     "no lines",
+			lines:    []string{},
+			expected: []string{},
+		},
+		{
+			name:     "unique lines",
+			lines:    []string{"/path/a.pem [alpn h2,http/1.1] a.com", "/path/b.pem b.com"},
+			expected: []string{"/path/a.pem [alpn h2,http/1.1] a.com", "/path/b.pem b.com"},
+		},
+		{
+			name:     "duplicate lines",
+			lines:    []string{"/path/b.pem b.com", "/path/a.pem a.com", "/path/b.pem b.com", "/path/a.pem a.com"},
+			expected: []string{"/path/b.pem b.com", "/path/a.pem a.com"},
+		},
+		{
+			name:     "same cert with different options",
+			lines:    []string{"/path/a.pem a.com", "/path/a.pem [alpn h2,http/1.1] a.com"},
+			expected: []string{"/path/a.pem a.com", "/path/a.pem [alpn h2,http/1.1] a.com"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := dedupeCertLines(tc.lines); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHelperFunctionNames(t *testing.T) {
+	names := HelperFunctionNames()
+	if len(names) != len(helperFunctions) {
+		t.Fatalf("Expected %d names, got %d", len(helperFunctions), len(names))
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("Expected sorted names, got %v", names)
+	}
+	for _, name := range names {
+		if _, ok := helperFunctions[name]; !ok {
+			t.Errorf("Expected %q to be a registered helper function", name)
+		}
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	testCases := []struct {
+		name          string
+		src           string
+		expectedError bool
+	}{
+		{
+			name: "valid template",
+			src:  `{{- range $cfgIdx, $cfg := .State }}{{ processRewriteTarget (index $cfg.Annotations "haproxy.router.openshift.io/rewrite-target") }}{{- end }}`,
+		},
+		{
+			name:          "unknown function",
+			src:           `{{ noSuchHelper "value" }}`,
+			expectedError: true,
+		},
+		{
+			name:          "syntax error",
+			src:           `{{- range .State }}`,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateTemplate(tc.src)
+			if tc.expectedError && err == nil {
+				t.Errorf("Expected an error, got none")
+			}
+			if !tc.expectedError && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRenderDryRun(t *testing.T) {
+	workingDir := t.TempDir()
+	td := templateData{
+		WorkingDir: workingDir,
+		State: map[ServiceAliasConfigKey]ServiceAliasConfig{
+			"ns1:route1": {
+				Name:      "route1",
+				Namespace: "ns1",
+				Host:      "route1.example.com",
+				Annotations: map[string]string{
+					"haproxy.router.openshift.io/ip_allowlist": "192.168.1.0/24 10.0.0.1",
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name          string
+		src           string
+		expected      string
+		expectedError bool
+	}{
+		{
+			name:     "minimal template",
+			src:      `{{- range $cfgIdx, $cfg := .State }}backend be_{{ $cfg.Namespace }}:{{ $cfg.Name }} {{ $cfg.Host }}{{- end }}`,
+			expected: "backend be_ns1:route1 route1.example.com",
+		},
+		{
+			name:     "allowlist file is not written",
+			src:      `{{- range $cfgIdx, $cfg := .State }}{{ generateHAProxyAllowlistFile $.WorkingDir $cfgIdx (index $cfg.Annotations "haproxy.router.openshift.io/ip_allowlist") }}{{- end }}`,
+			expected: path.Join(workingDir, allowlistDir, "ns1:route1.txt"),
+		},
+		{
+			name:          "parse error",
+			src:           `{{ noSuchHelper }}`,
+			expectedError: true,
+		},
+		{
+			name:          "execution error",
+			src:           `{{ .NoSuchField }}`,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := RenderDryRun(tc.src, td)
+			if tc.expectedError {
+				if err == nil {
+					t.Errorf("Expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+
+	if _, err := os.Stat(path.Join(workingDir, allowlistDir)); !os.IsNotExist(err) {
+		t.Errorf("Expected dry run not to write to %s", workingDir)
+	}
+}
+
+func TestCollectGeneratedPaths(t *testing.T) {
+	largeAllowlist := make([]string, 0, haproxyutil.HAPROXY_MAX_ALLOWLIST_LENGTH+1)
+	for i := 0; i <= haproxyutil.HAPROXY_MAX_ALLOWLIST_LENGTH; i++ {
+		largeAllowlist = append(largeAllowlist, fmt.Sprintf("10.0.0.%d", i))
+	}
+
+	testCases := []struct {
+		name     string
+		state    map[ServiceAliasConfigKey]ServiceAliasConfig
+		expected []string
+	}{
+		{
+			name:     "empty state",
+			state:    map[ServiceAliasConfigKey]ServiceAliasConfig{},
+			expected: []string{},
+		},
+		{
+			name: "multiple file types",
+			state: map[ServiceAliasConfigKey]ServiceAliasConfig{
+				"ns1:edge": {
+					Host:           "edge.example.com",
+					TLSTermination: routev1.TLSTerminationEdge,
+					Certificates: map[string]Certificate{
+						"edge.example.com": {ID: "ns1:edge"},
+					},
+				},
+				"ns1:reencrypt": {
+					Host:           "reencrypt.example.com",
+					TLSTermination: routev1.TLSTerminationReencrypt,
+					Certificates: map[string]Certificate{
+						"reencrypt.example.com":                   {ID: "ns1:reencrypt"},
+						"reencrypt.example.com" + destCertPostfix: {ID: "ns1:reencrypt"},
+					},
+				},
+				"ns1:client-auth": {
+					Host:           "client.example.com",
+					TLSTermination: routev1.TLSTerminationEdge,
+					Certificates: map[string]Certificate{
+						"client.example.com": {ID: "ns1:client-auth"},
+					},
+					Annotations: map[string]string{
+						clientCAAnnotation:  testCACertificate,
+						clientCRLAnnotation: testClientCRL,
+					},
+				},
+				"ns1:invalid-client-auth": {
+					Host: "invalid-client.example.com",
+					Annotations: map[string]string{
+						clientCAAnnotation:  "not a certificate",
+						clientCRLAnnotation: "not a crl",
+					},
+				},
+				"ns1:passthrough": {
+					Host:           "passthrough.example.com",
+					TLSTermination: routev1.TLSTerminationPassthrough,
+				},
+				"ns1:small-allowlist": {
+					Host: "small.example.com",
+					Annotations: map[string]string{
+						"haproxy.router.openshift.io/ip_allowlist": "192.168.1.0/24",
+					},
+				},
+				"ns1:large-allowlist": {
+					Host: "large.example.com",
+					Annotations: map[string]string{
+						"haproxy.router.openshift.io/ip_whitelist": strings.Join(largeAllowlist, " "),
+					},
+				},
+			},
+			expected: []string{
+				"/var/lib/haproxy/router/allowlists/ns1:large-allowlist.txt",
+				"/var/lib/haproxy/router/cacerts/ns1:client-auth" + clientCAPostfix + ".pem",
+				"/var/lib/haproxy/router/cacerts/ns1:client-auth" + clientCRLPostfix + ".pem",
+				"/var/lib/haproxy/router/cacerts/ns1:reencrypt.pem",
+				"/var/lib/haproxy/router/certs/ns1:client-auth.pem",
+				"/var/lib/haproxy/router/certs/ns1:edge.pem",
+				"/var/lib/haproxy/router/certs/ns1:reencrypt.pem",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			td := templateData{WorkingDir: "/var/lib/haproxy", State: tc.state}
+			if got := collectGeneratedPaths(td); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHelperSetVersion(t *testing.T) {
+	if got, expected := HelperSetVersion(), helperSetVersion(HelperFunctionNames()); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	base := []string{"env", "firstMatch", "matchPattern"}
+	testCases := []struct {
+		name            string
+		names           []string
+		expectedChanged bool
+	}{
+		{
+			name:            "same helpers",
+			names:           []string{"env", "firstMatch", "matchPattern"},
+			expectedChanged: false,
+		},
+		{
+			name:            "helper added",
+			names:           []string{"env", "firstMatch", "isTrue", "matchPattern"},
+			expectedChanged: true,
+		},
+		{
+			name:            "helper removed",
+			names:           []string{"env", "matchPattern"},
+			expectedChanged: true,
+		},
+		{
+			name:            "helper renamed",
+			names:           []string{"env", "firstMatch", "matchPatterns"},
+			expectedChanged: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			changed := helperSetVersion(tc.names) != helperSetVersion(base)
+			if changed != tc.expectedChanged {
+				t.Errorf("Expected changed to be %v, got %v", tc.expectedChanged, changed)
+			}
+		})
+	}
+}
+
+func TestEndpointWeight(t *testing.T) {
+	testCases := []struct {
+		name     string
+		weight   string
+		expected int
+	}{
+		{name: "in range", weight: "100", expected: 100},
+		{name: "maximum", weight: "256", expected: 256},
+		{name: "over range", weight: "1000", expected: 256},
+		{name: "under range", weight: "-5", expected: 0},
+		{name: "zero", weight: "0", expected: 0},
+		{name: "invalid", weight: "heavy", expected: 1},
+		{name: "absent", weight: "", expected: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ep := Endpoint{ID: "ep1", IP: "10.0.0.1", Port: "8080", Weight: tc.weight}
+			if got := endpointWeight(ep, 1); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestBackupServerCount(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		available   int
+		expected    int
+	}{
+		{
+			name:        "within availability",
+			annotations: map[string]string{backupServersAnnotation: "2"},
+			available:   3,
+			expected:    2,
+		},
+		{
+			name:        "over availability",
+			annotations: map[string]string{backupServersAnnotation: "5"},
+			available:   3,
+			expected:    3,
+		},
+		{
+			name:        "negative",
+			annotations: map[string]string{backupServersAnnotation: "-1"},
+			available:   3,
+			expected:    0,
+		},
+		{
+			name:        "invalid",
+			annotations: map[string]string{backupServersAnnotation: "some"},
+			available:   3,
+			expected:    0,
+		},
+		{
+			name:      "unset",
+			available: 3,
+			expected:  0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := backupServerCount(cfg, tc.available); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLogFormatDirective(t *testing.T) {
+	testCases := []struct {
+		name        string
+		termination routev1.TLSTerminationType
+		expected    string
+	}{
+		{name: "passthrough", termination: routev1.TLSTerminationPassthrough, expected: "option tcplog"},
+		{name: "edge", termination: routev1.TLSTerminationEdge, expected: "option httplog"},
+		{name: "reencrypt", termination: routev1.TLSTerminationReencrypt, expected: "option httplog"},
+		{name: "http", expected: "option httplog"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{TLSTermination: tc.termination}
+			if got := logFormatDirective(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidateTimeoutConsistency(t *testing.T) {
+	testCases := []struct {
+		name                string
+		annotations         map[string]string
+		expectedDescription string
+		expectedConsistent  bool
+	}{
+		{
+			name:               "no timeouts",
+			expectedConsistent: true,
+		},
+		{
+			name: "consistent timeouts",
+			annotations: map[string]string{
+				timeoutAnnotation:       "30s",
+				timeoutClientAnnotation: "1m",
+				timeoutTunnelAnnotation: "1h",
+			},
+			expectedConsistent: true,
+		},
+		{
+			name: "equal timeouts",
+			annotations: map[string]string{
+				timeoutAnnotation:       "30s",
+				timeoutClientAnnotation: "30000ms",
+			},
+			expectedConsistent: true,
+		},
+		{
+			name: "client shorter than server",
+			annotations: map[string]string{
+				timeoutAnnotation:       "1m",
+				timeoutClientAnnotation: "10s",
+			},
+			expectedDescription: "client timeout 10s is shorter than server timeout 1m0s",
+		},
+		{
+			name: "client and tunnel shorter than server",
+			annotations: map[string]string{
+				timeoutAnnotation:       "1m",
+				timeoutClientAnnotation: "10s",
+				timeoutTunnelAnnotation: "30s",
+			},
+			expectedDescription: "client timeout 10s is shorter than server timeout 1m0s; tunnel timeout 30s is shorter than server timeout 1m0s",
+		},
+		{
+			name: "invalid client timeout",
+			annotations: map[string]string{
+				timeoutAnnotation:       "1m",
+				timeoutClientAnnotation: "soon",
+			},
+			expectedConsistent: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			description, consistent := validateTimeoutConsistency(cfg)
+			if consistent != tc.expectedConsistent {
+				t.Errorf("Expected consistent to be %v, got %v", tc.expectedConsistent, consistent)
+			}
+			if description != tc.expectedDescription {
+				t.Errorf("Expected %q, got %q", tc.expectedDescription, description)
+			}
+		})
+	}
+}
+
+func TestFrontendIdleTimeout(t *testing.T) {
+	testCases := []struct {
+		name       string
+		keepAlives []string
+		expected   string
+	}{
+		{
+			name:     "no routes",
+			expected: "300s",
+		},
+		{
+			name:       "routes without keep-alive timeouts",
+			keepAlives: []string{"", ""},
+			expected:   "300s",
+		},
+		{
+			name:       "varying keep-alive timeouts",
+			keepAlives: []string{"10s", "2m", "", "90000ms"},
+			expected:   "2m",
+		},
+		{
+			name:       "invalid keep-alive timeout",
+			keepAlives: []string{"forever", "5s"},
+			expected:   "5s",
+		},
+		{
+			name:       "keep-alive timeout over the haproxy maximum",
+			keepAlives: []string{"10s", "9999999999s"},
+			expected:   templateutil.HaproxyMaxTimeout,
+		},
+		{
+			name:       "equal keep-alive timeouts written differently",
+			keepAlives: []string{"60s", "1m", "60000ms", "10s"},
+			expected:   "1m",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := make(map[ServiceAliasConfigKey]ServiceAliasConfig)
+			for i, keepAlive := range tc.keepAlives {
+				cfg := ServiceAliasConfig{Annotations: map[string]string{}}
+				if len(keepAlive) > 0 {
+					cfg.Annotations[keepAliveTimeoutAnnotation] = keepAlive
+				}
+				state[ServiceAliasConfigKey(fmt.Sprintf("ns:route%d", i))] = cfg
+			}
+			// Map iteration order is random, render repeatedly to catch
+			// order dependent results.
+			for i := 0; i < 20; i++ {
+				if got := frontendIdleTimeout(templateData{State: state}, "300s"); got != tc.expected {
+					t.Fatalf("Expected %q, got %q", tc.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRequiresHAProxyVersion(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:     "baseline route",
+			expected: "",
+		},
+		{
+			name: "annotations without version requirements",
+			annotations: map[string]string{
+				"haproxy.router.openshift.io/timeout": "30s",
+				balanceAnnotation:                     "leastconn",
+			},
+			expected: "",
+		},
+		{
+			name: "annotation needing haproxy 2.x",
+			annotations: map[string]string{
+				"haproxy.router.openshift.io/timeout": "30s",
+				waitForBodyAnnotation:                 "1s",
+			},
+			expected: "2.4",
+		},
+		{
+			name: "uri normalization needs haproxy 2.4",
+			annotations: map[string]string{
+				normalizeURIAnnotation: "path-merge-slashes",
+			},
+			expected: "2.4",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := requiresHAProxyVersion(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHAProxyVersionLess(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{a: "", b: "2.4", expected: true},
+		{a: "2.4", b: "", expected: false},
+		{a: "2.2", b: "2.4", expected: true},
+		{a: "2.4", b: "2.10", expected: true},
+		{a: "2.4", b: "2.4", expected: false},
+		{a: "2.4", b: "2.4.1", expected: true},
+		{a: "3.0", b: "2.8", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.a+"<"+tc.b, func(t *testing.T) {
+			if got := haproxyVersionLess(tc.a, tc.b); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDHParam(t *testing.T) {
+	testCases := []struct {
+		profile  string
+		expected int
+	}{
+		{profile: "modern", expected: 2048},
+		{profile: "intermediate", expected: 2048},
+		{profile: "old", expected: 1024},
+		{profile: "custom-ciphers", expected: defaultDHParam},
+		{profile: "", expected: defaultDHParam},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.profile, func(t *testing.T) {
+			if got := dhParam(tc.profile); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHTTPCheckExpect(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "specific code",
+			annotations: map[string]string{healthCheckExpectStatusAnnotation: "204"},
+			expected:    "http-check expect status 204",
+		},
+		{
+			name:        "status range",
+			annotations: map[string]string{healthCheckExpectStatusAnnotation: "200-299"},
+			expected:    "http-check expect status 200-299",
+		},
+		{
+			name:        "inverted status range",
+			annotations: map[string]string{healthCheckExpectStatusAnnotation: "299-200"},
+			expected:    "http-check expect status 200-399",
+		},
+		{
+			name:        "invalid value",
+			annotations: map[string]string{healthCheckExpectStatusAnnotation: "ok"},
+			expected:    "http-check expect status 200-399",
+		},
+		{
+			name:        "out of range code",
+			annotations: map[string]string{healthCheckExpectStatusAnnotation: "700"},
+			expected:    "http-check expect status 200-399",
+		},
+		{
+			name:     "default",
+			expected: "http-check expect status 200-399",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := httpCheckExpect(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAbortOnClose(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		def         bool
+		expected    bool
+	}{
+		{
+			name:        "explicit on",
+			annotations: map[string]string{abortOnCloseAnnotation: "true"},
+			def:         false,
+			expected:    true,
+		},
+		{
+			name:        "explicit off",
+			annotations: map[string]string{abortOnCloseAnnotation: "false"},
+			def:         true,
+			expected:    false,
+		},
+		{
+			name:     "default on",
+			def:      true,
+			expected: true,
+		},
+		{
+			name:     "default off",
+			def:      false,
+			expected: false,
+		},
+		{
+			name:        "invalid value",
+			annotations: map[string]string{abortOnCloseAnnotation: "sometimes"},
+			def:         true,
+			expected:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := abortOnClose(cfg, tc.def); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+	}{
+		{
+			name:        "default bundle",
+			annotations: map[string]string{securityHeadersAnnotation: "true"},
+			expected: []string{
+				"http-response set-header X-Content-Type-Options 'nosniff'",
+				"http-response set-header X-Frame-Options 'DENY'",
+				"http-response set-header Referrer-Policy 'strict-origin-when-cross-origin'",
+			},
+		},
+		{
+			name: "override",
+			annotations: map[string]string{
+				securityHeadersAnnotation:                          "true",
+				securityHeaderAnnotationPrefix + "x-frame-options": "SAMEORIGIN",
+				securityHeaderAnnotationPrefix + "referrer-policy": "",
+			},
+			expected: []string{
+				"http-response set-header X-Content-Type-Options 'nosniff'",
+				"http-response set-header X-Frame-Options 'SAMEORIGIN'",
+			},
+		},
+		{
+			name: "override is sanitized",
+			annotations: map[string]string{
+				securityHeadersAnnotation:                                 "true",
+				securityHeaderAnnotationPrefix + "x-content-type-options": "nosniff' if TRUE",
+				securityHeaderAnnotationPrefix + "x-frame-options":        "",
+				securityHeaderAnnotationPrefix + "referrer-policy":        "",
+			},
+			expected: []string{
+				`http-response set-header X-Content-Type-Options 'nosniff'\'' if TRUE'`,
+			},
+		},
+		{
+			name: "override with newline falls back to default",
+			annotations: map[string]string{
+				securityHeadersAnnotation:                          "true",
+				securityHeaderAnnotationPrefix + "x-frame-options": "DENY\n  http-request deny",
+				securityHeaderAnnotationPrefix + "referrer-policy": "no-referrer\r",
+			},
+			expected: []string{
+				"http-response set-header X-Content-Type-Options 'nosniff'",
+				"http-response set-header X-Frame-Options 'DENY'",
+				"http-response set-header Referrer-Policy 'strict-origin-when-cross-origin'",
+			},
+		},
+		{
+			name:        "disabled",
+			annotations: map[string]string{securityHeadersAnnotation: "false"},
+		},
+		{
+			name: "unset",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := securityHeaders(cfg); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestIsHopByHopHeader(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected bool
+	}{
+		{name: "Connection", expected: true},
+		{name: "Keep-Alive", expected: true},
+		{name: "Proxy-Authenticate", expected: true},
+		{name: "Proxy-Authorization", expected: true},
+		{name: "Proxy-Connection", expected: true},
+		{name: "TE", expected: true},
+		{name: "Trailer", expected: true},
+		{name: "transfer-encoding", expected: true},
+		{name: "Upgrade", expected: true},
+		{name: "X-Forwarded-For", expected: false},
+		{name: "Content-Type", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isHopByHopHeader(tc.name); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestConnectionMode(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "keep-alive",
+			annotations: map[string]string{connectionModeAnnotation: "keep-alive"},
+			expected:    "option http-keep-alive",
+		},
+		{
+			name:        "server-close",
+			annotations: map[string]string{connectionModeAnnotation: "server-close"},
+			expected:    "option http-server-close",
+		},
+		{
+			name:        "unsupported tunnel mode",
+			annotations: map[string]string{connectionModeAnnotation: "tunnel"},
+			expected:    "option http-server-close",
+		},
+		{
+			name:        "close",
+			annotations: map[string]string{connectionModeAnnotation: "close"},
+			expected:    "option httpclose",
+		},
+		{
+			name:        "invalid mode",
+			annotations: map[string]string{connectionModeAnnotation: "pipeline"},
+			expected:    "option http-server-close",
+		},
+		{
+			name:     "default",
+			expected: "option http-server-close",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := connectionMode(cfg, "server-close"); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidateConfigStructure(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rendered string
+		expected []string
+	}{
+		{
+			name: "well-formed config",
+			rendered: `global
+  maxconn 20000
+
+frontend public
+  bind :80
+  # no default_backend here
+  use_backend %[base,map_reg(/var/lib/haproxy/conf/os_http_be.map)]
+  default_backend openshift_default
+
+backend openshift_default
+  mode http
+
+backend be_http:ns1:route1
+  mode http
+  server pod:ns1:route1:10.0.0.1:8080 10.0.0.1:8080 weight 1
+
+backend be_http:ns1:route2
+  server-template _dynamic-pod- 1-5 172.4.0.4:8765 check disabled
+`,
+		},
+		{
+			name: "empty backend",
+			rendered: `backend be_http:ns1:route1
+  mode http
+  # server pod:ns1:route1:10.0.0.1:8080 10.0.0.1:8080
+
+backend be_http:ns1:route2
+  server pod:ns1:route2:10.0.0.2:8080 10.0.0.2:8080 weight 1
+`,
+			expected: []string{"backend be_http:ns1:route1 has no servers"},
+		},
+		{
+			name: "frontend without default_backend",
+			rendered: `frontend public
+  bind :80
+  use_backend %[base,map_reg(/var/lib/haproxy/conf/os_http_be.map)]
+`,
+			expected: []string{"frontend public has no default_backend"},
+		},
+		{
+			name: "both warnings",
+			rendered: `frontend public
+  bind :80
+backend be_http:ns1:route1
+  mode http`,
+			expected: []string{
+				"frontend public has no default_backend",
+				"backend be_http:ns1:route1 has no servers",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := validateConfigStructure(tc.rendered); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestReencryptTargetPort(t *testing.T) {
+	endpoints := []Endpoint{
+		{ID: "ep1", IP: "10.0.0.1", Port: "8443", PortName: "https"},
+		{ID: "ep2", IP: "10.0.0.1", Port: "8080", PortName: "http"},
+		{ID: "ep3", IP: "10.0.0.2", Port: "8443", PortName: "https"},
+	}
+
+	testCases := []struct {
+		name       string
+		preferPort string
+		endpoints  []Endpoint
+		expected   int
+	}{
+		{
+			name:       "explicit preferred port number",
+			preferPort: "9443",
+			endpoints:  endpoints,
+			expected:   9443,
+		},
+		{
+			name:       "explicit preferred port name",
+			preferPort: "https",
+			endpoints:  endpoints,
+			expected:   8443,
+		},
+		{
+			name:      "single endpoint port",
+			endpoints: endpoints[:1],
+			expected:  8443,
+		},
+		{
+			name:      "ambiguous endpoint ports",
+			endpoints: endpoints,
+			expected:  defaultReencryptPort,
+		},
+		{
+			name:       "unknown preferred port name",
+			preferPort: "metrics",
+			endpoints:  endpoints,
+			expected:   defaultReencryptPort,
+		},
+		{
+			name:     "no endpoints",
+			expected: defaultReencryptPort,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{TLSTermination: routev1.TLSTerminationReencrypt, PreferPort: tc.preferPort}
+			svc := ServiceUnit{Name: "ns/svc", EndpointTable: tc.endpoints}
+			if got := reencryptTargetPort(cfg, svc); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestServerTemplate(t *testing.T) {
+	testCases := []struct {
+		name               string
+		annotations        map[string]string
+		count              int
+		expected           string
+		expectedApplicable bool
+	}{
+		{
+			name:               "enabled",
+			annotations:        map[string]string{dnsDiscoveryAnnotation: "_https._tcp.svc.ns1.svc.cluster.local"},
+			count:              5,
+			expected:           "server-template _srv- 5 _https._tcp.svc.ns1.svc.cluster.local check resolvers cluster-dns init-addr none",
+			expectedApplicable: true,
+		},
+		{
+			name:        "enabled without servers",
+			annotations: map[string]string{dnsDiscoveryAnnotation: "_https._tcp.svc.ns1.svc.cluster.local"},
+			count:       0,
+		},
+		{
+			name:        "invalid SRV record",
+			annotations: map[string]string{dnsDiscoveryAnnotation: "svc.ns1 check"},
+			count:       5,
+		},
+		{
+			name:  "disabled",
+			count: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			got, applicable := serverTemplate(cfg, tc.count)
+			if applicable != tc.expectedApplicable {
+				t.Errorf("Expected applicable to be %v, got %v", tc.expectedApplicable, applicable)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCacheControlHint(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{
+			name:     "max-age and stale-while-revalidate",
+			value:    "max-age=60, stale-while-revalidate=30",
+			expected: "http-response set-header Cache-Control 'max-age=60, stale-while-revalidate=30'",
+		},
+		{
+			name:     "max-age only",
+			value:    "max-age=0",
+			expected: "http-response set-header Cache-Control 'max-age=0'",
+		},
+		{
+			name:  "negative value",
+			value: "max-age=-1",
+		},
+		{
+			name:  "non numeric value",
+			value: "max-age=60,stale-while-revalidate=soon",
+		},
+		{
+			name:  "unknown directive",
+			value: "max-age=60,no-store",
+		},
+		{
+			name:  "duplicate directive",
+			value: "max-age=60,max-age=30",
+		},
+		{
+			name: "unset",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: map[string]string{}}
+			if len(tc.value) > 0 {
+				cfg.Annotations[cacheControlAnnotation] = tc.value
+			}
+			if got := cacheControlHint(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestUniqueIDFormat(t *testing.T) {
+	const def = `%{+X}o\ %ci:%cp_%fi:%fp_%Ts_%rt:%pid`
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "custom format",
+			annotations: map[string]string{uniqueIDFormatAnnotation: "%[uuid(4)]"},
+			expected:    "%[uuid(4)]",
+		},
+		{
+			name:        "custom format with variables",
+			annotations: map[string]string{uniqueIDFormatAnnotation: "router-%ci:%cp-%[rand(1000)]"},
+			expected:    "router-%ci:%cp-%[rand(1000)]",
+		},
+		{
+			name:        "unsafe sample fetch",
+			annotations: map[string]string{uniqueIDFormatAnnotation: "%[req.hdr(authorization)]"},
+			expected:    def,
+		},
+		{
+			name:        "unsafe characters",
+			annotations: map[string]string{uniqueIDFormatAnnotation: "%[uuid]\n  http-request deny"},
+			expected:    def,
+		},
+		{
+			name:     "default",
+			expected: def,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := uniqueIDFormat(cfg, def); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestUniqueIDDirectives(t *testing.T) {
+	cfg := ServiceAliasConfig{Annotations: map[string]string{uniqueIDFormatAnnotation: "%[uuid]"}}
+	expected := []string{"unique-id-format %[uuid]", "unique-id-header X-Request-ID"}
+	if got := uniqueIDDirectives(cfg, "%[rand]"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestTracePropagationHeaders(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+	}{
+		{
+			name:        "enabled",
+			annotations: map[string]string{tracingAnnotation: "true"},
+			expected: []string{
+				"http-request set-header X-Span-ID %[rand,hex] unless { req.hdr(X-Span-ID) -m found }",
+			},
+		},
+		{
+			name:        "disabled",
+			annotations: map[string]string{tracingAnnotation: "false"},
+		},
+		{
+			name: "unset",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := tracePropagationHeaders(cfg); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTracePropagationHeadersKeepsCommaSeparatedHeaders(t *testing.T) {
+	cfg := ServiceAliasConfig{Annotations: map[string]string{tracingAnnotation: "true"}}
+	header := "tracestate: congo=t61rcWkgMzE,rojo=00f067aa0ba902b7"
+	for _, directive := range tracePropagationHeaders(cfg) {
+		for _, name := range []string{"tracestate", "baggage", "traceparent"} {
+			if strings.Contains(strings.ToLower(directive), name) {
+				t.Errorf("Expected %q to be passed through untouched, got %q", header, directive)
+			}
+		}
+	}
+}
+
+func TestDetectRateLimitAllowlistOverlap(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    bool
+	}{
+		{
+			name: "overlap present",
+			annotations: map[string]string{
+				rateLimitAnnotation:                        "true",
+				rateLimitAnnotation + ".rate-http":         "100",
+				"haproxy.router.openshift.io/ip_allowlist": "192.168.1.0/24",
+			},
+			expected: true,
+		},
+		{
+			name: "overlap with deprecated allowlist annotation",
+			annotations: map[string]string{
+				rateLimitAnnotation:                        "true",
+				rateLimitAnnotation + ".concurrent-tcp":    "10",
+				"haproxy.router.openshift.io/ip_whitelist": "10.0.0.1",
+			},
+			expected: true,
+		},
+		{
+			name: "no allowlist",
+			annotations: map[string]string{
+				rateLimitAnnotation:                "true",
+				rateLimitAnnotation + ".rate-http": "100",
+			},
+			expected: false,
+		},
+		{
+			name: "rate limiting without limits",
+			annotations: map[string]string{
+				rateLimitAnnotation:                        "true",
+				"haproxy.router.openshift.io/ip_allowlist": "192.168.1.0/24",
+			},
+			expected: false,
+		},
+		{
+			name: "rate limiting disabled",
+			annotations: map[string]string{
+				rateLimitAnnotation:                        "false",
+				rateLimitAnnotation + ".rate-http":         "100",
+				"haproxy.router.openshift.io/ip_allowlist": "192.168.1.0/24",
+			},
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := detectRateLimitAllowlistOverlap(cfg); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRateLimitExemptACL(t *testing.T) {
+	testCases := []struct {
+		name          string
+		allowlistFile string
+		expected      string
+	}{
+		{
+			name:          "allowlist present",
+			allowlistFile: "/var/lib/haproxy/router/allowlists/ns1:route1.txt",
+			expected:      "acl rate_limit_exempt src -f /var/lib/haproxy/router/allowlists/ns1:route1.txt",
+		},
+		{
+			name:     "no allowlist",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rateLimitExemptACL(tc.allowlistFile); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDistinctCertCount(t *testing.T) {
+	testCases := []struct {
+		name             string
+		certificateIndex map[string]int
+		expected         int
+	}{
+		{
+			name:             "shared certs",
+			certificateIndex: map[string]int{"default": 1, "cert1": 3},
+			expected:         2,
+		},
+		{
+			name:             "unique certs",
+			certificateIndex: map[string]int{"default": 1, "cert1": 1, "cert2": 1, "cert3": 1},
+			expected:         4,
+		},
+		{
+			name:             "no certs",
+			certificateIndex: map[string]int{"": 1},
+			expected:         0,
+		},
+		{
+			name:     "no certificate index",
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			td := templateData{CertificateIndex: tc.certificateIndex}
+			if got := distinctCertCount(td); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSSLCacheSize(t *testing.T) {
+	testCases := []struct {
+		name          string
+		distinctCerts int
+		maxConn       int
+		expected      int
+	}{
+		{name: "small", distinctCerts: 2, maxConn: 1000, expected: minSSLCacheSize},
+		{name: "large", distinctCerts: 500, maxConn: 50000, expected: 100000},
+		{name: "capped", distinctCerts: 10000, maxConn: 500000, expected: maxSSLCacheSize},
+		{name: "no certs or connections", expected: minSSLCacheSize},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sslCacheSize(tc.distinctCerts, tc.maxConn); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDeprecatedAnnotations(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    map[string]string
+	}{
+		{
+			name: "deprecated annotation",
+			annotations: map[string]string{
+				"haproxy.router.openshift.io/ip_whitelist": "10.0.0.1",
+				"haproxy.router.openshift.io/timeout":      "30s",
+			},
+			expected: map[string]string{
+				"haproxy.router.openshift.io/ip_whitelist": "haproxy.router.openshift.io/ip_allowlist",
+			},
+		},
+		{
+			name: "no deprecated annotation",
+			annotations: map[string]string{
+				"haproxy.router.openshift.io/ip_allowlist": "10.0.0.1",
+			},
+			expected: map[string]string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := deprecatedAnnotations(cfg, deprecatedAnnotationReplacements); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestMigrateAnnotations(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    map[string]string
+	}{
+		{
+			name: "deprecated annotation is translated",
+			annotations: map[string]string{
+				"haproxy.router.openshift.io/ip_whitelist": "10.0.0.1",
+				"haproxy.router.openshift.io/timeout":      "30s",
+			},
+			expected: map[string]string{
+				"haproxy.router.openshift.io/ip_allowlist": "10.0.0.1",
+				"haproxy.router.openshift.io/timeout":      "30s",
+			},
+		},
+		{
+			name: "replacement takes precedence",
+			annotations: map[string]string{
+				"haproxy.router.openshift.io/ip_whitelist": "10.0.0.1",
+				"haproxy.router.openshift.io/ip_allowlist": "10.0.0.2",
+			},
+			expected: map[string]string{
+				"haproxy.router.openshift.io/ip_allowlist": "10.0.0.2",
+			},
+		},
+		{
+			name: "non-deprecated annotations pass through",
+			annotations: map[string]string{
+				"haproxy.router.openshift.io/ip_allowlist": "10.0.0.1",
+				"haproxy.router.openshift.io/timeout":      "30s",
+			},
+			expected: map[string]string{
+				"haproxy.router.openshift.io/ip_allowlist": "10.0.0.1",
+				"haproxy.router.openshift.io/timeout":      "30s",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			original := make(map[string]string, len(tc.annotations))
+			for k, v := range tc.annotations {
+				original[k] = v
+			}
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := migrateAnnotations(cfg, deprecatedAnnotationReplacements); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+			if !reflect.DeepEqual(cfg.Annotations, original) {
+				t.Errorf("Expected annotations to be unchanged, got %v", cfg.Annotations)
+			}
+		})
+	}
+}
+
+func TestUseLegacyRegexp(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    bool
+	}{
+		{
+			name:        "explicit legacy",
+			annotations: map[string]string{legacyRegexpAnnotation: "true"},
+			expected:    true,
+		},
+		{
+			name:        "explicit new",
+			annotations: map[string]string{legacyRegexpAnnotation: "false"},
+			expected:    false,
+		},
+		{
+			name:        "invalid value",
+			annotations: map[string]string{legacyRegexpAnnotation: "legacy"},
+			expected:    false,
+		},
+		{
+			name:     "default",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := useLegacyRegexp(cfg); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestWarmRegexpCache(t *testing.T) {
+	valid := []string{`^warm\.example\.com(:[0-9]+)?(/.*)?$`, `^[^\.]*\.warm\.example\.com(:[0-9]+)?(/.*)?$`}
+	invalid := `^warm(\.example\.com$`
+
+	WarmRegexpCache(append(valid, invalid))
+
+	for _, pattern := range valid {
+		if _, ok := compiledRegexp.Load(pattern); !ok {
+			t.Errorf("Expected %q to be in the regexp cache", pattern)
+		}
+	}
+	if _, ok := compiledRegexp.Load(invalid); ok {
+		t.Errorf("Expected %q not to be in the regexp cache", invalid)
+	}
+}
+
+func TestEvictRegexpCache(t *testing.T) {
+	retained := []string{`^retained\.example\.com(:[0-9]+)?(/.*)?$`}
+	evicted := []string{`^evicted\.example\.com(:[0-9]+)?(/.*)?$`, `^[^\.]*\.evicted\.example\.com(:[0-9]+)?(/.*)?$`}
+
+	WarmRegexpCache(append(retained, evicted...))
+	EvictRegexpCache(retained)
+
+	for _, pattern := range retained {
+		if _, ok := compiledRegexp.Load(pattern); !ok {
+			t.Errorf("Expected %q to be retained in the regexp cache", pattern)
+		}
+	}
+	for _, pattern := range evicted {
+		if _, ok := compiledRegexp.Load(pattern); ok {
+			t.Errorf("Expected %q to be evicted from the regexp cache", pattern)
+		}
+	}
+}
+
+func TestRegexpCacheStats(t *testing.T) {
+	EvictRegexpCache(nil)
+	if got := RegexpCacheStats(); got != 0 {
+		t.Errorf("Expected an empty regexp cache, got %d entries", got)
+	}
+
+	patterns := []string{`^stats\.example\.com$`, `^[^\.]*\.stats\.example\.com$`}
+	for _, pattern := range patterns {
+		for i := 0; i < 2; i++ {
+			if _, err := cachedRegexpCompile(pattern); err != nil {
+				t.Fatalf("Unexpected error compiling %q: %v", pattern, err)
+			}
+		}
+	}
+	if got := RegexpCacheStats(); got != len(patterns) {
+		t.Errorf("Expected %d entries, got %d", len(patterns), got)
+	}
+}
+
+func TestShouldShuffle(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		action      string
+		expected    bool
+	}{
+		{
+			name:        "shuffle with affinity",
+			annotations: map[string]string{sessionAffinityAnnotation: "true"},
+			action:      "shuffle",
+			expected:    false,
+		},
+		{
+			name:     "shuffle without affinity",
+			action:   "Shuffle",
+			expected: true,
+		},
+		{
+			name:        "shuffle with affinity disabled",
+			annotations: map[string]string{sessionAffinityAnnotation: "false"},
+			action:      "shuffle",
+			expected:    true,
+		},
+		{
+			name:     "default action",
+			action:   "",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Namespace: "ns1", Name: "route1", Annotations: tc.annotations}
+			for i := 0; i < 2; i++ {
+				if got := shouldShuffle(cfg, tc.action); got != tc.expected {
+					t.Errorf("Expected %v, got %v", tc.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestServerID(t *testing.T) {
+	ep1 := Endpoint{ID: "ep1", IP: "10.0.0.1", Port: "8080"}
+	ep2 := Endpoint{ID: "ep2", IP: "10.0.0.2", Port: "8080"}
+	ep3 := Endpoint{ID: "ep3", IP: "10.0.0.3", Port: "8080"}
+	ep4 := Endpoint{ID: "ep4", IP: "10.0.0.4", Port: "8080"}
+
+	testCases := []struct {
+		name     string
+		slots    map[Endpoint]int
+		expected map[string]int
+	}{
+		{
+			name:     "initial membership",
+			slots:    map[Endpoint]int{ep1: 0, ep2: 1, ep3: 2},
+			expected: map[string]int{"ep1": 1, "ep2": 2, "ep3": 3},
+		},
+		{
+			name:     "endpoint removed",
+			slots:    map[Endpoint]int{ep1: 0, ep3: 2},
+			expected: map[string]int{"ep1": 1, "ep3": 3},
+		},
+		{
+			name:     "endpoint added to a free slot",
+			slots:    map[Endpoint]int{ep1: 0, ep4: 1, ep3: 2},
+			expected: map[string]int{"ep1": 1, "ep4": 2, "ep3": 3},
+		},
+		{
+			name:     "endpoint without slot",
+			slots:    map[Endpoint]int{ep1: 0, ep2: -1},
+			expected: map[string]int{"ep1": 1, "ep2": 0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := make(map[string]int)
+			for ep, slot := range tc.slots {
+				got[ep.ID] = serverID(ep, slot)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAllowlistOverlapsCluster(t *testing.T) {
+	clusterCIDRs := []string{"10.128.0.0/14", "172.30.0.0/16", "fd01::/48"}
+
+	testCases := []struct {
+		name     string
+		value    string
+		expected bool
+	}{
+		{name: "entry within the cluster network", value: "192.168.1.0/24 10.128.4.0/24", expected: true},
+		{name: "entry containing the cluster network", value: "10.0.0.0/8", expected: true},
+		{name: "cluster IP address", value: "172.30.0.10", expected: true},
+		{name: "IPv6 entry within the cluster network", value: "fd01::10", expected: true},
+		{name: "non-overlapping entries", value: "192.168.1.0/24 10.0.0.1 2001:db8::/32", expected: false},
+		{name: "invalid entries", value: "cluster 10.128.0.0/99", expected: false},
+		{name: "empty allowlist", value: "", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := allowlistOverlapsCluster(tc.value, clusterCIDRs); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAllowlistSourceExpr(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "behind proxy",
+			annotations: map[string]string{behindProxyAnnotation: "true"},
+			expected:    "req.hdr_ip(X-Forwarded-For,-1)",
+		},
+		{
+			name:        "direct",
+			annotations: map[string]string{behindProxyAnnotation: "false"},
+			expected:    "src",
+		},
+		{
+			name:     "unset",
+			expected: "src",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := allowlistSourceExpr(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestXFFClientIPExpr(t *testing.T) {
+	testCases := []struct {
+		name     string
+		depth    int
+		expected string
+	}{
+		{name: "depth 1", depth: 1, expected: "req.hdr_ip(X-Forwarded-For,-1)"},
+		{name: "depth 2", depth: 2, expected: "req.hdr_ip(X-Forwarded-For,-2)"},
+		{name: "zero depth", depth: 0, expected: ""},
+		{name: "negative depth", depth: -1, expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := xffClientIPExpr(tc.depth); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAllowlistOrDenyAll(t *testing.T) {
+	testCases := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{
+			name:     "valid path",
+			path:     "/var/lib/haproxy/router/allowlists/ns1:route1.txt",
+			expected: "acl allowlist src -f /var/lib/haproxy/router/allowlists/ns1:route1.txt",
+		},
+		{
+			name:     "empty path",
+			expected: "acl allowlist always_false",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := allowlistOrDenyAll(tc.path); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAccessDecisionACLs(t *testing.T) {
+	const (
+		allowPath = "/var/lib/haproxy/router/allowlists/ns1:route1.txt"
+		denyPath  = "/var/lib/haproxy/router/blocklists/ns1:route1.txt"
+	)
+
+	testCases := []struct {
+		name      string
+		allowPath string
+		denyPath  string
+		expected  []string
+	}{
+		{
+			name:      "allow only",
+			allowPath: allowPath,
+			expected: []string{
+				"acl allowlist src -f " + allowPath,
+				"tcp-request content reject if !allowlist",
+			},
+		},
+		{
+			name:     "deny only",
+			denyPath: denyPath,
+			expected: []string{
+				"acl blocklist src -f " + denyPath,
+				"tcp-request content reject if blocklist",
+			},
+		},
+		{
+			name:      "both",
+			allowPath: allowPath,
+			denyPath:  denyPath,
+			expected: []string{
+				"acl allowlist src -f " + allowPath,
+				"acl blocklist src -f " + denyPath,
+				"tcp-request content reject if !allowlist",
+				"tcp-request content reject if blocklist",
+			},
+		},
+		{
+			name: "neither",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := accessDecisionACLs(tc.allowPath, tc.denyPath); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestFinTimeouts(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+	}{
+		{
+			name: "both set",
+			annotations: map[string]string{
+				timeoutClientFinAnnotation: "1s",
+				timeoutServerFinAnnotation: "2s",
+			},
+			expected: []string{"timeout client-fin 1s", "timeout server-fin 2s"},
+		},
+		{
+			name:        "one set",
+			annotations: map[string]string{timeoutServerFinAnnotation: "500ms"},
+			expected:    []string{"timeout server-fin 500ms"},
+		},
+		{
+			name:        "overflowing value",
+			annotations: map[string]string{timeoutClientFinAnnotation: "9999999999s"},
+			expected:    []string{"timeout client-fin " + templateutil.HaproxyMaxTimeout},
+		},
+		{
+			name:        "invalid value",
+			annotations: map[string]string{timeoutClientFinAnnotation: "later"},
+		},
+		{
+			name: "unset",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := finTimeouts(cfg); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestNeedsLargeHeaderBuffer(t *testing.T) {
+	testCases := []struct {
+		name            string
+		annotations     map[string]string
+		expectedBufsize int
+		expected        bool
+	}{
+		{
+			name:            "large headers",
+			annotations:     map[string]string{headerBufferSizeAnnotation: "40000"},
+			expectedBufsize: 65536,
+			expected:        true,
+		},
+		{
+			name:            "headers over the maximum",
+			annotations:     map[string]string{headerBufferSizeAnnotation: "1000000"},
+			expectedBufsize: maxBufsize,
+			expected:        true,
+		},
+		{
+			name:            "headers within the default",
+			annotations:     map[string]string{headerBufferSizeAnnotation: "8192"},
+			expectedBufsize: defaultBufsize,
+			expected:        false,
+		},
+		{
+			name:        "invalid size",
+			annotations: map[string]string{headerBufferSizeAnnotation: "big"},
+			expected:    false,
+		},
+		{
+			name:     "disabled",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := needsLargeHeaderBuffer(cfg); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+			if got := headerBufferSize(cfg); got != tc.expectedBufsize {
+				t.Errorf("Expected bufsize %d, got %d", tc.expectedBufsize, got)
+			}
+		})
+	}
+}
+
+func TestRecommendedBufsize(t *testing.T) {
+	testCases := []struct {
+		name     string
+		sizes    []string
+		expected int
+	}{
+		{
+			name:     "no routes",
+			expected: defaultBufsize,
+		},
+		{
+			name:     "routes without requirements",
+			sizes:    []string{"", ""},
+			expected: defaultBufsize,
+		},
+		{
+			name:     "varying requirements",
+			sizes:    []string{"8000", "20000", "", "40000"},
+			expected: 65536,
+		},
+		{
+			name:     "requirement over the maximum",
+			sizes:    []string{"40000", "500000"},
+			expected: maxBufsize,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := make(map[ServiceAliasConfigKey]ServiceAliasConfig)
+			for i, size := range tc.sizes {
+				cfg := ServiceAliasConfig{Annotations: map[string]string{}}
+				if len(size) > 0 {
+					cfg.Annotations[headerBufferSizeAnnotation] = size
+				}
+				state[ServiceAliasConfigKey(fmt.Sprintf("ns:route%d", i))] = cfg
+			}
+			if got := recommendedBufsize(templateData{State: state}, defaultBufsize); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeURIDirectives(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		{
+			name:  "valid set",
+			value: "percent-decode-unreserved, path-merge-slashes,path-strip-dotdot",
+			expected: []string{
+				"http-request normalize-uri percent-decode-unreserved",
+				"http-request normalize-uri path-merge-slashes",
+				"http-request normalize-uri path-strip-dotdot",
+			},
+		},
+		{
+			name:  "invalid normalization name",
+			value: "path-merge-slashes,lowercase-everything,path-merge-slashes",
+			expected: []string{
+				"http-request normalize-uri path-merge-slashes",
+			},
+		},
+		{
+			name: "disabled",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: map[string]string{}}
+			if len(tc.value) > 0 {
+				cfg.Annotations[normalizeURIAnnotation] = tc.value
+			}
+			if got := normalizeURIDirectives(cfg); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDetectNormalizationAmbiguity(t *testing.T) {
+	testCases := []struct {
+		name     string
+		aliases  map[ServiceAliasConfigKey]ServiceAliasConfig
+		expected []ServiceAliasConfigKey
+	}{
+		{
+			name: "ambiguous pair",
+			aliases: map[ServiceAliasConfigKey]ServiceAliasConfig{
+				"ns1:encoded": {Host: "www.example.com", Path: "/a%2Fb"},
+				"ns1:plain":   {Host: "www.example.com", Path: "/a/b"},
+				"ns1:other":   {Host: "www.example.com", Path: "/c"},
+			},
+			expected: []ServiceAliasConfigKey{"ns1:encoded", "ns1:plain"},
+		},
+		{
+			name: "ambiguous slashes",
+			aliases: map[ServiceAliasConfigKey]ServiceAliasConfig{
+				"ns1:double": {Host: "www.example.com", Path: "/a//b"},
+				"ns1:single": {Host: "www.example.com", Path: "/a/b"},
+			},
+			expected: []ServiceAliasConfigKey{"ns1:double", "ns1:single"},
+		},
+		{
+			name: "clear set",
+			aliases: map[ServiceAliasConfigKey]ServiceAliasConfig{
+				"ns1:a":     {Host: "www.example.com", Path: "/a/b"},
+				"ns1:b":     {Host: "www.example.com", Path: "/a/c"},
+				"ns2:a":     {Host: "api.example.com", Path: "/a%2Fb"},
+				"ns2:dup-a": {Host: "api.example.com", Path: "/a%2Fb"},
+			},
+			expected: []ServiceAliasConfigKey{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := detectNormalizationAmbiguity(tc.aliases); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCompressionOffload(t *testing.T) {
+	testCases := []struct {
+		name            string
+		annotations     map[string]string
+		expectedEnabled bool
+		expectedLevel   int
+	}{
+		{
+			name: "enabled with a level",
+			annotations: map[string]string{
+				compressionAnnotation:      "true",
+				compressionLevelAnnotation: "9",
+			},
+			expectedEnabled: true,
+			expectedLevel:   9,
+		},
+		{
+			name:            "enabled without a level",
+			annotations:     map[string]string{compressionAnnotation: "true"},
+			expectedEnabled: true,
+			expectedLevel:   defaultCompressionLevel,
+		},
+		{
+			name: "invalid level",
+			annotations: map[string]string{
+				compressionAnnotation:      "true",
+				compressionLevelAnnotation: "10",
+			},
+			expectedEnabled: true,
+			expectedLevel:   defaultCompressionLevel,
+		},
+		{
+			name: "disabled",
+			annotations: map[string]string{
+				compressionAnnotation:      "false",
+				compressionLevelAnnotation: "3",
+			},
+		},
+		{
+			name: "unset",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			enabled, level := compressionOffload(cfg)
+			if enabled != tc.expectedEnabled {
+				t.Errorf("Expected enabled to be %v, got %v", tc.expectedEnabled, enabled)
+			}
+			if level != tc.expectedLevel {
+				t.Errorf("Expected level %d, got %d", tc.expectedLevel, level)
+			}
+		})
+	}
+}
+
+func TestValidateRouteAnnotations(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+	}{
+		{
+			name: "clean route",
+			annotations: map[string]string{
+				"haproxy.router.openshift.io/ip_allowlist":         "10.0.0.1",
+				timeoutAnnotation:                                  "30s",
+				timeoutClientAnnotation:                            "1m",
+				balanceAnnotation:                                  "leastconn",
+				securityHeaderAnnotationPrefix + "x-frame-options": "SAMEORIGIN",
+				"app.kubernetes.io/name":                           "frontend",
+			},
+		},
+		{
+			name: "route with several issues",
+			annotations: map[string]string{
+				"haproxy.router.openshift.io/ip_whitelist": "10.0.0.1",
+				"haproxy.router.openshift.io/timeuot":      "30s",
+				"haproxy.router.openshift.io/made-up":      "true",
+				timeoutAnnotation:                          "1m",
+				timeoutClientAnnotation:                    "10s",
+				timeoutTunnelAnnotation:                    "soon",
+				h2MaxConcurrentStreamsAnnotation:           "5000",
+				compressionLevelAnnotation:                 "0",
+				tcpCheckPortAnnotation:                     "http",
+				balanceAnnotation:                          "leastconn",
+				sessionAffinityAnnotation:                  "true",
+				rateLimitAnnotation:                        "true",
+				rateLimitAnnotation + ".rate-http":         "100",
+			},
+			expected: []string{
+				"annotation haproxy.router.openshift.io/ip_whitelist is deprecated, use haproxy.router.openshift.io/ip_allowlist",
+				"unknown annotation haproxy.router.openshift.io/made-up",
+				"unknown annotation haproxy.router.openshift.io/timeuot, did you mean haproxy.router.openshift.io/timeout?",
+				`annotation haproxy.router.openshift.io/timeout-tunnel has invalid timeout "soon"`,
+				`annotation haproxy.router.openshift.io/h2-max-concurrent-streams value "5000" is not between 1 and 1000`,
+				`annotation haproxy.router.openshift.io/compression.level value "0" is not between 1 and 9`,
+				`annotation haproxy.router.openshift.io/tcp-check-port value "http" is not a valid port`,
+				"client timeout 10s is shorter than server timeout 1m0s",
+				"session affinity overrides balance leastconn",
+				"rate limits apply to the allowlisted sources",
+			},
+		},
+		{
+			name: "timeout over the maximum",
+			annotations: map[string]string{
+				keepAliveTimeoutAnnotation: "9999999999s",
+			},
+			expected: []string{
+				`annotation haproxy.router.openshift.io/timeout-http-keep-alive timeout "9999999999s" exceeds the maximum of ` + templateutil.HaproxyMaxTimeout,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := validateRouteAnnotations(cfg); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "", b: "", expected: 0},
+		{a: "timeout", b: "timeout", expected: 0},
+		{a: "timeuot", b: "timeout", expected: 2},
+		{a: "timeout", b: "timeouts", expected: 1},
+		{a: "balance", b: "", expected: 7},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.a+"/"+tc.b, func(t *testing.T) {
+			if got := editDistance(tc.a, tc.b); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestFormatDiagnosticsJSON(t *testing.T) {
+	testCases := []struct {
+		name     string
+		diags    []string
+		expected string
+	}{
+		{
+			name:     "empty list",
+			expected: `[]`,
+		},
+		{
+			name:     "single diagnostic",
+			diags:    []string{"unknown annotation haproxy.router.openshift.io/made-up"},
+			expected: `["unknown annotation haproxy.router.openshift.io/made-up"]`,
+		},
+		{
+			name:     "entries needing escaping",
+			diags:    []string{`annotation timeout has invalid timeout "soon"`, "line one\nline two", `back\slash`},
+			expected: `["annotation timeout has invalid timeout \"soon\"","line one\nline two","back\\slash"]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := formatDiagnosticsJSON(tc.diags); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHeaderHashExpr(t *testing.T) {
+	testCases := []struct {
+		name               string
+		annotations        map[string]string
+		expected           string
+		expectedApplicable bool
+	}{
+		{
+			name:               "valid header",
+			annotations:        map[string]string{hashHeaderAnnotation: "X-User-ID"},
+			expected:           "balance hdr(X-User-ID)\nhash-type consistent",
+			expectedApplicable: true,
+		},
+		{
+			name:        "invalid header name",
+			annotations: map[string]string{hashHeaderAnnotation: "X-User) if TRUE"},
+		},
+		{
+			name: "absent annotation",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			got, applicable := headerHashExpr(cfg)
+			if applicable != tc.expectedApplicable {
+				t.Errorf("Expected applicable to be %v, got %v", tc.expectedApplicable, applicable)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDetectBackendProtocolConflict(t *testing.T) {
+	testCases := []struct {
+		name             string
+		termination      routev1.TLSTerminationType
+		protocol         string
+		expected         string
+		expectedConflict bool
+	}{
+		{
+			name:             "h2c with reencrypt",
+			termination:      routev1.TLSTerminationReencrypt,
+			protocol:         "h2c",
+			expected:         "backend protocol h2c conflicts with reencrypt termination, which encrypts traffic to the backend",
+			expectedConflict: true,
+		},
+		{
+			name:             "h2c with passthrough",
+			termination:      routev1.TLSTerminationPassthrough,
+			protocol:         "H2C",
+			expected:         "backend protocol h2c conflicts with passthrough termination, which encrypts traffic to the backend",
+			expectedConflict: true,
+		},
+		{
+			name:        "h2 with reencrypt",
+			termination: routev1.TLSTerminationReencrypt,
+			protocol:    "h2",
+		},
+		{
+			name:        "h2c with edge",
+			termination: routev1.TLSTerminationEdge,
+			protocol:    "h2c",
+		},
+		{
+			name:        "no backend protocol",
+			termination: routev1.TLSTerminationReencrypt,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{TLSTermination: tc.termination, Annotations: map[string]string{}}
+			if len(tc.protocol) > 0 {
+				cfg.Annotations[backendProtocolAnnotation] = tc.protocol
+			}
+			got, conflict := detectBackendProtocolConflict(cfg)
+			if conflict != tc.expectedConflict {
+				t.Errorf("Expected conflict to be %v, got %v", tc.expectedConflict, conflict)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestVerifyHost(t *testing.T) {
+	testCases := []struct {
+		name        string
+		termination routev1.TLSTerminationType
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "explicit host",
+			termination: routev1.TLSTerminationReencrypt,
+			annotations: map[string]string{backendSNIAnnotation: "Backend.NS1.svc"},
+			expected:    "verifyhost backend.ns1.svc",
+		},
+		{
+			name:        "invalid explicit host",
+			termination: routev1.TLSTerminationReencrypt,
+			annotations: map[string]string{backendSNIAnnotation: "backend ssl"},
+			expected:    "verifyhost www.example.com",
+		},
+		{
+			name:        "default",
+			termination: routev1.TLSTerminationReencrypt,
+			expected:    "verifyhost www.example.com",
+		},
+		{
+			name:        "verification disabled",
+			termination: routev1.TLSTerminationReencrypt,
+			annotations: map[string]string{
+				backendSNIAnnotation:        "backend.ns1.svc",
+				verifyBackendHostAnnotation: "false",
+			},
+			expected: "",
+		},
+		{
+			name:        "edge",
+			termination: routev1.TLSTerminationEdge,
+			expected:    "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Host: "www.example.com", TLSTermination: tc.termination, Annotations: tc.annotations}
+			if got := verifyHost(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRenderFrontend(t *testing.T) {
+	t.Setenv("ROUTER_SERVICE_HTTP_PORT", "")
+	t.Setenv("ROUTER_SERVICE_HTTPS_PORT", "")
+	t.Setenv("ROUTER_INSPECT_DELAY", "")
+
+	td := templateData{
+		WorkingDir: "/var/lib/haproxy",
+		State: map[ServiceAliasConfigKey]ServiceAliasConfig{
+			"ns1:http": {
+				Name:      "http",
+				Namespace: "ns1",
+				Host:      "www.example.com",
+			},
+			"ns1:http-path": {
+				Name:      "http-path",
+				Namespace: "ns1",
+				Host:      "www.example.com",
+				Path:      "/api",
+			},
+			"ns1:edge": {
+				Name:                          "edge",
+				Namespace:                     "ns1",
+				Host:                          "edge.example.com",
+				TLSTermination:                routev1.TLSTerminationEdge,
+				InsecureEdgeTerminationPolicy: routev1.InsecureEdgeTerminationPolicyRedirect,
+			},
+			"ns1:edge-allow": {
+				Name:                          "edge-allow",
+				Namespace:                     "ns1",
+				Host:                          "allow.example.com",
+				TLSTermination:                routev1.TLSTerminationEdge,
+				InsecureEdgeTerminationPolicy: routev1.InsecureEdgeTerminationPolicyAllow,
+			},
+			"ns2:reencrypt": {
+				Name:           "reencrypt",
+				Namespace:      "ns2",
+				Host:           "secure.example.com",
+				TLSTermination: routev1.TLSTerminationReencrypt,
+			},
+			"ns2:wildcard": {
+				Name:           "wildcard",
+				Namespace:      "ns2",
+				Host:           "wild.apps.example.com",
+				IsWildcard:     true,
+				TLSTermination: routev1.TLSTerminationEdge,
+			},
+			"ns3:passthrough": {
+				Name:           "passthrough",
+				Namespace:      "ns3",
+				Host:           "db.example.com",
+				TLSTermination: routev1.TLSTerminationPassthrough,
+			},
+			"ns3:slow-passthrough": {
+				Name:           "slow-passthrough",
+				Namespace:      "ns3",
+				Host:           "slow.example.com",
+				TLSTermination: routev1.TLSTerminationPassthrough,
+				Annotations:    map[string]string{sniInspectDelayAnnotation: "10s"},
+			},
+			"ns3:wild-passthrough": {
+				Name:           "wild-passthrough",
+				Namespace:      "ns3",
+				Host:           "tls.db.example.com",
+				IsWildcard:     true,
+				TLSTermination: routev1.TLSTerminationPassthrough,
+			},
+			"ns3:unmatchable": {
+				Name:      "unmatchable",
+				Namespace: "ns3",
+			},
+		},
+	}
+
+	golden, err := ioutil.ReadFile(path.Join("testdata", "render_frontend.golden"))
+	if err != nil {
+		t.Fatalf("Unable to read golden file: %v", err)
+	}
+	if got := renderFrontend(td); got != string(golden) {
+		t.Errorf("Expected:\n%s\ngot:\n%s", golden, got)
+	}
+}
+
+func TestOrderUseBackendRules(t *testing.T) {
+	aliases := map[ServiceAliasConfigKey]ServiceAliasConfig{
+		"ns:b-root":        {Host: "b.example.com"},
+		"ns:a-api":         {Host: "a.example.com", Path: "/api"},
+		"ns:b-api":         {Host: "b.example.com", Path: "/api"},
+		"ns:a-root":        {Host: "a.example.com"},
+		"ns:b-api-v1":      {Host: "b.example.com", Path: "/api/v1"},
+		"ns:wildcard":      {Host: "x.example.com", IsWildcard: true},
+		"ns:wildcard-api":  {Host: "x.example.com", Path: "/api", IsWildcard: true},
+		"ns:deep":          {Host: "a.b.example.com"},
+		"ns:a-api-dup":     {Host: "A.example.com", Path: "/api/"},
+		"ns:path-only":     {Path: "/health"},
+		"ns:wildcard-deep": {Host: "x.b.example.com", IsWildcard: true},
+	}
+
+	expected := []ServiceAliasConfigKey{
+		"ns:deep",
+		"ns:wildcard-deep",
+		"ns:a-api",
+		"ns:a-api-dup",
+		"ns:a-root",
+		"ns:b-api-v1",
+		"ns:b-api",
+		"ns:b-root",
+		"ns:wildcard-api",
+		"ns:wildcard",
+		"ns:path-only",
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := orderUseBackendRules(aliases); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	}
+
+	if got := orderUseBackendRules(nil); len(got) != 0 {
+		t.Errorf("Expected no keys for empty aliases, got %v", got)
+	}
+}
+
+func TestIsRoutableEndpoint(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ip       string
+		expected bool
+	}{
+		{
+			name:     "ipv4 loopback",
+			ip:       "127.0.0.1",
+			expected: false,
+		},
+		{
+			name:     "ipv4 loopback range",
+			ip:       "127.10.20.30",
+			expected: false,
+		},
+		{
+			name:     "ipv6 loopback",
+			ip:       "::1",
+			expected: false,
+		},
+		{
+			name:     "ipv4 link-local",
+			ip:       "169.254.169.254",
+			expected: false,
+		},
+		{
+			name:     "ipv6 link-local",
+			ip:       "fe80::1",
+			expected: false,
+		},
+		{
+			name:     "ipv4 address",
+			ip:       "10.128.0.15",
+			expected: true,
+		},
+		{
+			name:     "ipv6 address",
+			ip:       "fd01::2",
+			expected: true,
+		},
+		{
+			name:     "unparseable address",
+			ip:       "not-an-ip",
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isRoutableEndpoint(Endpoint{ID: "ept:test", IP: tc.ip}); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRouteFingerprint(t *testing.T) {
+	cfg := ServiceAliasConfig{
+		Name:         "route",
+		Namespace:    "ns",
+		Host:         "www.example.com",
+		Certificates: map[string]Certificate{"ns:route": {ID: "ns:route", Contents: "cert"}},
+	}
+	eps := []Endpoint{{ID: "ept:a", IP: "10.0.0.1", Port: "8080"}, {ID: "ept:b", IP: "10.0.0.2", Port: "8080"}}
+	base := parseRouteFingerprint(routeFingerprint(cfg, eps))
+
+	reordered := parseRouteFingerprint(routeFingerprint(cfg, []Endpoint{eps[1], eps[0]}))
+	if !reflect.DeepEqual(base, reordered) {
+		t.Errorf("Expected endpoint order to not change the fingerprint, got %v and %v", base, reordered)
+	}
+
+	saved := cfg
+	saved.Status = ServiceAliasConfigStatusSaved
+	if got := parseRouteFingerprint(routeFingerprint(saved, eps)); !reflect.DeepEqual(base, got) {
+		t.Errorf("Expected status to not change the fingerprint, got %v and %v", base, got)
+	}
+
+	recerted := cfg
+	recerted.Certificates = map[string]Certificate{"ns:route": {ID: "ns:route", Contents: "new cert"}}
+	got := parseRouteFingerprint(routeFingerprint(recerted, eps))
+	if got["config"] != base["config"] || got["endpoints"] != base["endpoints"] || got["certs"] == base["certs"] {
+		t.Errorf("Expected only the certs part to change, got %v and %v", base, got)
+	}
+
+	got = parseRouteFingerprint(routeFingerprint(cfg, eps[:1]))
+	if got["config"] != base["config"] || got["certs"] != base["certs"] || got["endpoints"] == base["endpoints"] {
+		t.Errorf("Expected only the endpoints part to change, got %v and %v", base, got)
+	}
+
+	scaled := cfg
+	scaled.ServiceUnitNames = map[ServiceUnitKey]int32{"ns/svc": 256}
+	scaled.ActiveServiceUnits = 1
+	scaled.ActiveEndpoints = 1
+	got = parseRouteFingerprint(routeFingerprint(scaled, eps[:1]))
+	if got["config"] != base["config"] || got["certs"] != base["certs"] || got["endpoints"] == base["endpoints"] {
+		t.Errorf("Expected recomputed weights and counts to only change the endpoints part, got %v and %v", base, got)
+	}
+}
+
+func TestReloadReason(t *testing.T) {
+	fingerprint := func(config, certs, endpoints string) string {
+		return fmt.Sprintf("config=%s certs=%s endpoints=%s", config, certs, endpoints)
+	}
+
+	testCases := []struct {
+		name     string
+		prev     map[ServiceAliasConfigKey]string
+		curr     map[ServiceAliasConfigKey]string
+		expected string
+	}{
+		{
+			name:     "no changes",
+			prev:     map[ServiceAliasConfigKey]string{"ns:a": fingerprint("1", "1", "1")},
+			curr:     map[ServiceAliasConfigKey]string{"ns:a": fingerprint("1", "1", "1")},
+			expected: "no changes",
+		},
+		{
+			name: "additions",
+			prev: map[ServiceAliasConfigKey]string{"ns:a": fingerprint("1", "1", "1")},
+			curr: map[ServiceAliasConfigKey]string{
+				"ns:a": fingerprint("1", "1", "1"),
+				"ns:b": fingerprint("2", "2", "2"),
+				"ns:c": fingerprint("3", "3", "3"),
+				"ns:d": fingerprint("4", "4", "4"),
+			},
+			expected: "3 routes added",
+		},
+		{
+			name: "removals",
+			prev: map[ServiceAliasConfigKey]string{
+				"ns:a": fingerprint("1", "1", "1"),
+				"ns:b": fingerprint("2", "2", "2"),
+			},
+			curr:     map[ServiceAliasConfigKey]string{"ns:a": fingerprint("1", "1", "1")},
+			expected: "1 route removed",
+		},
+		{
+			name: "mixed changes",
+			prev: map[ServiceAliasConfigKey]string{
+				"ns:a": fingerprint("1", "1", "1"),
+				"ns:b": fingerprint("2", "2", "2"),
+				"ns:c": fingerprint("3", "3", "3"),
+				"ns:d": fingerprint("4", "4", "4"),
+			},
+			curr: map[ServiceAliasConfigKey]string{
+				"ns:a": fingerprint("1", "9", "1"),
+				"ns:b": fingerprint("2", "2", "9"),
+				"ns:c": fingerprint("3", "3", "9"),
+				"ns:e": fingerprint("5", "5", "5"),
+			},
+			expected: "1 route added, 1 route removed, 1 cert changed, 2 endpoints changed",
+		},
+		{
+			name:     "route configuration changed",
+			prev:     map[ServiceAliasConfigKey]string{"ns:a": fingerprint("1", "1", "1")},
+			curr:     map[ServiceAliasConfigKey]string{"ns:a": fingerprint("2", "1", "1")},
+			expected: "1 route changed",
+		},
+		{
+			name:     "opaque fingerprints",
+			prev:     map[ServiceAliasConfigKey]string{"ns:a": "abc", "ns:b": "def"},
+			curr:     map[ServiceAliasConfigKey]string{"ns:a": "xyz", "ns:b": "uvw"},
+			expected: "2 routes changed",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := reloadReason(tc.prev, tc.curr); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestShouldUseRuntimeAPI(t *testing.T) {
+	testCases := []struct {
+		name     string
+		changes  map[ServiceAliasConfigKey]string
+		expected bool
+	}{
+		{
+			name: "all endpoint changes",
+			changes: map[ServiceAliasConfigKey]string{
+				"ns:a": changeKindEndpoints,
+				"ns:b": changeKindEndpoints,
+				"ns:c": changeKindEndpoints,
+			},
+			expected: true,
+		},
+		{
+			name: "endpoint changes and unchanged routes",
+			changes: map[ServiceAliasConfigKey]string{
+				"ns:a": changeKindEndpoints,
+				"ns:b": changeKindNone,
+			},
+			expected: true,
+		},
+		{
+			name: "mixed changes",
+			changes: map[ServiceAliasConfigKey]string{
+				"ns:a": changeKindEndpoints,
+				"ns:b": changeKindStructural,
+			},
+			expected: false,
+		},
+		{
+			name: "structural changes",
+			changes: map[ServiceAliasConfigKey]string{
+				"ns:a": changeKindStructural,
+			},
+			expected: false,
+		},
+		{
+			name:     "unknown change kind",
+			changes:  map[ServiceAliasConfigKey]string{"ns:a": "certificate"},
+			expected: false,
+		},
+		{
+			name:     "no changes",
+			changes:  map[ServiceAliasConfigKey]string{"ns:a": changeKindNone},
+			expected: false,
+		},
+		{
+			name:     "empty",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := shouldUseRuntimeAPI(tc.changes); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestBindLines(t *testing.T) {
+	manyPorts := make([]int, 0, maxBindLines+4)
+	for i := 0; i < maxBindLines+4; i++ {
+		manyPorts = append(manyPorts, 8000+i)
+	}
+
+	testCases := []struct {
+		name     string
+		ports    []int
+		opts     string
+		expected []string
+	}{
+		{
+			name:     "multiple ports",
+			ports:    []int{80, 8080},
+			expected: []string{"bind :80", "bind :8080"},
+		},
+		{
+			name:     "multiple ports with options",
+			ports:    []int{443, 8443},
+			opts:     " accept-proxy ",
+			expected: []string{"bind :443 accept-proxy", "bind :8443 accept-proxy"},
+		},
+		{
+			name:     "duplicate ports",
+			ports:    []int{8080, 80, 8080, 80},
+			expected: []string{"bind :8080", "bind :80"},
+		},
+		{
+			name:     "invalid ports",
+			ports:    []int{0, -1, 80, 65536},
+			expected: []string{"bind :80"},
+		},
+		{
+			name:     "over the cap",
+			ports:    manyPorts,
+			expected: bindLines(manyPorts[:maxBindLines], ""),
+		},
+		{
+			name: "no ports",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := bindLines(tc.ports, tc.opts)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+			if len(got) > maxBindLines {
+				t.Errorf("Expected at most %d bind lines, got %d", maxBindLines, len(got))
+			}
+		})
+	}
+}
+
+func TestMatchesDefaultWildcard(t *testing.T) {
+	testCases := []struct {
+		name          string
+		host          string
+		wildcard      bool
+		defaultDomain string
+		expected      bool
+	}{
+		{
+			name:          "shadowing host",
+			host:          "www.apps.example.com",
+			wildcard:      true,
+			defaultDomain: "apps.example.com",
+			expected:      true,
+		},
+		{
+			name:          "shadowing host with wildcard default domain",
+			host:          "www.APPS.example.com.",
+			wildcard:      true,
+			defaultDomain: "*.apps.example.com",
+			expected:      true,
+		},
+		{
+			name:          "parent domain wildcard",
+			host:          "www.example.com",
+			wildcard:      true,
+			defaultDomain: "apps.example.com",
+			expected:      false,
+		},
+		{
+			name:          "sibling domain",
+			host:          "www.apps2.example.com",
+			wildcard:      true,
+			defaultDomain: "apps.example.com",
+			expected:      false,
+		},
+		{
+			name:          "subdomain wildcard",
+			host:          "www.team.apps.example.com",
+			wildcard:      true,
+			defaultDomain: "apps.example.com",
+			expected:      false,
+		},
+		{
+			name:          "route under the default domain",
+			host:          "www.apps.example.com",
+			defaultDomain: "apps.example.com",
+			expected:      false,
+		},
+		{
+			name:          "unrelated host",
+			host:          "www.example.org",
+			wildcard:      true,
+			defaultDomain: "apps.example.com",
+			expected:      false,
+		},
+		{
+			name:          "no default domain",
+			host:          "www.example.com",
+			wildcard:      true,
+			defaultDomain: "",
+			expected:      false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Host: tc.host, IsWildcard: tc.wildcard}
+			if got := matchesDefaultWildcard(cfg, tc.defaultDomain); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "valid value",
+			annotations: map[string]string{keepAliveTimeoutAnnotation: "30s"},
+			expected:    "30s",
+		},
+		{
+			name:        "overflowing value is clipped",
+			annotations: map[string]string{keepAliveTimeoutAnnotation: "9999999999999999d"},
+			expected:    templateutil.HaproxyMaxTimeout,
+		},
+		{
+			name:        "invalid value",
+			annotations: map[string]string{keepAliveTimeoutAnnotation: "forever"},
+			expected:    "300s",
+		},
+		{
+			name:     "absent annotation",
+			expected: "300s",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := keepAliveTimeout(cfg, "300s"); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTCPBlocklistReject(t *testing.T) {
+	testCases := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{
+			name:     "blocklist file",
+			path:     "/var/lib/haproxy/router/blocklists/ns:route.txt",
+			expected: "tcp-request connection reject if { src -f /var/lib/haproxy/router/blocklists/ns:route.txt }",
+		},
+		{
+			name:     "no blocklist file",
+			path:     "",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tcpBlocklistReject(tc.path); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAllowlistACL(t *testing.T) {
+	var ips []string
+	for i := 0; i <= haproxyutil.HAPROXY_MAX_ALLOWLIST_LENGTH; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.0.%d", i))
+	}
+	long := strings.Join(ips, " ")
+
+	testCases := []struct {
+		name        string
+		termination routev1.TLSTerminationType
+		annotations map[string]string
+		path        string
+		expected    string
+	}{
+		{
+			name:        "passthrough route with inline allowlist",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{"haproxy.router.openshift.io/ip_allowlist": "10.0.0.0/8 192.168.1.1"},
+			expected:    "acl allowlist src 10.0.0.0/8 192.168.1.1\ntcp-request content reject if !allowlist",
+		},
+		{
+			name:        "passthrough route with allowlist file",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{"haproxy.router.openshift.io/ip_allowlist": long},
+			path:        "/var/lib/haproxy/router/allowlists/ns:route.txt",
+			expected:    "acl allowlist src -f /var/lib/haproxy/router/allowlists/ns:route.txt\ntcp-request content reject if !allowlist",
+		},
+		{
+			name:        "passthrough route behind proxy still filters on source",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{"haproxy.router.openshift.io/ip_allowlist": long, behindProxyAnnotation: "true"},
+			path:        "/var/lib/haproxy/router/allowlists/ns:route.txt",
+			expected:    "acl allowlist src -f /var/lib/haproxy/router/allowlists/ns:route.txt\ntcp-request content reject if !allowlist",
+		},
+		{
+			name:        "http route with inline allowlist",
+			annotations: map[string]string{"haproxy.router.openshift.io/ip_allowlist": "10.0.0.0/8"},
+			expected:    "acl allowlist src 10.0.0.0/8\nhttp-request deny if !allowlist",
+		},
+		{
+			name:        "http route with allowlist file",
+			annotations: map[string]string{"haproxy.router.openshift.io/ip_allowlist": long},
+			path:        "/var/lib/haproxy/router/allowlists/ns:route.txt",
+			expected:    "acl allowlist src -f /var/lib/haproxy/router/allowlists/ns:route.txt\nhttp-request deny if !allowlist",
+		},
+		{
+			name:        "edge route with deprecated inline allowlist behind proxy",
+			termination: routev1.TLSTerminationEdge,
+			annotations: map[string]string{"haproxy.router.openshift.io/ip_whitelist": "10.0.0.0/8", behindProxyAnnotation: "true"},
+			expected:    "acl allowlist req.hdr_ip(X-Forwarded-For,-1) 10.0.0.0/8\nhttp-request deny if !allowlist",
+		},
+		{
+			name:        "edge route with allowlist file behind proxy",
+			termination: routev1.TLSTerminationEdge,
+			annotations: map[string]string{"haproxy.router.openshift.io/ip_allowlist": long, behindProxyAnnotation: "true"},
+			path:        "/var/lib/haproxy/router/allowlists/ns:route.txt",
+			expected:    "acl allowlist req.hdr_ip(X-Forwarded-For,-1) -f /var/lib/haproxy/router/allowlists/ns:route.txt\nhttp-request deny if !allowlist",
+		},
+		{
+			name:        "missing allowlist file denies all",
+			annotations: map[string]string{"haproxy.router.openshift.io/ip_allowlist": long},
+			expected:    "acl allowlist always_false\nhttp-request deny if !allowlist",
+		},
+		{
+			name:     "no allowlist",
+			path:     "/var/lib/haproxy/router/allowlists/ns:route.txt",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{TLSTermination: tc.termination, Annotations: tc.annotations}
+			if got := allowlistACL(cfg, tc.path); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDetectBindConflicts(t *testing.T) {
+	testCases := []struct {
+		name     string
+		binds    []string
+		expected []string
+	}{
+		{
+			name:     "same port",
+			binds:    []string{"bind :80", "bind :443 ssl crt /etc/default.pem", "bind :80 accept-proxy"},
+			expected: []string{"bind :80 accept-proxy"},
+		},
+		{
+			name:     "wildcard address and specific address on the same port",
+			binds:    []string{"10.0.0.1:8080", ":8080"},
+			expected: []string{":8080"},
+		},
+		{
+			name:     "same unix socket",
+			binds:    []string{"bind unix@/var/lib/haproxy/run/haproxy-sni.sock ssl", "bind unix@/var/lib/haproxy/run/haproxy-sni.sock"},
+			expected: []string{"bind unix@/var/lib/haproxy/run/haproxy-sni.sock"},
+		},
+		{
+			name:  "conflict free",
+			binds: []string{"bind :80", "bind :443", "bind 10.0.0.1:8080", "bind 10.0.0.2:8080", "bind [::1]:8080", "bind unix@/var/lib/haproxy/run/haproxy-sni.sock"},
+		},
+		{
+			name: "no binds",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := detectBindConflicts(tc.binds); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestShouldBindIPv6(t *testing.T) {
+	testCases := []struct {
+		name     string
+		env      string
+		expected bool
+	}{
+		{
+			name:     "dual stack",
+			env:      "v4v6",
+			expected: true,
+		},
+		{
+			name:     "ipv6 only",
+			env:      "v6",
+			expected: true,
+		},
+		{
+			name:     "ipv4 only",
+			env:      "v4",
+			expected: false,
+		},
+		{
+			name:     "unset",
+			env:      "",
+			expected: false,
+		},
+		{
+			name:     "loosely formatted value",
+			env:      " V6 ",
+			expected: false,
+		},
+		{
+			name:     "unknown value",
+			env:      "true",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := shouldBindIPv6(tc.env); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestStatsAuthConfig(t *testing.T) {
+	testCases := []struct {
+		name     string
+		user     string
+		password string
+		expected []string
+	}{
+		{
+			name:     "configured auth",
+			user:     "admin",
+			password: "secret",
+			expected: []string{`stats realm Haproxy\ Statistics`, "stats auth admin:secret"},
+		},
+		{
+			name:     "no user",
+			password: "secret",
+		},
+		{
+			name: "no password",
+			user: "admin",
+		},
+		{
+			name:     "user with colon",
+			user:     "ad:min",
+			password: "secret",
+		},
+		{
+			name:     "user with white space",
+			user:     "ad min",
+			password: "secret",
+		},
+		{
+			name:     "user with newline",
+			user:     "admin\nstats admin if TRUE",
+			password: "secret",
+		},
+		{
+			name:     "password with colon",
+			user:     "admin",
+			password: "sec:ret",
+			expected: []string{`stats realm Haproxy\ Statistics`, "stats auth admin:sec:ret"},
+		},
+		{
+			name:     "password with white space",
+			user:     "admin",
+			password: "sec ret",
+		},
+		{
+			name:     "password with newline",
+			user:     "admin",
+			password: "secret\n  stats admin if TRUE",
+		},
+		{
+			name: "unconfigured",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := statsAuthConfig(tc.user, tc.password); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestStatsAllowlistACL(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{
+			name:     "valid list",
+			value:    " 10.0.0.0/8  192.168.1.10 fd00::/8 ",
+			expected: "http-request deny unless { src 10.0.0.0/8 192.168.1.10 fd00::/8 }",
+		},
+		{
+			name:     "invalid list",
+			value:    "10.0.0.0/8 10.0.0.300",
+			expected: "http-request deny",
+		},
+		{
+			name:     "invalid cidr",
+			value:    "10.0.0.0/33",
+			expected: "http-request deny",
+		},
+		{
+			name:     "empty input",
+			value:    "",
+			expected: "",
+		},
+		{
+			name:     "blank input",
+			value:    "  ",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := statsAllowlistACL(tc.value); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestGlobalMaxConnRate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		env      string
+		expected int
+	}{
+		{
+			name:     "valid override",
+			env:      "500",
+			expected: 500,
+		},
+		{
+			name:     "non numeric override",
+			env:      "lots",
+			expected: 1000,
+		},
+		{
+			name:     "zero override",
+			env:      "0",
+			expected: 1000,
+		},
+		{
+			name:     "negative override",
+			env:      "-5",
+			expected: 1000,
+		},
+		{
+			name:     "unset",
+			expected: 1000,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := globalMaxConnRate(tc.env, 1000); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHTTP3Eligible(t *testing.T) {
+	optIn := map[string]string{http3Annotation: "true"}
+
+	testCases := []struct {
+		name         string
+		termination  routev1.TLSTerminationType
+		annotations  map[string]string
+		disableHTTP2 bool
+		expected     bool
+	}{
+		{
+			name:        "edge route opting in",
+			termination: routev1.TLSTerminationEdge,
+			annotations: optIn,
+			expected:    true,
+		},
+		{
+			name:        "reencrypt route opting in",
+			termination: routev1.TLSTerminationReencrypt,
+			annotations: optIn,
+			expected:    true,
+		},
+		{
+			name:         "http2 disabled",
+			termination:  routev1.TLSTerminationEdge,
+			annotations:  optIn,
+			disableHTTP2: true,
+			expected:     false,
+		},
+		{
+			name:        "not opting in",
+			termination: routev1.TLSTerminationEdge,
+			annotations: map[string]string{http3Annotation: "false"},
+			expected:    false,
+		},
+		{
+			name:        "passthrough route",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: optIn,
+			expected:    false,
+		},
+		{
+			name:        "insecure route",
+			annotations: optIn,
+			expected:    false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{TLSTermination: tc.termination, Annotations: tc.annotations}
+			td := templateData{DisableHTTP2: tc.disableHTTP2}
+			if got := http3Eligible(cfg, td); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAltSvcHeader(t *testing.T) {
+	testCases := []struct {
+		name     string
+		port     int
+		expected string
+	}{
+		{
+			name:     "valid port",
+			port:     443,
+			expected: `http-response set-header Alt-Svc "h3=\":443\"; ma=86400"`,
+		},
+		{
+			name:     "zero port",
+			port:     0,
+			expected: "",
+		},
+		{
+			name:     "out of range port",
+			port:     70000,
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := altSvcHeader(tc.port); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDSCPMarking(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "valid value",
+			annotations: map[string]string{dscpAnnotation: "46"},
+			expected:    "http-request set-tos 184",
+		},
+		{
+			name:        "lowest value",
+			annotations: map[string]string{dscpAnnotation: "0"},
+			expected:    "http-request set-tos 0",
+		},
+		{
+			name:        "out of range value",
+			annotations: map[string]string{dscpAnnotation: "64"},
+			expected:    "",
+		},
+		{
+			name:        "negative value",
+			annotations: map[string]string{dscpAnnotation: "-1"},
+			expected:    "",
+		},
+		{
+			name:        "non numeric value",
+			annotations: map[string]string{dscpAnnotation: "EF"},
+			expected:    "",
+		},
+		{
+			name:     "absent annotation",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := dscpMarking(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestConsolidateBackends(t *testing.T) {
+	units := map[ServiceUnitKey]int32{"ns/svc": 100}
+	otherUnits := map[ServiceUnitKey]int32{"ns/other": 100}
+
+	td := templateData{
+		State: map[ServiceAliasConfigKey]ServiceAliasConfig{
+			"ns:a": {Host: "a.example.com", ServiceUnits: units},
+			"ns:b": {Host: "b.example.com", ServiceUnits: units},
+			"ns:c": {Host: "c.example.com", ServiceUnits: otherUnits},
+			"ns:d": {Host: "d.example.com", ServiceUnits: units, TLSTermination: routev1.TLSTerminationEdge},
+			"ns:e": {Host: "e.example.com", ServiceUnits: units, TLSTermination: routev1.TLSTerminationEdge},
+			"ns:f": {Host: "f.example.com", ServiceUnits: units, Annotations: map[string]string{"haproxy.router.openshift.io/balance": "leastconn"}},
+			"ns:g": {
+				Host:           "g.example.com",
+				ServiceUnits:   units,
+				TLSTermination: routev1.TLSTerminationReencrypt,
+				Certificates:   map[string]Certificate{"g.example.com" + destCertPostfix: {ID: "ns:g", Contents: "ca-1"}},
+			},
+			"ns:h": {
+				Host:           "h.example.com",
+				ServiceUnits:   units,
+				TLSTermination: routev1.TLSTerminationReencrypt,
+				Certificates:   map[string]Certificate{"h.example.com" + destCertPostfix: {ID: "ns:h", Contents: "ca-2"}},
+			},
+		},
+	}
+
+	groups := consolidateBackends(td)
+
+	var got [][]ServiceAliasConfigKey
+	for _, keys := range groups {
+		got = append(got, keys)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i][0] < got[j][0] })
+
+	expected := [][]ServiceAliasConfigKey{
+		{"ns:a", "ns:b"},
+		{"ns:c"},
+		{"ns:d", "ns:e"},
+		{"ns:f"},
+		{"ns:g"},
+		{"ns:h"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	for fingerprint, keys := range groups {
+		if want := backendFingerprint(td.State[keys[0]]); fingerprint != want {
+			t.Errorf("Expected group %v to be keyed by %q, got %q", keys, want, fingerprint)
+		}
+	}
+
+	if got := consolidateBackends(templateData{}); len(got) != 0 {
+		t.Errorf("Expected no groups, got %v", got)
+	}
+}
+
+func TestBackendFingerprintRenderedFields(t *testing.T) {
+	base := ServiceAliasConfig{
+		Host:           "a.example.com",
+		ServiceUnits:   map[ServiceUnitKey]int32{"ns/svc": 100},
+		TLSTermination: routev1.TLSTerminationReencrypt,
+		RoutingKeyName: "key-a",
+		Certificates:   map[string]Certificate{"a.example.com" + destCertPostfix: {ID: "ns:a", Contents: "ca"}},
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(cfg *ServiceAliasConfig)
+	}{
+		{
+			name:   "path",
+			modify: func(cfg *ServiceAliasConfig) { cfg.Path = "/other" },
+		},
+		{
+			name:   "routing key",
+			modify: func(cfg *ServiceAliasConfig) { cfg.RoutingKeyName = "key-b" },
+		},
+		{
+			name: "insecure edge termination policy",
+			modify: func(cfg *ServiceAliasConfig) {
+				cfg.InsecureEdgeTerminationPolicy = routev1.InsecureEdgeTerminationPolicyAllow
+			},
+		},
+		{
+			name: "request headers",
+			modify: func(cfg *ServiceAliasConfig) {
+				cfg.HTTPRequestHeaders = []HTTPHeader{{Name: "X-Test", Value: "'a'", Action: "Set"}}
+			},
+		},
+		{
+			name: "response headers",
+			modify: func(cfg *ServiceAliasConfig) {
+				cfg.HTTPResponseHeaders = []HTTPHeader{{Name: "X-Test", Action: "Delete"}}
+			},
+		},
+		{
+			name: "destination CA file",
+			modify: func(cfg *ServiceAliasConfig) {
+				cfg.Certificates = map[string]Certificate{"a.example.com" + destCertPostfix: {ID: "ns:b", Contents: "ca"}}
+			},
+		},
+	}
+
+	fingerprint := backendFingerprint(base)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := base
+			tc.modify(&cfg)
+			if got := backendFingerprint(cfg); got == fingerprint {
+				t.Errorf("Expected the fingerprint to change, got %q for both", got)
+			}
+		})
+	}
+}
+
+func TestSharedBackendName(t *testing.T) {
+	units := map[ServiceAliasConfigKey]ServiceAliasConfig{
+		"ns:a": {ServiceUnits: map[ServiceUnitKey]int32{"ns/a": 100}},
+		"ns:b": {ServiceUnits: map[ServiceUnitKey]int32{"ns/b": 100}},
+		"ns:c": {ServiceUnits: map[ServiceUnitKey]int32{"ns/a": 100}, TLSTermination: routev1.TLSTerminationEdge},
+	}
+	fingerprints := []string{"", "abc", "abd"}
+	for _, cfg := range units {
+		fingerprints = append(fingerprints, backendFingerprint(cfg))
+	}
+
+	names := map[string]string{}
+	for _, fingerprint := range fingerprints {
+		name := sharedBackendName(fingerprint)
+		if again := sharedBackendName(fingerprint); again != name {
+			t.Errorf("Expected a stable name for %q, got %q and %q", fingerprint, name, again)
+		}
+		if !strings.HasPrefix(name, "be_shared:") {
+			t.Errorf("Expected name %q to start with be_shared:", name)
+		}
+		if other, ok := names[name]; ok {
+			t.Errorf("Expected distinct names for %q and %q, got %q", other, fingerprint, name)
+		}
+		names[name] = fingerprint
+	}
+}
+
+func TestDisableForwardedHeaders(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    bool
+	}{
+		{
+			name:        "enabled",
+			annotations: map[string]string{disableForwardedHeadersAnnotation: "true"},
+			expected:    true,
+		},
+		{
+			name:        "disabled",
+			annotations: map[string]string{disableForwardedHeadersAnnotation: "false"},
+			expected:    false,
+		},
+		{
+			name:        "invalid value",
+			annotations: map[string]string{disableForwardedHeadersAnnotation: "yes please"},
+			expected:    false,
+		},
+		{
+			name:     "default",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := disableForwardedHeaders(cfg); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "valid prefix",
+			annotations: map[string]string{stripPrefixAnnotation: "/api"},
+			expected:    `http-request replace-path ^/api(/|$)(.*)$ '/\2'`,
+		},
+		{
+			name:        "valid prefix with trailing slash",
+			annotations: map[string]string{stripPrefixAnnotation: "/api/v1.2/"},
+			expected:    `http-request replace-path ^/api/v1\.2(/|$)(.*)$ '/\2'`,
+		},
+		{
+			name:        "traversal attempt",
+			annotations: map[string]string{stripPrefixAnnotation: "/api/../admin"},
+			expected:    "",
+		},
+		{
+			name:        "encoded traversal attempt",
+			annotations: map[string]string{stripPrefixAnnotation: "/api/%2e%2e/admin"},
+			expected:    "",
+		},
+		{
+			name:        "regular expression",
+			annotations: map[string]string{stripPrefixAnnotation: "/api(.*)"},
+			expected:    "",
+		},
+		{
+			name:        "relative prefix",
+			annotations: map[string]string{stripPrefixAnnotation: "api"},
+			expected:    "",
+		},
+		{
+			name:        "root prefix",
+			annotations: map[string]string{stripPrefixAnnotation: "/"},
+			expected:    "",
+		},
+		{
+			name:     "absent annotation",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Annotations: tc.annotations}
+			if got := stripPathPrefix(cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestEffectiveEndpoints(t *testing.T) {
+	http1 := Endpoint{ID: "ept:a:http", IP: "10.0.0.1", Port: "8080", PortName: "http"}
+	https1 := Endpoint{ID: "ept:a:https", IP: "10.0.0.1", Port: "8443", PortName: "https"}
+	http2 := Endpoint{ID: "ept:b:http", IP: "10.0.0.2", Port: "8080", PortName: "http"}
+	loopback := Endpoint{ID: "ept:c:http", IP: "127.0.0.1", Port: "8080", PortName: "http"}
+	linkLocal := Endpoint{ID: "ept:d:http", IP: "fe80::1", Port: "8080", PortName: "http"}
+	duplicate := Endpoint{ID: "ept:e:http", IP: "10.0.0.1", Port: "8080", PortName: "http"}
+
+	testCases := []struct {
+		name       string
+		preferPort string
+		endpoints  []Endpoint
+		expected   []Endpoint
+	}{
+		{
+			name:      "no filtering needed",
+			endpoints: []Endpoint{http1, https1, http2},
+			expected:  []Endpoint{http1, https1, http2},
+		},
+		{
+			name:       "prefer port by name",
+			preferPort: "https",
+			endpoints:  []Endpoint{http1, https1, http2},
+			expected:   []Endpoint{https1},
+		},
+		{
+			name:       "prefer port by number",
+			preferPort: "8080",
+			endpoints:  []Endpoint{http1, https1, http2},
+			expected:   []Endpoint{http1, http2},
+		},
+		{
+			name:      "unroutable endpoints",
+			endpoints: []Endpoint{loopback, http1, linkLocal},
+			expected:  []Endpoint{http1},
+		},
+		{
+			name:      "duplicate endpoints",
+			endpoints: []Endpoint{http1, duplicate, http2},
+			expected:  []Endpoint{http1, http2},
+		},
+		{
+			name:       "all filters",
+			preferPort: "http",
+			endpoints:  []Endpoint{loopback, https1, http1, duplicate, linkLocal, http2},
+			expected:   []Endpoint{http1, http2},
+		},
+		{
+			name:       "nothing left",
+			preferPort: "http",
+			endpoints:  []Endpoint{loopback, https1},
+			expected:   []Endpoint{},
+		},
+		{
+			name:     "no endpoints",
+			expected: []Endpoint{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			table := append([]Endpoint(nil), tc.endpoints...)
+			alias := ServiceAliasConfig{Name: "route", Namespace: "ns", PreferPort: tc.preferPort}
+			svc := ServiceUnit{Name: "ns/svc", EndpointTable: table}
+
+			if got := effectiveEndpoints(alias, svc); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+			if !reflect.DeepEqual(table, append([]Endpoint(nil), tc.endpoints...)) {
+				t.Errorf("Expected the endpoint table to be left unchanged, got %v", table)
+			}
+		})
+	}
+}
+
+func TestDescribeEndpointFiltering(t *testing.T) {
+	http1 := Endpoint{ID: "ept:a:http", IP: "10.0.0.1", Port: "8080", PortName: "http"}
+	https1 := Endpoint{ID: "ept:a:https", IP: "10.0.0.1", Port: "8443", PortName: "https"}
+	http2 := Endpoint{ID: "ept:b:http", IP: "10.0.0.2", Port: "8080", PortName: "http"}
+	loopback := Endpoint{ID: "ept:c:http", IP: "127.0.0.1", Port: "8080", PortName: "http"}
+	duplicate := Endpoint{ID: "ept:e:http", IP: "10.0.0.1", Port: "8080", PortName: "http"}
+
+	testCases := []struct {
+		name       string
+		preferPort string
+		endpoints  []Endpoint
+		expected   []string
+	}{
+		{
+			name:      "nothing dropped",
+			endpoints: []Endpoint{http1, http2},
+			expected: []string{
+				"table: 2 endpoints",
+				"preferPort: kept 2, dropped 0",
+				"routable: kept 2, dropped 0",
+				"dedupe: kept 2, dropped 0",
+			},
+		},
+		{
+			name:       "each stage drops endpoints",
+			preferPort: "http",
+			endpoints:  []Endpoint{loopback, https1, http1, duplicate, http2},
+			expected: []string{
+				"table: 5 endpoints",
+				"preferPort: kept 4, dropped 1 (ept:a:https)",
+				"routable: kept 3, dropped 1 (ept:c:http)",
+				"dedupe: kept 2, dropped 1 (ept:e:http)",
+			},
+		},
+		{
+			name: "no endpoints",
+			expected: []string{
+				"table: 0 endpoints",
+				"preferPort: kept 0, dropped 0",
+				"routable: kept 0, dropped 0",
+				"dedupe: kept 0, dropped 0",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			alias := ServiceAliasConfig{PreferPort: tc.preferPort}
+			svc := ServiceUnit{EndpointTable: tc.endpoints}
+			if got := describeEndpointFiltering(alias, svc); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestGenerationComment(t *testing.T) {
+	defer func(clock func() time.Time) { generationClock = clock }(generationClock)
+	generationClock = func() time.Time {
+		return time.Date(2024, time.March, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+	}
+
+	testCases := []struct {
+		name     string
+		checksum string
+		prev     string
+		expected string
+	}{
+		{
+			name:     "changed checksum",
+			checksum: "abc123",
+			prev:     "def456",
+			expected: "# Generated at 2024-03-01T11:30:00Z (checksum abc123)",
+		},
+		{
+			name:     "first generation",
+			checksum: "abc123",
+			expected: "# Generated at 2024-03-01T11:30:00Z (checksum abc123)",
+		},
+		{
+			name:     "unchanged checksum",
+			checksum: "abc123",
+			prev:     "abc123",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := generationComment(tc.checksum, tc.prev); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestReferencedMapsExist(t *testing.T) {
+	generated := []string{
+		"/var/lib/haproxy/conf/os_http_be.map",
+		"/var/lib/haproxy/conf/os_edge_reencrypt_be.map",
+		"/var/lib/haproxy/conf/os_sni_passthrough.map",
+	}
+
+	testCases := []struct {
+		name       string
+		referenced []string
+		expected   []string
+	}{
+		{
+			name: "matching set",
+			referenced: []string{
+				"/var/lib/haproxy/conf/os_http_be.map",
+				"/var/lib/haproxy/conf//os_sni_passthrough.map",
+			},
+		},
+		{
+			name: "missing reference",
+			referenced: []string{
+				"/var/lib/haproxy/conf/os_http_be.map",
+				"/var/lib/haproxy/conf/os_edge_reencrpyt_be.map",
+				"/var/lib/haproxy/conf/os_tcp_be.map",
+				"/var/lib/haproxy/conf/os_edge_reencrpyt_be.map",
+			},
+			expected: []string{
+				"/var/lib/haproxy/conf/os_edge_reencrpyt_be.map",
+				"/var/lib/haproxy/conf/os_tcp_be.map",
+			},
+		},
+		{
+			name: "no references",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := referencedMapsExist(tc.referenced, generated); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestL4RateLimitTrack(t *testing.T) {
+	testCases := []struct {
+		name        string
+		termination routev1.TLSTerminationType
+		annotations map[string]string
+		table       string
+		expected    string
+	}{
+		{
+			name:        "rate limited passthrough route",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{
+				rateLimitAnnotation:               "true",
+				rateLimitAnnotation + ".rate-tcp": "100",
+			},
+			table:    "st_l4:ns:route",
+			expected: "tcp-request content track-sc1 src table st_l4:ns:route",
+		},
+		{
+			name:        "concurrency limited passthrough route without table",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{
+				rateLimitAnnotation:                     "true",
+				rateLimitAnnotation + ".concurrent-tcp": "10",
+			},
+			expected: "tcp-request content track-sc1 src",
+		},
+		{
+			name:        "passthrough route with only an http limit",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{
+				rateLimitAnnotation:                "true",
+				rateLimitAnnotation + ".rate-http": "100",
+			},
+			table:    "st_l4:ns:route",
+			expected: "",
+		},
+		{
+			name:        "rate limiting disabled",
+			termination: routev1.TLSTerminationPassthrough,
+			annotations: map[string]string{
+				rateLimitAnnotation:               "false",
+				rateLimitAnnotation + ".rate-tcp": "100",
+			},
+			table:    "st_l4:ns:route",
+			expected: "",
+		},
+		{
+			name:        "not rate limited passthrough route",
+			termination: routev1.TLSTerminationPassthrough,
+			table:       "st_l4:ns:route",
+			expected:    "",
+		},
+		{
+			name:        "rate limited edge route",
+			termination: routev1.TLSTerminationEdge,
+			annotations: map[string]string{
+				rateLimitAnnotation:               "true",
+				rateLimitAnnotation + ".rate-tcp": "100",
+			},
+			table:    "st_l4:ns:route",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{TLSTermination: tc.termination, Annotations: tc.annotations}
+			if got := l4RateLimitTrack(cfg, tc.table); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestReloadWarmupMaxConn(t *testing.T) {
+	testCases := []struct {
+		name     string
+		base     int
+		fraction int
+		expected int
+	}{
+		{
+			name:     "quarter",
+			base:     50000,
+			fraction: 25,
+			expected: 12500,
+		},
+		{
+			name:     "full",
+			base:     50000,
+			fraction: 100,
+			expected: 50000,
+		},
+		{
+			name:     "small base is kept positive",
+			base:     10,
+			fraction: 1,
+			expected: 1,
+		},
+		{
+			name:     "zero fraction",
+			base:     50000,
+			fraction: 0,
+			expected: 50000,
+		},
+		{
+			name:     "fraction over 100",
+			base:     50000,
+			fraction: 150,
+			expected: 50000,
+		},
+		{
+			name:     "negative fraction",
+			base:     50000,
+			fraction: -10,
+			expected: 50000,
+		},
+		{
+			name:     "unset base",
+			base:     0,
+			fraction: 50,
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := reloadWarmupMaxConn(tc.base, tc.fraction); got != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestChainIsComplete(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contents    string
+		expected    bool
+		expectError bool
+	}{
+		{
+			name:     "complete chain",
+			contents: strings.Join([]string{testPrivateKey, testCertificate, testCACertificate}, "\n"),
+			expected: true,
+		},
+		{
+			name:     "root certificate",
+			contents: testCACertificate,
+			expected: true,
+		},
+		{
+			name:     "leaf only",
+			contents: strings.Join([]string{testCertificate, testPrivateKey}, "\n"),
+			expected: false,
+		},
+		{
+			name:     "unrelated certificate in bundle",
+			contents: strings.Join([]string{testCertificate, testCertificateRsaSha1}, "\n"),
+			expected: false,
+		},
+		{
+			name:        "unparseable input",
+			contents:    "not a certificate",
+			expectError: true,
+		},
+		{
+			name:        "corrupt certificate",
+			contents:    "-----BEGIN CERTIFICATE-----\nMIIC\n-----END CERTIFICATE-----",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := chainIsComplete(tc.contents)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// generateTestSANCertificate returns a PEM encoded self-signed certificate
+// with the given DNS subject alternative names.
+func generateTestSANCertificate(t *testing.T, dnsNames ...string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sni.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestSNINamesForCert(t *testing.T) {
+	testCases := []struct {
+		name      string
+		contents  string
+		routeHost string
+		expected  []string
+	}{
+		{
+			name:      "single name certificate",
+			contents:  generateTestSANCertificate(t, "www.example.com"),
+			routeHost: "www.example.com",
+			expected:  []string{"www.example.com"},
+		},
+		{
+			name:      "multi san certificate",
+			contents:  testPrivateKey + "\n" + generateTestSANCertificate(t, "www.example.com", "Example.com", "api.example.com", "example.com"),
+			routeHost: "WWW.example.com",
+			expected:  []string{"www.example.com", "api.example.com", "example.com"},
+		},
+		{
+			name:      "wildcard certificate",
+			contents:  generateTestSANCertificate(t, "*.apps.example.com", "apps.example.com", "a*.example.com"),
+			routeHost: "wild.apps.example.com",
+			expected:  []string{"wild.apps.example.com", "*.apps.example.com", "apps.example.com"},
+		},
+		{
+			name:      "certificate without san",
+			contents:  testCertificate,
+			routeHost: "header.test",
+			expected:  []string{"header.test"},
+		},
+		{
+			name:      "unparseable certificate",
+			contents:  "not a certificate",
+			routeHost: "www.example.com",
+			expected:  []string{"www.example.com"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cert := Certificate{ID: "ns:route", Contents: tc.contents}
+			if got := sniNamesForCert(cert, tc.routeHost); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRouteChainIsComplete(t *testing.T) {
+	testCases := []struct {
+		name         string
+		certificates map[string]Certificate
+		expected     bool
+	}{
+		{
+			name: "chain in the ca certificate",
+			certificates: map[string]Certificate{
+				"www.example.com":                 {Contents: testCertificate, PrivateKey: testPrivateKey},
+				"www.example.com" + caCertPostfix: {Contents: testCACertificate},
+			},
+			expected: true,
+		},
+		{
+			name: "chain in the certificate",
+			certificates: map[string]Certificate{
+				"www.example.com": {Contents: testCertificate + "\n" + testCACertificate},
+			},
+			expected: true,
+		},
+		{
+			name: "unrelated ca certificate",
+			certificates: map[string]Certificate{
+				"www.example.com":                 {Contents: testCertificate},
+				"www.example.com" + caCertPostfix: {Contents: testCertificateRsaSha1},
+			},
+			expected: false,
+		},
+		{
+			name: "no ca certificate",
+			certificates: map[string]Certificate{
+				"www.example.com": {Contents: testCertificate},
+			},
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServiceAliasConfig{Host: "www.example.com", Certificates: tc.certificates}
+			got, err := routeChainIsComplete(cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -113,6 +113,7 @@ type Endpoint struct {
 	IdHash        string
 	NoHealthCheck bool
 	AppProtocol   string
+	Weight        string
 }
 
 // certificateManager provides the ability to write certificates for a ServiceAliasConfig